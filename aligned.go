@@ -0,0 +1,109 @@
+package tcmu
+
+import (
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// NewAlignedReadWriterAt wraps a backing store that only accepts I/O whose offset, length and memory buffer
+// are all multiples of `align` bytes, such as a file opened with O_DIRECT. Unaligned reads go through an
+// aligned bounce buffer, and unaligned writes become read-modify-write cycles of the surrounding aligned
+// blocks. `align` must be a power of two.
+//
+// This is what lets a 512e device, which accepts 512 byte logical block writes, sit on top of storage with
+// 4K physical blocks.
+func NewAlignedReadWriterAt(rw ReadWriterAt, align int) ReadWriterAt {
+	if align <= 0 || align&(align-1) != 0 {
+		panic("alignment needs to be a power of two")
+	}
+	return &alignedReadWriterAt{rw: rw, align: int64(align)}
+}
+
+type alignedReadWriterAt struct {
+	rw    ReadWriterAt
+	align int64
+	// Read-modify-write cycles hold the write lock, so that no other write to
+	// the blocks they touch can land between their read and their write.
+	// Aligned writes only need the read lock.
+	mu sync.RWMutex
+}
+
+func (a *alignedReadWriterAt) aligned(p []byte, off int64) bool {
+	return off&(a.align-1) == 0 && int64(len(p))&(a.align-1) == 0 &&
+		(len(p) == 0 || uintptr(unsafe.Pointer(&p[0]))&uintptr(a.align-1) == 0)
+}
+
+// span returns the aligned region covering [off, off+n).
+func (a *alignedReadWriterAt) span(off int64, n int) (int64, int64) {
+	start := off &^ (a.align - 1)
+	end := (off + int64(n) + a.align - 1) &^ (a.align - 1)
+	return start, end
+}
+
+func (a *alignedReadWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	if a.aligned(p, off) {
+		return a.rw.ReadAt(p, off)
+	}
+	start, end := a.span(off, len(p))
+	buf := alignedBuffer(int(end-start), int(a.align))
+	n, err := a.rw.ReadAt(buf, start)
+	// Only what was read past off is ours to return.
+	n -= int(off - start)
+	if n < 0 {
+		n = 0
+	}
+	n = copy(p, buf[off-start:int(off-start)+n])
+	if n == len(p) && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (a *alignedReadWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if a.aligned(p, off) {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return a.rw.WriteAt(p, off)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	start, end := a.span(off, len(p))
+	buf := alignedBuffer(int(end-start), int(a.align))
+	// Blocks past the end of the store read short; they are written back as
+	// zeroes around the new data.
+	if _, err := a.rw.ReadAt(buf, start); err != nil && err != io.EOF {
+		return 0, err
+	}
+	copy(buf[off-start:], p)
+	n, err := a.rw.WriteAt(buf, start)
+	n -= int(off - start)
+	if n < 0 {
+		n = 0
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	return n, err
+}
+
+// alignedBuffer allocates n bytes starting at a memory address that is a multiple of align.
+func alignedBuffer(n int, align int) []byte {
+	buf := make([]byte, n+align)
+	skew := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(align-1))
+	if skew != 0 {
+		skew = align - skew
+	}
+	return buf[skew : skew+n]
+}
+
+// SyncRange passes FUA flushes through to the wrapped store.
+func (a *alignedReadWriterAt) SyncRange(off, length int64) error {
+	switch s := a.rw.(type) {
+	case RangeSyncer:
+		return s.SyncRange(off, length)
+	case Syncer:
+		return s.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// ALUAState is an asymmetric access state of a target port group.
+type ALUAState byte
+
+const (
+	ALUAActiveOptimized    ALUAState = 0x0
+	ALUAActiveNonOptimized ALUAState = 0x1
+	ALUAStandby            ALUAState = 0x2
+	ALUAUnavailable        ALUAState = 0x3
+	ALUAOffline            ALUAState = 0xe
+	ALUATransitioning      ALUAState = 0xf
+)
+
+func (s ALUAState) valid() bool {
+	switch s {
+	case ALUAActiveOptimized, ALUAActiveNonOptimized, ALUAStandby, ALUAUnavailable, ALUAOffline, ALUATransitioning:
+		return true
+	}
+	return false
+}
+
+// Status codes of a target port group, telling why it last changed state.
+const (
+	aluaStatusNone     = 0x00
+	aluaStatusExplicit = 0x01
+	aluaStatusImplicit = 0x02
+)
+
+// ALUAGroup describes a target port group of a device with asymmetric logical unit access.
+type ALUAGroup struct {
+	// The name of the group in configfs.
+	Name string
+	// The target port group identifier, which must not be 0.
+	ID uint16
+	// The initial asymmetric access state.
+	State ALUAState
+	// Implicit transitions are made by the device, with
+	// Device.SetALUAState. Explicit ones are requested by initiators, with
+	// SET TARGET PORT GROUPS. A group with explicit transitions must have
+	// implicit ones too, as the kernel only takes the state of such groups.
+	Implicit bool
+	Explicit bool
+	// Set the PREF bit, for the group initiators should prefer.
+	Preferred bool
+	// The relative target port identifiers of the ports in the group.
+	Ports []uint16
+}
+
+// aluaGroup is the runtime state of an ALUAGroup.
+type aluaGroup struct {
+	ALUAGroup
+	status byte
+}
+
+// checkALUAGroups rejects target port groups the kernel cannot be told about.
+func checkALUAGroups(groups []ALUAGroup) error {
+	for _, g := range groups {
+		if g.ID == 0 {
+			return fmt.Errorf("target port group %s has identifier 0", g.Name)
+		}
+		if g.Explicit && !g.Implicit {
+			return fmt.Errorf("target port group %s has explicit transitions but not implicit ones", g.Name)
+		}
+	}
+	return nil
+}
+
+func newALUAGroups(groups []ALUAGroup) []aluaGroup {
+	g := make([]aluaGroup, len(groups))
+	for i := range groups {
+		g[i].ALUAGroup = groups[i]
+		g[i].Ports = append([]uint16(nil), groups[i].Ports...)
+	}
+	return g
+}
+
+// aluaTPGS returns the TPGS field of the standard INQUIRY data: bit 0 for implicit and bit 1 for explicit
+// asymmetric access.
+func (d *Device) aluaTPGS() byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var tpgs byte
+	for _, g := range d.alua {
+		if g.Implicit {
+			tpgs |= 0x01
+		}
+		if g.Explicit {
+			tpgs |= 0x02
+		}
+	}
+	return tpgs
+}
+
+// ALUAGroups returns the target port groups of the device, in their current state.
+func (d *Device) ALUAGroups() []ALUAGroup {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	groups := make([]ALUAGroup, len(d.alua))
+	for i, g := range d.alua {
+		groups[i] = g.ALUAGroup
+		groups[i].Ports = append([]uint16(nil), g.Ports...)
+	}
+	return groups
+}
+
+// SetALUAState makes an implicit transition of the target port group `id` to `state`, eg. to
+// ALUATransitioning and then to ALUAStandby on failover. The kernel is told about the change through
+// configfs, and the initiator with an ASYMMETRIC ACCESS STATE CHANGED unit attention.
+func (d *Device) SetALUAState(id uint16, state ALUAState) error {
+	if !state.valid() {
+		return fmt.Errorf("invalid ALUA state 0x%x", byte(state))
+	}
+	d.aluaMu.Lock()
+	defer d.aluaMu.Unlock()
+	d.mu.Lock()
+	g := d.aluaGroup(id)
+	if g == nil {
+		d.mu.Unlock()
+		return fmt.Errorf("no target port group %d", id)
+	}
+	if !g.Implicit {
+		d.mu.Unlock()
+		return fmt.Errorf("target port group %d does not support implicit transitions", id)
+	}
+	if g.State == state {
+		g.status = aluaStatusImplicit
+		d.mu.Unlock()
+		return nil
+	}
+	d.mu.Unlock()
+	// The kernel is told first, so that if it refuses, both keep the old state.
+	if err := d.writeALUAState(g.Name, state); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	g.State = state
+	g.status = aluaStatusImplicit
+	d.mu.Unlock()
+	d.RaiseUnitAttention(scsi.AscAsymmetricAccessStateChanged)
+	return nil
+}
+
+// aluaGroup returns the group with identifier `id`. Must be called with mu held.
+func (d *Device) aluaGroup(id uint16) *aluaGroup {
+	for i := range d.alua {
+		if d.alua[i].ID == id {
+			return &d.alua[i]
+		}
+	}
+	return nil
+}
+
+// aluaDir returns the configfs directory of a target port group of the device.
+func (d *Device) aluaDir(name string) string {
+	return path.Join(d.hbaDir, d.scsi.VolumeName, "alua", name)
+}
+
+// createALUAGroups creates the target port groups of the device in configfs, so that the kernel reports
+// the same states as the device. The states are enforced by checkALUAState.
+func (d *Device) createALUAGroups() error {
+	for _, g := range d.scsi.ALUAGroups {
+		var accessType int
+		if g.Implicit {
+			accessType |= 1
+		}
+		if g.Explicit {
+			accessType |= 2
+		}
+		dir := d.aluaDir(g.Name)
+		// The identifier must come first; the kernel refuses the other
+		// attributes of a group without one.
+		attrs := []struct{ name, value string }{
+			{"tg_pt_gp_id", strconv.Itoa(int(g.ID))},
+			{"alua_access_type", strconv.Itoa(accessType)},
+			{"preferred", strconv.Itoa(int(boolValue(g.Preferred)))},
+		}
+		if g.Implicit {
+			attrs = append(attrs, struct{ name, value string }{"alua_access_state", strconv.Itoa(int(g.State))})
+		}
+		for _, a := range attrs {
+			if err := d.writeLines(path.Join(dir, a.name), []string{a.value}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// joinALUAGroup moves the LUN of the loopback port into the first target port group.
+func (d *Device) joinALUAGroup(lunPath string) error {
+	if len(d.scsi.ALUAGroups) == 0 {
+		return nil
+	}
+	return d.writeLines(path.Join(lunPath, "alua_tg_pt_gp"), []string{d.scsi.ALUAGroups[0].Name})
+}
+
+// writeALUAState updates the state of a target port group in configfs.
+func (d *Device) writeALUAState(name string, state ALUAState) error {
+	if d.hbaDir == "" {
+		// Not attached to the kernel.
+		return nil
+	}
+	return d.writeLines(path.Join(d.aluaDir(name), "alua_access_state"), []string{strconv.Itoa(int(state))})
+}
+
+// checkALUAState rejects a read or write of the medium while the target port group of the loopback port
+// is in a state that does not allow it.
+func checkALUAState(cmd *SCSICmd) (SCSIResponse, bool) {
+	if !isReadCommand(cmd) && !isWriteCommand(cmd) {
+		return SCSIResponse{}, true
+	}
+	d := cmd.Device()
+	d.mu.Lock()
+	if len(d.alua) == 0 {
+		d.mu.Unlock()
+		return SCSIResponse{}, true
+	}
+	state := d.alua[0].State
+	d.mu.Unlock()
+	var asc uint16
+	switch state {
+	case ALUATransitioning:
+		asc = scsi.AscAsymmetricAccessStateTransition
+	case ALUAStandby:
+		asc = scsi.AscTargetPortInStandbyState
+	case ALUAUnavailable:
+		asc = scsi.AscTargetPortInUnavailableState
+	case ALUAOffline:
+		asc = scsi.AscLogicalUnitNotReadyOffline
+	default:
+		return SCSIResponse{}, true
+	}
+	return cmd.CheckCondition(scsi.SenseNotReady, asc), false
+}
+
+// targetPortGroupDesignators returns the target port group and relative target port designators of the
+// Device Identification VPD page, for the first target port group and its first port.
+func targetPortGroupDesignators(d *Device) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.alua) == 0 {
+		return nil
+	}
+	g := d.alua[0]
+	var data []byte
+	if len(g.Ports) > 0 {
+		// Association: target port; identifier: relative target port.
+		data = append(data, 0x01, 0x14, 0, 4, 0, 0, byte(g.Ports[0]>>8), byte(g.Ports[0]))
+	}
+	// Association: target port; identifier: target port group.
+	return append(data, 0x01, 0x15, 0, 4, 0, 0, byte(g.ID>>8), byte(g.ID))
+}
+
+// EmulateReportTargetPortGroups answers REPORT TARGET PORT GROUPS with the groups of the device, in the
+// length only or the extended header format.
+func EmulateReportTargetPortGroups(cmd *SCSICmd) (SCSIResponse, error) {
+	d := cmd.Device()
+	allocLen := int(binary.BigEndian.Uint32(cmd.cdb[6:10]))
+	extended := cmd.GetCDB(1)&0xe0 == scsi.MiExtHdrParamFmt
+
+	d.mu.Lock()
+	if len(d.alua) == 0 {
+		d.mu.Unlock()
+		return cmd.NotHandled(), nil
+	}
+	hdr := 4
+	if extended {
+		hdr = 8
+	}
+	data := make([]byte, hdr)
+	for _, g := range d.alua {
+		desc := make([]byte, 8+4*len(g.Ports))
+		desc[0] = byte(g.State)
+		if g.Preferred {
+			desc[0] |= 0x80
+		}
+		// T_SUP, O_SUP, U_SUP, S_SUP, AN_SUP and AO_SUP.
+		desc[1] = 0xcf
+		binary.BigEndian.PutUint16(desc[2:4], g.ID)
+		desc[5] = g.status
+		desc[7] = byte(len(g.Ports))
+		for i, p := range g.Ports {
+			binary.BigEndian.PutUint16(desc[8+4*i+2:], p)
+		}
+		data = append(data, desc...)
+	}
+	d.mu.Unlock()
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)-4))
+	if extended {
+		data[4] = 0x10 // format type 1; no implicit transition time
+	}
+	return writeTruncated(cmd, data, allocLen)
+}
+
+// EmulateSetTargetPortGroups handles SET TARGET PORT GROUPS, for explicit transitions. Every descriptor is
+// checked before any group changes state.
+func EmulateSetTargetPortGroups(cmd *SCSICmd) (SCSIResponse, error) {
+	d := cmd.Device()
+	n := int(binary.BigEndian.Uint32(cmd.cdb[6:10]))
+	if n < 4 {
+		return cmd.Ok(), nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cmd, buf); err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	buf = buf[4:]
+	if len(buf)%4 != 0 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+
+	d.aluaMu.Lock()
+	defer d.aluaMu.Unlock()
+	d.mu.Lock()
+	if len(d.alua) == 0 {
+		d.mu.Unlock()
+		return cmd.NotHandled(), nil
+	}
+	type transition struct {
+		g        *aluaGroup
+		from, to ALUAState
+	}
+	var ts []transition
+	for ; len(buf) > 0; buf = buf[4:] {
+		state := ALUAState(buf[0] & 0x0f)
+		g := d.aluaGroup(binary.BigEndian.Uint16(buf[2:4]))
+		if g == nil || !g.Explicit || !state.valid() || state == ALUATransitioning {
+			d.mu.Unlock()
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+		ts = append(ts, transition{g, g.State, state})
+	}
+	d.mu.Unlock()
+
+	// The kernel is told first. If it refuses a state, the groups it has
+	// already taken are put back, and every group keeps its old state.
+	for i, t := range ts {
+		log.Debugf("SET TARGET PORT GROUPS: group %d to state 0x%x\n", t.g.ID, byte(t.to))
+		if err := d.writeALUAState(t.g.Name, t.to); err != nil {
+			log.Errorf("updating target port group %s: %v", t.g.Name, err)
+			for j := i - 1; j >= 0; j-- {
+				if err := d.writeALUAState(ts[j].g.Name, ts[j].from); err != nil {
+					log.Errorf("restoring target port group %s: %v", ts[j].g.Name, err)
+				}
+			}
+			return cmd.TargetFailure(), nil
+		}
+	}
+	d.mu.Lock()
+	for _, t := range ts {
+		t.g.State = t.to
+		t.g.status = aluaStatusExplicit
+	}
+	d.mu.Unlock()
+	return cmd.Ok(), nil
+}
@@ -0,0 +1,354 @@
+package tcmu
+
+import (
+	"encoding/binary"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// ATA commands answered by EmulateATAPassThrough.
+const (
+	ataCheckPowerMode = 0xe5
+	ataIdentifyDevice = 0xec
+	ataSMART          = 0xb0
+)
+
+// Features of the ATA SMART command.
+const (
+	smartReadData         = 0xd0
+	smartReadThresholds   = 0xd1
+	smartEnableOperations = 0xd8
+	smartReturnStatus     = 0xda
+)
+
+// ATA status and error register bits.
+const (
+	ataStatusErr  = 0x01
+	ataStatusDRDY = 0x40
+	ataStatusDSC  = 0x10
+	ataErrorAbrt  = 0x04
+)
+
+const (
+	ataSectorSize = 512
+	// SMART commands carry these values in LBA Mid and LBA High. RETURN STATUS swaps them for the second
+	// pair when an attribute has crossed its threshold.
+	smartLBAMid          = 0x4f
+	smartLBAHigh         = 0xc2
+	smartLBAMidExceeded  = 0xf4
+	smartLBAHighExceeded = 0x2c
+	maxSMARTAttributes   = 30
+)
+
+// SMARTAttribute is one attribute of the SMART READ DATA and SMART READ THRESHOLDS responses.
+type SMARTAttribute struct {
+	ID    byte
+	Flags uint16
+	// The normalized value and the worst one seen.
+	Value byte
+	Worst byte
+	// SMART RETURN STATUS reports a failure once Value is at or below Threshold. A zero Threshold never
+	// trips.
+	Threshold byte
+	// Only the low 48 bits of the raw value are reported.
+	Raw uint64
+}
+
+// HealthProvider supplies the SMART attributes reported through ATA PASS-THROUGH. At most thirty
+// attributes are reported.
+type HealthProvider interface {
+	SMARTAttributes() []SMARTAttribute
+}
+
+// defaultSMARTAttributes are reported for a device without a HealthProvider: the power on hours and a
+// single power cycle.
+func defaultSMARTAttributes(d *Device) []SMARTAttribute {
+	return []SMARTAttribute{
+		{ID: 9, Flags: 0x0032, Value: 100, Worst: 100, Raw: uint64(d.powerOnHours())},
+		{ID: 12, Flags: 0x0032, Value: 100, Worst: 100, Raw: 1},
+	}
+}
+
+func (d *Device) smartAttributes() []SMARTAttribute {
+	var attrs []SMARTAttribute
+	if d.scsi.Health != nil {
+		attrs = d.scsi.Health.SMARTAttributes()
+	} else {
+		attrs = defaultSMARTAttributes(d)
+	}
+	if len(attrs) > maxSMARTAttributes {
+		attrs = attrs[:maxSMARTAttributes]
+	}
+	return attrs
+}
+
+// ataRegisters are the ATA task file registers of a pass-through command, and of its result.
+type ataRegisters struct {
+	Extend   bool
+	Features uint16
+	Error    byte
+	Count    uint16
+	LBA      uint64
+	Device   byte
+	Command  byte
+	Status   byte
+}
+
+// ataPassThroughRegisters decodes the registers of an ATA PASS-THROUGH (12) or (16) command.
+func ataPassThroughRegisters(cmd *SCSICmd) ataRegisters {
+	c := cmd.cdb
+	if cmd.Command() == scsi.AtaPassThrough12 {
+		return ataRegisters{
+			Features: uint16(c[3]),
+			Count:    uint16(c[4]),
+			LBA:      uint64(c[7])<<16 | uint64(c[6])<<8 | uint64(c[5]),
+			Device:   c[8],
+			Command:  c[9],
+		}
+	}
+	return ataRegisters{
+		Extend:   c[1]&0x01 != 0,
+		Features: uint16(c[3])<<8 | uint16(c[4]),
+		Count:    uint16(c[5])<<8 | uint16(c[6]),
+		LBA: uint64(c[11])<<40 | uint64(c[9])<<32 | uint64(c[7])<<24 |
+			uint64(c[12])<<16 | uint64(c[10])<<8 | uint64(c[8]),
+		Device:  c[13],
+		Command: c[14],
+	}
+}
+
+// lbaMidHigh returns the LBA Mid and LBA High registers.
+func (r ataRegisters) lbaMidHigh() (byte, byte) {
+	return byte(r.LBA >> 8), byte(r.LBA >> 16)
+}
+
+// returnDescriptor encodes the registers as an ATA Status Return sense data descriptor.
+func (r ataRegisters) returnDescriptor() []byte {
+	d := make([]byte, 14)
+	d[0] = 0x09
+	d[1] = 0x0c
+	if r.Extend {
+		d[2] = 0x01
+	}
+	d[3] = r.Error
+	d[4] = byte(r.Count >> 8)
+	d[5] = byte(r.Count)
+	d[6] = byte(r.LBA >> 24)
+	d[7] = byte(r.LBA)
+	d[8] = byte(r.LBA >> 32)
+	d[9] = byte(r.LBA >> 8)
+	d[10] = byte(r.LBA >> 40)
+	d[11] = byte(r.LBA >> 16)
+	d[12] = r.Device
+	d[13] = r.Status
+	return d
+}
+
+// ataResponse returns CHECK CONDITION with descriptor format sense data carrying the result registers.
+func ataResponse(cmd *SCSICmd, key byte, asc uint16, r ataRegisters) SCSIResponse {
+	buf := make([]byte, tcmuSenseBufferSize)
+	buf[0] = 0x72 /* descriptor, current */
+	buf[1] = key
+	buf[2] = byte(asc >> 8)
+	buf[3] = byte(asc)
+	desc := r.returnDescriptor()
+	buf[7] = byte(len(desc))
+	copy(buf[8:], desc)
+	return cmd.RespondSenseData(scsi.SamStatCheckCondition, buf)
+}
+
+// EmulateATAPassThrough answers ATA PASS-THROUGH (12) and (16) as a SCSI to ATA translation layer in front
+// of an ATA disk would, for the commands monitoring tools send: IDENTIFY DEVICE, CHECK POWER MODE and the
+// SMART READ DATA, READ THRESHOLDS, ENABLE OPERATIONS and RETURN STATUS features. Any other ATA command is
+// aborted by the emulated device. The SMART attributes come from the HealthProvider of the SCSIHandler.
+func EmulateATAPassThrough(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
+	d := cmd.Device()
+	regs := ataPassThroughRegisters(cmd)
+	ckCond := cmd.GetCDB(2)&0x20 != 0
+	log.Debugf("ATA pass-through command 0x%x features 0x%x\n", regs.Command, regs.Features)
+
+	var data []byte
+	out := regs
+	out.Error = 0
+	out.Status = ataStatusDRDY | ataStatusDSC
+	switch regs.Command {
+	case ataIdentifyDevice:
+		data = ataIdentifyData(d, inq)
+	case ataCheckPowerMode:
+		// Active or idle.
+		out.Count = 0xff
+	case ataSMART:
+		mid, high := regs.lbaMidHigh()
+		if mid != smartLBAMid || high != smartLBAHigh {
+			return ataAbort(cmd, regs), nil
+		}
+		switch regs.Features {
+		case smartReadData:
+			data = smartData(d.smartAttributes())
+		case smartReadThresholds:
+			data = smartThresholds(d.smartAttributes())
+		case smartEnableOperations:
+		case smartReturnStatus:
+			for _, a := range d.smartAttributes() {
+				if a.Threshold != 0 && a.Value <= a.Threshold {
+					out.LBA = out.LBA&^0xffff00 | smartLBAHighExceeded<<16 | smartLBAMidExceeded<<8
+					break
+				}
+			}
+		default:
+			return ataAbort(cmd, regs), nil
+		}
+	default:
+		return ataAbort(cmd, regs), nil
+	}
+
+	if data != nil {
+		if _, err := writeTruncated(cmd, data, dataInLen(cmd)); err != nil {
+			return SCSIResponse{}, err
+		}
+	}
+	if ckCond {
+		return ataResponse(cmd, scsi.SenseRecoveredError, scsi.AscAtaInformationAvailable, out), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// ataAbort is the response for an ATA command the emulated device does not support.
+func ataAbort(cmd *SCSICmd, regs ataRegisters) SCSIResponse {
+	regs.Error = ataErrorAbrt
+	regs.Status = ataStatusDRDY | ataStatusDSC | ataStatusErr
+	return ataResponse(cmd, scsi.SenseAbortedCommand, scsi.AscNoAdditionalSense, regs)
+}
+
+// dataInLen returns the size of the buffers for data returned to the initiator.
+func dataInLen(cmd *SCSICmd) int {
+	n := 0
+	for _, v := range cmd.DataInVecs() {
+		n += len(v)
+	}
+	return n
+}
+
+// ataString stores `s` in an IDENTIFY DEVICE string field, which swaps the bytes of every word.
+func ataString(dst []byte, s string) {
+	b := FixedString(s, len(dst))
+	for i := 0; i+1 < len(b); i += 2 {
+		dst[i], dst[i+1] = b[i+1], b[i]
+	}
+}
+
+// ataChecksum sets the last byte of a 512 byte structure so that all of its bytes add up to zero.
+func ataChecksum(data []byte) {
+	var sum byte
+	for _, b := range data[:ataSectorSize-1] {
+		sum += b
+	}
+	data[ataSectorSize-1] = -sum
+}
+
+// ataIdentifyData builds the IDENTIFY DEVICE data of the emulated disk, with the model, serial number and
+// firmware revision taken from `inq`.
+func ataIdentifyData(d *Device, inq *InquiryInfo) []byte {
+	sizes := d.Sizes()
+	sectors := uint64(sizes.VolumeSize / sizes.BlockSize)
+	data := make([]byte, ataSectorSize)
+	word := func(n int, v uint16) {
+		binary.LittleEndian.PutUint16(data[2*n:], v)
+	}
+	word(0, 0x0040) // fixed device
+	ataString(data[20:40], inq.SerialNumber)
+	ataString(data[46:54], d.productRev(inq))
+	ataString(data[54:94], inq.VendorID+" "+inq.ProductID)
+	word(47, 0x8001)
+	word(49, 0x0300) // LBA and DMA supported
+	word(50, 0x4000)
+	word(53, 0x0006)
+	lba28 := sectors
+	if lba28 > 0x0fffffff {
+		lba28 = 0x0fffffff
+	}
+	word(60, uint16(lba28))
+	word(61, uint16(lba28>>16))
+	word(80, 0x01f0) // ATA/ATAPI-4 to ATA8-ACS
+	word(82, 0x0001) // SMART supported
+	word(83, 0x4400) // 48-bit addresses supported
+	word(84, 0x4000)
+	word(85, 0x0001) // SMART enabled
+	word(86, 0x0400) // 48-bit addresses enabled
+	word(87, 0x4000)
+	for i := 0; i < 4; i++ {
+		word(100+i, uint16(sectors>>(16*uint(i))))
+	}
+	sectorSize := uint16(0x4000)
+	if exp := d.scsi.PhysicalBlockExponent; exp != 0 {
+		sectorSize |= 0x2000 | uint16(exp&0x0f)
+	}
+	if sizes.BlockSize != ataSectorSize {
+		sectorSize |= 0x1000
+		words := uint32(sizes.BlockSize / 2)
+		word(117, uint16(words))
+		word(118, uint16(words>>16))
+	}
+	word(106, sectorSize)
+	word(217, 0x0001) // non-rotating
+	data[510] = 0xa5
+	ataChecksum(data)
+	return data
+}
+
+// smartData builds the SMART READ DATA response.
+func smartData(attrs []SMARTAttribute) []byte {
+	data := make([]byte, ataSectorSize)
+	binary.LittleEndian.PutUint16(data[0:2], 0x0010)
+	for i, a := range attrs {
+		e := data[2+12*i : 2+12*(i+1)]
+		e[0] = a.ID
+		binary.LittleEndian.PutUint16(e[1:3], a.Flags)
+		e[3] = a.Value
+		e[4] = a.Worst
+		for j := 0; j < 6; j++ {
+			e[5+j] = byte(a.Raw >> (8 * uint(j)))
+		}
+	}
+	binary.LittleEndian.PutUint16(data[368:370], 0x0003) // SMART capability: saves data over power cycles
+	ataChecksum(data)
+	return data
+}
+
+// smartThresholds builds the SMART READ THRESHOLDS response.
+func smartThresholds(attrs []SMARTAttribute) []byte {
+	data := make([]byte, ataSectorSize)
+	binary.LittleEndian.PutUint16(data[0:2], 0x0010)
+	for i, a := range attrs {
+		data[2+12*i] = a.ID
+		data[3+12*i] = a.Threshold
+	}
+	ataChecksum(data)
+	return data
+}
+
+// hasATAInformation reports whether EmulateEvpdInquiry serves the ATA Information VPD page for `inq`.
+func hasATAInformation(inq *InquiryInfo) bool {
+	return inq.ATAInformation && inq.DeviceType == scsi.TypeDisk
+}
+
+// ataInformationVPD builds the ATA Information VPD page (0x89), which carries the IDENTIFY DEVICE data.
+func ataInformationVPD(cmd *SCSICmd, inq *InquiryInfo) []byte {
+	data := make([]byte, 60+ataSectorSize)
+	data[0] = inq.peripheral()
+	data[1] = 0x89
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-4))
+	copy(data[8:16], FixedString("go-tcmu", 8))
+	copy(data[16:32], FixedString("SAT emulation", 16))
+	copy(data[32:36], FixedString(cmd.Device().productRev(inq), 4))
+	// The device signature, as a Register - Device to Host FIS.
+	data[36] = 0x34
+	data[38] = ataStatusDRDY | ataStatusDSC
+	data[39] = 0x01
+	data[40] = 0x01 // LBA Low
+	data[48] = 0x01 // Count
+	data[56] = ataIdentifyDevice
+	copy(data[60:], ataIdentifyData(cmd.Device(), inq))
+	return data
+}
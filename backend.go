@@ -0,0 +1,50 @@
+package tcmu
+
+// Optional interfaces a backing store may implement in addition to io.ReaderAt and io.WriterAt. The Emulate
+// functions check for them and fall back to the plain interfaces if they are missing.
+
+// IOFlags carries the per-command caching hints from the CDB down to the backing store.
+type IOFlags uint8
+
+const (
+	// FlagFUA (Force Unit Access) asks for a write that is durable once it returns, or a read that does not
+	// come from a volatile cache.
+	FlagFUA IOFlags = 1 << iota
+	// FlagDPO (Disable Page Out) hints that the data is unlikely to be accessed again soon, and need not be
+	// kept in any cache.
+	FlagDPO
+)
+
+// FlagReaderAt is a ReaderAt that understands FUA and DPO.
+type FlagReaderAt interface {
+	ReadAtFlags(p []byte, off int64, flags IOFlags) (n int, err error)
+}
+
+// FlagWriterAt is a WriterAt that understands FUA and DPO. A FUA write must be on stable storage once
+// WriteAtFlags returns.
+type FlagWriterAt interface {
+	WriteAtFlags(p []byte, off int64, flags IOFlags) (n int, err error)
+}
+
+// AtomicWriterAt is a WriterAt that can write a buffer all-or-nothing: after a crash, the range holds
+// either all of the old data or all of the new, never a mix. Concurrent readers must not observe a partly
+// applied write either.
+type AtomicWriterAt interface {
+	WriteAtAtomic(p []byte, off int64) (n int, err error)
+}
+
+// RangeVerifier checks a byte range of the backing store against its own checksums, without returning the
+// data. Self-tests use it in preference to reading the range.
+type RangeVerifier interface {
+	VerifyRange(off, length int64) error
+}
+
+// RangeSyncer flushes a byte range of the backing store to stable storage.
+type RangeSyncer interface {
+	SyncRange(off, length int64) error
+}
+
+// Syncer flushes the whole backing store to stable storage. *os.File implements it.
+type Syncer interface {
+	Sync() error
+}
@@ -0,0 +1,230 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// WRITE BUFFER and READ BUFFER modes.
+const (
+	bufferModeCombined              = 0x00
+	bufferModeData                  = 0x02
+	bufferModeDescriptor            = 0x03
+	bufferModeMicrocode             = 0x04
+	bufferModeMicrocodeSave         = 0x05
+	bufferModeMicrocodeOffsets      = 0x06
+	bufferModeMicrocodeOffsetsSave  = 0x07
+	bufferModeEcho                  = 0x0a
+	bufferModeEchoDescriptor        = 0x0b
+	bufferModeMicrocodeSelectDefer  = 0x0d
+	bufferModeMicrocodeOffsetsDefer = 0x0e
+	bufferModeActivateDeferred      = 0x0f
+)
+
+const (
+	dataBufferSize   = 64 * 1024
+	echoBufferSize   = 4096
+	maxMicrocodeSize = 16 * 1024 * 1024
+)
+
+// FirmwareFunc installs a microcode image downloaded with WRITE BUFFER, once it is activated. `save` is set
+// if the image should survive a restart. It returns the product revision the device reports from then on.
+// An error rejects the image, and the device keeps its revision.
+type FirmwareFunc func(image []byte, save bool) (revision string, err error)
+
+// bufferState holds what WRITE BUFFER has sent to a device.
+type bufferState struct {
+	data []byte
+	echo []byte
+	// The microcode image being downloaded in segments, and the length of
+	// its first segment.
+	microcode    []byte
+	firstSegment int
+	// A complete image waits for ACTIVATE DEFERRED MICROCODE.
+	deferred bool
+}
+
+// productRev returns the product revision of the device: that of the microcode activated with WRITE
+// BUFFER, or else the one in `inq`.
+func (d *Device) productRev(inq *InquiryInfo) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.revision != "" {
+		return d.revision
+	}
+	return inq.ProductRev
+}
+
+func bufferField(cmd *SCSICmd, i int) int {
+	return int(cmd.GetCDB(i))<<16 | int(cmd.GetCDB(i+1))<<8 | int(cmd.GetCDB(i+2))
+}
+
+// EmulateWriteBuffer handles WRITE BUFFER in the data, echo buffer and download microcode modes. Microcode
+// is passed to the FirmwareFunc of the SCSIHandler when it is activated, which reports a MICROCODE HAS
+// BEEN CHANGED unit attention; without one, microcode downloads are refused.
+//
+// In the modes with offsets, the segments must arrive in order. The image is complete once the
+// FirmwareSize of the SCSIHandler has arrived or, without one, once a segment shorter than the first, or
+// empty, arrives. The deferred modes instead wait for ACTIVATE DEFERRED MICROCODE.
+func EmulateWriteBuffer(cmd *SCSICmd) (SCSIResponse, error) {
+	d := cmd.Device()
+	mode := cmd.GetCDB(1) & 0x1f
+	id := cmd.GetCDB(2)
+	off := bufferField(cmd, 3)
+	n := bufferField(cmd, 6)
+	log.Debugf("WRITE BUFFER mode 0x%x offset %d length %d\n", mode, off, n)
+
+	switch mode {
+	case bufferModeData, bufferModeEcho:
+	case bufferModeMicrocode, bufferModeMicrocodeSave,
+		bufferModeMicrocodeOffsets, bufferModeMicrocodeOffsetsSave,
+		bufferModeMicrocodeSelectDefer, bufferModeMicrocodeOffsetsDefer, bufferModeActivateDeferred:
+		if d.scsi.Firmware == nil {
+			return cmd.IllegalRequest(), nil
+		}
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	if n > maxMicrocodeSize {
+		return cmd.IllegalRequest(), nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cmd, buf); err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+
+	d.mu.Lock()
+	b := &d.buffers
+	switch mode {
+	case bufferModeData:
+		if id != 0 || off+n > dataBufferSize {
+			d.mu.Unlock()
+			return cmd.IllegalRequest(), nil
+		}
+		if b.data == nil {
+			b.data = make([]byte, dataBufferSize)
+		}
+		copy(b.data[off:], buf)
+		d.mu.Unlock()
+		return cmd.Ok(), nil
+	case bufferModeEcho:
+		if n > echoBufferSize {
+			d.mu.Unlock()
+			return cmd.IllegalRequest(), nil
+		}
+		b.echo = buf
+		d.mu.Unlock()
+		return cmd.Ok(), nil
+	case bufferModeMicrocode, bufferModeMicrocodeSave:
+		if off != 0 {
+			d.mu.Unlock()
+			return cmd.IllegalRequest(), nil
+		}
+		b.microcode, b.deferred = nil, false
+		d.mu.Unlock()
+		return activateMicrocode(cmd, buf, mode == bufferModeMicrocodeSave)
+	case bufferModeActivateDeferred:
+		image, deferred := b.microcode, b.deferred
+		b.microcode, b.deferred = nil, false
+		d.mu.Unlock()
+		if !deferred {
+			return cmd.Ok(), nil
+		}
+		return activateMicrocode(cmd, image, true)
+	}
+
+	// The modes with offsets.
+	if off == 0 {
+		b.microcode, b.firstSegment, b.deferred = nil, n, false
+	}
+	limit := maxMicrocodeSize
+	if d.scsi.FirmwareSize != 0 {
+		limit = d.scsi.FirmwareSize
+	}
+	if off != len(b.microcode) || off+n > limit {
+		b.microcode = nil
+		d.mu.Unlock()
+		return cmd.IllegalRequest(), nil
+	}
+	b.microcode = append(b.microcode, buf...)
+	if mode == bufferModeMicrocodeSelectDefer || mode == bufferModeMicrocodeOffsetsDefer {
+		b.deferred = true
+		d.mu.Unlock()
+		return cmd.Ok(), nil
+	}
+	more := off != 0 && n >= b.firstSegment || off == 0 && n != 0
+	if d.scsi.FirmwareSize != 0 {
+		more = len(b.microcode) < d.scsi.FirmwareSize
+	}
+	if more {
+		d.mu.Unlock()
+		return cmd.Ok(), nil
+	}
+	image := b.microcode
+	b.microcode = nil
+	d.mu.Unlock()
+	return activateMicrocode(cmd, image, mode == bufferModeMicrocodeOffsetsSave)
+}
+
+// activateMicrocode hands a complete image to the FirmwareFunc, and switches to the revision it returns.
+func activateMicrocode(cmd *SCSICmd, image []byte, save bool) (SCSIResponse, error) {
+	d := cmd.Device()
+	rev, err := d.scsi.Firmware(image, save)
+	if err != nil {
+		log.Errorf("microcode rejected: %v", err)
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+	d.mu.Lock()
+	d.revision = rev
+	d.mu.Unlock()
+	d.RaiseUnitAttention(scsi.AscMicrocodeHasBeenChanged)
+	return cmd.Ok(), nil
+}
+
+// EmulateReadBuffer handles READ BUFFER in the combined header and data, data, descriptor, echo buffer and
+// echo buffer descriptor modes.
+func EmulateReadBuffer(cmd *SCSICmd) (SCSIResponse, error) {
+	d := cmd.Device()
+	mode := cmd.GetCDB(1) & 0x1f
+	id := cmd.GetCDB(2)
+	off := bufferField(cmd, 3)
+	allocLen := bufferField(cmd, 6)
+
+	var data []byte
+	d.mu.Lock()
+	switch mode {
+	case bufferModeCombined, bufferModeData, bufferModeDescriptor:
+		if id != 0 || off > dataBufferSize || mode != bufferModeData && off != 0 {
+			d.mu.Unlock()
+			return cmd.IllegalRequest(), nil
+		}
+		if d.buffers.data == nil {
+			d.buffers.data = make([]byte, dataBufferSize)
+		}
+		switch mode {
+		case bufferModeCombined:
+			data = make([]byte, 4+dataBufferSize)
+			putUint24(data[1:4], dataBufferSize)
+			copy(data[4:], d.buffers.data)
+		case bufferModeData:
+			data = append([]byte(nil), d.buffers.data[off:]...)
+		case bufferModeDescriptor:
+			// Byte aligned offsets.
+			data = make([]byte, 4)
+			putUint24(data[1:4], dataBufferSize)
+		}
+	case bufferModeEcho:
+		data = append([]byte(nil), d.buffers.echo...)
+	case bufferModeEchoDescriptor:
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint16(data[2:4], echoBufferSize&0x1fff)
+	default:
+		d.mu.Unlock()
+		return cmd.IllegalRequest(), nil
+	}
+	d.mu.Unlock()
+	return writeTruncated(cmd, data, allocLen)
+}
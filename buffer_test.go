@@ -0,0 +1,85 @@
+package tcmu
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+func writeBufferCDB(mode byte, off, n int) []byte {
+	return []byte{scsi.WriteBuffer, mode, 0, byte(off >> 16), byte(off >> 8), byte(off), byte(n >> 16), byte(n >> 8), byte(n), 0}
+}
+
+func TestWriteBufferMicrocodeSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		segments []string
+		// The segment after which the image is activated, or -1.
+		activated int
+	}{
+		{"short last segment", 0, []string{"abcd", "efgh", "ij"}, 2},
+		{"single segment", 0, []string{"abcd"}, -1},
+		{"single segment then empty", 0, []string{"abcd", ""}, 1},
+		{"multiple of the segment length", 0, []string{"abcd", "efgh"}, -1},
+		{"multiple then empty", 0, []string{"abcd", "efgh", ""}, 2},
+		{"configured size, single segment", 4, []string{"abcd"}, 0},
+		{"configured size, multiple", 8, []string{"abcd", "efgh"}, 1},
+		{"configured size, short segment", 10, []string{"abcd", "ef", "ghij"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDevice(1<<20, 512)
+			d.scsi.FirmwareSize = tt.size
+			var image []byte
+			d.scsi.Firmware = func(b []byte, save bool) (string, error) {
+				if !save {
+					t.Error("image not saved")
+				}
+				image = b
+				return "0002", nil
+			}
+			off := 0
+			var want []byte
+			for i, seg := range tt.segments {
+				cmd := newTestCmd(d, writeBufferCDB(bufferModeMicrocodeOffsetsSave, off, len(seg)), []byte(seg), 0)
+				resp, err := EmulateWriteBuffer(cmd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if k, asc := senseOf(resp); k != 0 {
+					t.Fatalf("segment %d: sense key 0x%x asc 0x%04x", i, k, asc)
+				}
+				off += len(seg)
+				want = append(want, seg...)
+				if activated := image != nil; activated != (i == tt.activated) {
+					t.Fatalf("segment %d: activated %v", i, activated)
+				}
+				if image != nil && !bytes.Equal(image, want) {
+					t.Fatalf("image %q, want %q", image, want)
+				}
+			}
+			if rev := d.productRev(&defaultInquiry); (rev == "0002") != (tt.activated >= 0) {
+				t.Errorf("product revision %q", rev)
+			}
+		})
+	}
+}
+
+func TestWriteBufferMicrocodeTooLong(t *testing.T) {
+	d := newTestDevice(1<<20, 512)
+	d.scsi.FirmwareSize = 6
+	d.scsi.Firmware = func(b []byte, save bool) (string, error) {
+		t.Errorf("image %q activated", b)
+		return "", nil
+	}
+	resp, _ := EmulateWriteBuffer(newTestCmd(d, writeBufferCDB(bufferModeMicrocodeOffsets, 0, 4), []byte("abcd"), 0))
+	if k, _ := senseOf(resp); k != 0 {
+		t.Fatalf("sense key 0x%x", k)
+	}
+	resp, _ = EmulateWriteBuffer(newTestCmd(d, writeBufferCDB(bufferModeMicrocodeOffsets, 4, 4), []byte("efgh"), 0))
+	if k, asc := senseOf(resp); k != scsi.SenseIllegalRequest || asc != scsi.AscInvalidFieldInCdb {
+		t.Fatalf("sense key 0x%x asc 0x%04x", k, asc)
+	}
+}
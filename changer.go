@@ -0,0 +1,526 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// Element types, as used by READ ELEMENT STATUS.
+const (
+	elementTransport    = 0x1
+	elementStorage      = 0x2
+	elementImportExport = 0x3
+	elementDrive        = 0x4
+)
+
+// The first address of each type of element. There is a single medium transport.
+const (
+	changerTransportAddr    = 0x0000
+	changerImportExportAddr = 0x0010
+	changerDriveAddr        = 0x0100
+	changerSlotAddr         = 0x1000
+)
+
+// CartridgeExt is the file name extension of the tape images in a changer directory. The rest of the file
+// name is the barcode of the cartridge.
+const CartridgeExt = ".tape"
+
+// ChangerConfig describes the library emulated by a ChangerCmdHandler.
+type ChangerConfig struct {
+	// The directory holding the cartridges, as TapeImage files ending in
+	// CartridgeExt, and the library state.
+	Dir string
+	// The number of storage and import/export elements.
+	Slots        int
+	ImportExport int
+	// The tape drives of the library. A drive may be nil if nothing should
+	// happen when a cartridge is moved in and out of it.
+	Drives []*TapeCmdHandler
+}
+
+type changerElement struct {
+	// The file name of the cartridge in the element, relative to the
+	// directory, or empty.
+	Cartridge string `json:"cartridge,omitempty"`
+	// The address of the element the cartridge was last moved from.
+	Source uint16 `json:"source,omitempty"`
+}
+
+type libraryState struct {
+	Slots        []changerElement `json:"slots"`
+	ImportExport []changerElement `json:"import_export"`
+	Drives       []changerElement `json:"drives"`
+}
+
+// ChangerCmdHandler emulates a SCSI media changer (SMC) that moves tape cartridges between slots,
+// import/export elements and drives. The state of the library is kept in library.json in the
+// cartridge directory.
+type ChangerCmdHandler struct {
+	Inq *InquiryInfo
+
+	conf  ChangerConfig
+	mu    sync.Mutex
+	state libraryState
+}
+
+// NewChangerCmdHandler creates a changer for the cartridges in conf.Dir. If there is no saved state, the
+// cartridges are put in the slots in order of name. Cartridges recorded in a drive are loaded into it.
+func NewChangerCmdHandler(conf ChangerConfig) (*ChangerCmdHandler, error) {
+	h := &ChangerCmdHandler{conf: conf}
+	data, err := ioutil.ReadFile(h.statePath())
+	switch {
+	case os.IsNotExist(err):
+		h.state = libraryState{
+			Slots:        make([]changerElement, conf.Slots),
+			ImportExport: make([]changerElement, conf.ImportExport),
+			Drives:       make([]changerElement, len(conf.Drives)),
+		}
+		if err := h.inventory(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &h.state); err != nil {
+			return nil, fmt.Errorf("Invalid library state in %s: %v", h.statePath(), err)
+		}
+		if len(h.state.Slots) != conf.Slots || len(h.state.ImportExport) != conf.ImportExport || len(h.state.Drives) != len(conf.Drives) {
+			return nil, fmt.Errorf("Library state in %s does not match the configured elements", h.statePath())
+		}
+	}
+	for i, e := range h.state.Drives {
+		if e.Cartridge == "" || conf.Drives[i] == nil || conf.Drives[i].Tape() != nil {
+			continue
+		}
+		if err := h.load(i, e.Cartridge); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// ChangerSCSIHandler is BasicSCSIHandler for a media changer.
+func ChangerSCSIHandler(h *ChangerCmdHandler) *SCSIHandler {
+	return &SCSIHandler{
+		HBA:        30,
+		LUN:        0,
+		WWN:        GenerateTestWWN(),
+		VolumeName: "testchanger",
+		// The kernel wants a size, though a changer has none.
+		DataSizes: DataSizes{VolumeSize: 1024 * 1024, BlockSize: 512},
+		DevReady:  SingleThreadedDevReady(h),
+	}
+}
+
+func (h *ChangerCmdHandler) statePath() string {
+	return filepath.Join(h.conf.Dir, "library.json")
+}
+
+// save writes the library state. Must be called with mu held, or before the handler is used.
+func (h *ChangerCmdHandler) save() error {
+	data, err := json.Marshal(h.state)
+	if err != nil {
+		return err
+	}
+	tmp := h.statePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.statePath())
+}
+
+// inventory brings the library state in line with the cartridge directory: cartridges whose files have
+// gone are removed, and new files are put in empty slots. Must be called with mu held, or before the
+// handler is used.
+func (h *ChangerCmdHandler) inventory() error {
+	names, err := filepath.Glob(filepath.Join(h.conf.Dir, "*"+CartridgeExt))
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool)
+	for _, n := range names {
+		present[filepath.Base(n)] = true
+	}
+	for _, elems := range [][]changerElement{h.state.Slots, h.state.ImportExport, h.state.Drives} {
+		for i := range elems {
+			if elems[i].Cartridge == "" {
+				continue
+			}
+			if !present[elems[i].Cartridge] {
+				elems[i] = changerElement{}
+				continue
+			}
+			delete(present, elems[i].Cartridge)
+		}
+	}
+	var added []string
+	for n := range present {
+		added = append(added, n)
+	}
+	sort.Strings(added)
+	for i := range h.state.Slots {
+		if len(added) == 0 {
+			break
+		}
+		if h.state.Slots[i].Cartridge == "" {
+			h.state.Slots[i] = changerElement{Cartridge: added[0]}
+			added = added[1:]
+		}
+	}
+	if len(added) > 0 {
+		log.Warnf("No empty slots for cartridges %v", added)
+	}
+	return h.save()
+}
+
+// element returns the element at `addr`, and its type, or nil if there is none. The medium transport
+// never holds a cartridge, as every move completes at once.
+func (h *ChangerCmdHandler) element(addr uint16) (*changerElement, byte) {
+	in := func(first uint16, elems []changerElement) *changerElement {
+		if addr >= first && int(addr-first) < len(elems) {
+			return &elems[addr-first]
+		}
+		return nil
+	}
+	if e := in(changerSlotAddr, h.state.Slots); e != nil {
+		return e, elementStorage
+	}
+	if e := in(changerImportExportAddr, h.state.ImportExport); e != nil {
+		return e, elementImportExport
+	}
+	if e := in(changerDriveAddr, h.state.Drives); e != nil {
+		return e, elementDrive
+	}
+	if addr == changerTransportAddr {
+		return &changerElement{}, elementTransport
+	}
+	return nil, 0
+}
+
+// load puts a cartridge into the tape drive behind drive element `i`, if there is one.
+func (h *ChangerCmdHandler) load(i int, cartridge string) error {
+	if h.conf.Drives[i] == nil {
+		return nil
+	}
+	tape, err := OpenTapeImage(filepath.Join(h.conf.Dir, cartridge))
+	if err != nil {
+		return err
+	}
+	h.conf.Drives[i].Load(tape)
+	return nil
+}
+
+// reload puts a cartridge back into the tape drive behind drive element `i` after a failed move. If that
+// fails too, the drive stays empty until the cartridge is loaded again when the library is restarted.
+func (h *ChangerCmdHandler) reload(i int, cartridge string) {
+	if err := h.load(i, cartridge); err != nil {
+		log.Errorf("couldn't reload %s into drive %d: %v", cartridge, i, err)
+	}
+}
+
+// unload takes the cartridge out of the tape drive behind drive element `i`, if there is one.
+func (h *ChangerCmdHandler) unload(i int) error {
+	if h.conf.Drives[i] == nil {
+		return nil
+	}
+	if tape := h.conf.Drives[i].Unload(); tape != nil {
+		return tape.Close()
+	}
+	return nil
+}
+
+func (h *ChangerCmdHandler) inquiry() *InquiryInfo {
+	inq := defaultInquiry
+	if h.Inq != nil {
+		inq = *h.Inq
+	}
+	inq.DeviceType = scsi.TypeMediumChanger
+	return &inq
+}
+
+func (h *ChangerCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch cmd.Command() {
+	case scsi.Inquiry:
+		return EmulateInquiry(cmd, h.inquiry())
+	case scsi.TestUnitReady:
+		return EmulateTestUnitReady(cmd)
+	case scsi.ModeSense, scsi.ModeSense10:
+		return h.modeSense(cmd)
+	case scsi.MoveMedium:
+		return h.moveMedium(cmd)
+	case scsi.ExchangeMedium:
+		return h.exchangeMedium(cmd)
+	case scsi.ReadElementStatus:
+		return h.readElementStatus(cmd)
+	case scsi.InitializeElementStatus:
+		if err := h.inventory(); err != nil {
+			log.Errorln("changer inventory failed:", err)
+			return cmd.TargetFailure(), nil
+		}
+		return cmd.Ok(), nil
+	case scsi.PositionToElement:
+		if _, t := h.element(binary.BigEndian.Uint16(cmd.cdb[2:4])); t != elementTransport {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidElementAddress), nil
+		}
+		if e, _ := h.element(binary.BigEndian.Uint16(cmd.cdb[4:6])); e == nil {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidElementAddress), nil
+		}
+		return cmd.Ok(), nil
+	default:
+		log.Debugf("Ignore unknown SCSI command 0x%x\n", cmd.Command())
+	}
+	return cmd.NotHandled(), nil
+}
+
+// move moves the cartridge in `src` to the empty element `dst`, swapping the media of any drives
+// involved. If the cartridge cannot be loaded into `dst`, it is put back into `src`, and the elements are
+// left as they were.
+func (h *ChangerCmdHandler) move(srcAddr, dstAddr uint16) error {
+	src, srcType := h.element(srcAddr)
+	dst, dstType := h.element(dstAddr)
+	if srcType == elementDrive {
+		if err := h.unload(int(srcAddr - changerDriveAddr)); err != nil {
+			return err
+		}
+	}
+	if dstType == elementDrive {
+		if err := h.load(int(dstAddr-changerDriveAddr), src.Cartridge); err != nil {
+			if srcType == elementDrive {
+				h.reload(int(srcAddr-changerDriveAddr), src.Cartridge)
+			}
+			return err
+		}
+	}
+	*dst = changerElement{Cartridge: src.Cartridge, Source: srcAddr}
+	*src = changerElement{}
+	return nil
+}
+
+// checkMove validates the transport, source and destination of MOVE MEDIUM and EXCHANGE MEDIUM.
+func (h *ChangerCmdHandler) checkMove(cmd *SCSICmd, addrs ...uint16) (SCSIResponse, bool) {
+	if _, t := h.element(binary.BigEndian.Uint16(cmd.cdb[2:4])); t != elementTransport {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidElementAddress), false
+	}
+	for _, a := range addrs {
+		if e, t := h.element(a); e == nil || t == elementTransport {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidElementAddress), false
+		}
+	}
+	if e, _ := h.element(addrs[0]); e.Cartridge == "" {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscMediumSourceElementEmpty), false
+	}
+	return SCSIResponse{}, true
+}
+
+func (h *ChangerCmdHandler) moveMedium(cmd *SCSICmd) (SCSIResponse, error) {
+	src := binary.BigEndian.Uint16(cmd.cdb[4:6])
+	dst := binary.BigEndian.Uint16(cmd.cdb[6:8])
+	if cmd.GetCDB(10)&0x01 != 0 { // INVERT
+		return cmd.IllegalRequest(), nil
+	}
+	if resp, ok := h.checkMove(cmd, src, dst); !ok {
+		return resp, nil
+	}
+	if e, _ := h.element(dst); e.Cartridge != "" {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscMediumDestinationElementFull), nil
+	}
+	if err := h.move(src, dst); err != nil {
+		log.Errorln("move medium failed:", err)
+		return cmd.TargetFailure(), nil
+	}
+	if err := h.save(); err != nil {
+		log.Errorln("saving library state failed:", err)
+		return cmd.TargetFailure(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// exchangeMedium moves the cartridge in the source to the first destination, and the cartridge that was
+// there to the second destination, which must be empty or the source itself.
+func (h *ChangerCmdHandler) exchangeMedium(cmd *SCSICmd) (SCSIResponse, error) {
+	src := binary.BigEndian.Uint16(cmd.cdb[4:6])
+	dst1 := binary.BigEndian.Uint16(cmd.cdb[6:8])
+	dst2 := binary.BigEndian.Uint16(cmd.cdb[8:10])
+	if cmd.GetCDB(10)&0x03 != 0 { // INV1, INV2
+		return cmd.IllegalRequest(), nil
+	}
+	if resp, ok := h.checkMove(cmd, src, dst1, dst2); !ok {
+		return resp, nil
+	}
+	if e, _ := h.element(dst1); e.Cartridge == "" {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscMediumSourceElementEmpty), nil
+	}
+	if e, _ := h.element(dst2); e.Cartridge != "" && dst2 != src {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscMediumDestinationElementFull), nil
+	}
+	// Park the first destination's cartridge in the transport while the source moves in.
+	first, firstType := h.element(dst1)
+	if firstType == elementDrive {
+		if err := h.unload(int(dst1 - changerDriveAddr)); err != nil {
+			log.Errorln("exchange medium failed:", err)
+			return cmd.TargetFailure(), nil
+		}
+	}
+	transport := *first
+	*first = changerElement{}
+	if err := h.move(src, dst1); err != nil {
+		// Put the first destination's cartridge back.
+		*first = transport
+		if firstType == elementDrive {
+			h.reload(int(dst1-changerDriveAddr), transport.Cartridge)
+		}
+		log.Errorln("exchange medium failed:", err)
+		return cmd.TargetFailure(), nil
+	}
+	second, secondType := h.element(dst2)
+	*second = changerElement{Cartridge: transport.Cartridge, Source: dst1}
+	if secondType == elementDrive {
+		if err := h.load(int(dst2-changerDriveAddr), transport.Cartridge); err != nil {
+			// The cartridge is in the second destination, but its drive
+			// could not load it.
+			log.Errorln("exchange medium failed:", err)
+			if err := h.save(); err != nil {
+				log.Errorln("saving library state failed:", err)
+			}
+			return cmd.TargetFailure(), nil
+		}
+	}
+	if err := h.save(); err != nil {
+		log.Errorln("saving library state failed:", err)
+		return cmd.TargetFailure(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// modeSense returns the Element Address Assignment (0x1d) and Device Capabilities (0x1f) pages.
+func (h *ChangerCmdHandler) modeSense(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	var pgdata []byte
+	page := cmd.GetCDB(2) & 0x3f
+	if page == 0x1d || page == 0x3f {
+		p := make([]byte, 20)
+		p[0] = 0x1d
+		p[1] = byte(len(p) - 2)
+		order.PutUint16(p[2:4], changerTransportAddr)
+		order.PutUint16(p[4:6], 1)
+		order.PutUint16(p[6:8], changerSlotAddr)
+		order.PutUint16(p[8:10], uint16(len(h.state.Slots)))
+		order.PutUint16(p[10:12], changerImportExportAddr)
+		order.PutUint16(p[12:14], uint16(len(h.state.ImportExport)))
+		order.PutUint16(p[14:16], changerDriveAddr)
+		order.PutUint16(p[16:18], uint16(len(h.state.Drives)))
+		pgdata = append(pgdata, p...)
+	}
+	if page == 0x1f || page == 0x3f {
+		p := make([]byte, 20)
+		p[0] = 0x1f
+		p[1] = byte(len(p) - 2)
+		p[2] = 0x0e // cartridges can be stored in slots, import/export elements and drives
+		// Any element can move to, and exchange with, any element that stores cartridges.
+		for i := 4; i < 8; i++ {
+			p[i] = 0x0e
+			p[i+8] = 0x0e
+		}
+		pgdata = append(pgdata, p...)
+	}
+	return writeModeSense(cmd, nil, pgdata, 0)
+}
+
+// readElementStatus handles READ ELEMENT STATUS, with primary volume tags (barcodes) if VOLTAG is set.
+// Device identifiers (DVCID) are not reported.
+func (h *ChangerCmdHandler) readElementStatus(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	voltag := cmd.GetCDB(1)&0x10 != 0
+	typ := cmd.GetCDB(1) & 0x0f
+	start := order.Uint16(cmd.cdb[2:4])
+	count := int(order.Uint16(cmd.cdb[4:6]))
+	allocLen := int(cmd.GetCDB(7))<<16 | int(cmd.GetCDB(8))<<8 | int(cmd.GetCDB(9))
+	if typ > elementDrive {
+		return cmd.IllegalRequest(), nil
+	}
+	descLen := 12
+	if voltag {
+		descLen += 36
+	}
+
+	type group struct {
+		typ   byte
+		first uint16
+		elems []changerElement
+	}
+	groups := []group{
+		{elementTransport, changerTransportAddr, []changerElement{{}}},
+		{elementImportExport, changerImportExportAddr, h.state.ImportExport},
+		{elementDrive, changerDriveAddr, h.state.Drives},
+		{elementStorage, changerSlotAddr, h.state.Slots},
+	}
+	var body []byte
+	var first uint16
+	reported := 0
+	for _, g := range groups {
+		if typ != 0 && typ != g.typ {
+			continue
+		}
+		var descs []byte
+		for i, e := range g.elems {
+			addr := g.first + uint16(i)
+			if addr < start || reported == count {
+				continue
+			}
+			if reported == 0 {
+				first = addr
+			}
+			reported++
+			d := make([]byte, descLen)
+			order.PutUint16(d[0:2], addr)
+			switch g.typ {
+			case elementImportExport:
+				d[2] = 0x38 // InEnab, ExEnab, Access
+			case elementStorage, elementDrive:
+				d[2] = 0x08 // Access
+			}
+			if e.Cartridge != "" {
+				d[2] |= 0x01 // Full
+				// The transport is never a source, so a zero source is unknown.
+				if e.Source != 0 {
+					d[9] = 0x80 // SValid
+					order.PutUint16(d[10:12], e.Source)
+				}
+				if voltag {
+					copy(d[12:44], FixedString(strings.TrimSuffix(e.Cartridge, CartridgeExt), 32))
+				}
+			}
+			descs = append(descs, d...)
+		}
+		if len(descs) == 0 {
+			continue
+		}
+		hdr := make([]byte, 8)
+		hdr[0] = g.typ
+		if voltag {
+			hdr[1] = 0x80 // PVolTag
+		}
+		order.PutUint16(hdr[2:4], uint16(descLen))
+		putUint24(hdr[5:8], uint32(len(descs)))
+		body = append(body, hdr...)
+		body = append(body, descs...)
+	}
+	data := make([]byte, 8+len(body))
+	order.PutUint16(data[0:2], first)
+	order.PutUint16(data[2:4], uint16(reported))
+	putUint24(data[5:8], uint32(len(body)))
+	copy(data[8:], body)
+	return writeTruncated(cmd, data, allocLen)
+}
@@ -0,0 +1,183 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+// newChangerTest returns a library of four slots, one import/export element and two drives, with the
+// cartridges A1 and A2 in the first two slots.
+func newChangerTest(t *testing.T) (*Device, *ChangerCmdHandler) {
+	dir := t.TempDir()
+	for _, name := range []string{"A1", "A2"} {
+		tape, err := CreateTapeImage(filepath.Join(dir, name+CartridgeExt), 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tape.Close()
+	}
+	h, err := NewChangerCmdHandler(ChangerConfig{
+		Dir:          dir,
+		Slots:        4,
+		ImportExport: 1,
+		Drives:       []*TapeCmdHandler{NewTapeCmdHandler(nil), NewTapeCmdHandler(nil)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestDevice(1<<20, 512), h
+}
+
+func moveMediumCmd(d *Device, transport, src, dst uint16) *SCSICmd {
+	cdb := make([]byte, 12)
+	cdb[0] = scsi.MoveMedium
+	binary.BigEndian.PutUint16(cdb[2:4], transport)
+	binary.BigEndian.PutUint16(cdb[4:6], src)
+	binary.BigEndian.PutUint16(cdb[6:8], dst)
+	return newTestCmd(d, cdb, nil, 0)
+}
+
+// savedLibrary returns the library state the changer saved.
+func savedLibrary(t *testing.T, h *ChangerCmdHandler) libraryState {
+	data, err := ioutil.ReadFile(h.statePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state libraryState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestMoveMedium(t *testing.T) {
+	const (
+		slot0  = changerSlotAddr
+		slot1  = changerSlotAddr + 1
+		slot2  = changerSlotAddr + 2
+		slot3  = changerSlotAddr + 3
+		ie     = changerImportExportAddr
+		drive0 = changerDriveAddr
+		drive1 = changerDriveAddr + 1
+	)
+	type move struct{ src, dst uint16 }
+	tests := []struct {
+		name string
+		// Moves made before the one tested, which must succeed.
+		before []move
+		move   move
+		// Called before the move tested.
+		setup func(t *testing.T, h *ChangerCmdHandler)
+		key   byte
+		asc   uint16
+		// The cartridges in the slots, import/export element and drives
+		// afterwards.
+		slots  []string
+		ie     string
+		drives []string
+	}{
+		{
+			name: "slot to slot", move: move{slot0, slot2},
+			slots: []string{"", "A2.tape", "A1.tape", ""}, drives: []string{"", ""},
+		},
+		{
+			name: "slot to drive", move: move{slot1, drive0},
+			slots: []string{"A1.tape", "", "", ""}, drives: []string{"A2.tape", ""},
+		},
+		{
+			name: "drive to drive", before: []move{{slot0, drive0}}, move: move{drive0, drive1},
+			slots: []string{"", "A2.tape", "", ""}, drives: []string{"", "A1.tape"},
+		},
+		{
+			name: "drive to import/export", before: []move{{slot0, drive1}}, move: move{drive1, ie},
+			slots: []string{"", "A2.tape", "", ""}, ie: "A1.tape", drives: []string{"", ""},
+		},
+		{
+			name: "source empty", move: move{slot2, slot3},
+			key: scsi.SenseIllegalRequest, asc: scsi.AscMediumSourceElementEmpty,
+			slots: []string{"A1.tape", "A2.tape", "", ""}, drives: []string{"", ""},
+		},
+		{
+			name: "destination full", before: []move{{slot1, drive0}}, move: move{slot0, drive0},
+			key: scsi.SenseIllegalRequest, asc: scsi.AscMediumDestinationElementFull,
+			slots: []string{"A1.tape", "", "", ""}, drives: []string{"A2.tape", ""},
+		},
+		{
+			name: "invalid element", move: move{slot0, changerSlotAddr + 4},
+			key: scsi.SenseIllegalRequest, asc: scsi.AscInvalidElementAddress,
+			slots: []string{"A1.tape", "A2.tape", "", ""}, drives: []string{"", ""},
+		},
+		{
+			name: "unreadable cartridge", move: move{slot0, drive0},
+			setup: func(t *testing.T, h *ChangerCmdHandler) {
+				if err := ioutil.WriteFile(filepath.Join(h.conf.Dir, "A1.tape"), []byte("junk"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			key: scsi.SenseHardwareError, asc: scsi.AscInternalTargetFailure,
+			slots: []string{"A1.tape", "A2.tape", "", ""}, drives: []string{"", ""},
+		},
+		{
+			name: "cartridge gone from under a drive", before: []move{{slot0, drive0}}, move: move{drive0, drive1},
+			setup: func(t *testing.T, h *ChangerCmdHandler) {
+				if err := os.Remove(filepath.Join(h.conf.Dir, "A1.tape")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			key: scsi.SenseHardwareError, asc: scsi.AscInternalTargetFailure,
+			slots: []string{"", "A2.tape", "", ""}, drives: []string{"A1.tape", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, h := newChangerTest(t)
+			for _, m := range tt.before {
+				resp, err := h.HandleCommand(moveMediumCmd(d, changerTransportAddr, m.src, m.dst))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if k, asc := senseOf(resp); k != 0 {
+					t.Fatalf("move 0x%x to 0x%x: sense key 0x%x asc 0x%04x", m.src, m.dst, k, asc)
+				}
+			}
+			if tt.setup != nil {
+				tt.setup(t, h)
+			}
+			resp, err := h.HandleCommand(moveMediumCmd(d, changerTransportAddr, tt.move.src, tt.move.dst))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k, asc := senseOf(resp); k != tt.key || asc != tt.asc {
+				t.Fatalf("sense key 0x%x asc 0x%04x, want 0x%x 0x%04x", k, asc, tt.key, tt.asc)
+			}
+
+			for _, state := range []libraryState{h.state, savedLibrary(t, h)} {
+				var slots, drives []string
+				for _, e := range state.Slots {
+					slots = append(slots, e.Cartridge)
+				}
+				for _, e := range state.Drives {
+					drives = append(drives, e.Cartridge)
+				}
+				if !reflect.DeepEqual(slots, tt.slots) || state.ImportExport[0].Cartridge != tt.ie || !reflect.DeepEqual(drives, tt.drives) {
+					t.Errorf("slots %q, import/export %q, drives %q; want %q, %q, %q",
+						slots, state.ImportExport[0].Cartridge, drives, tt.slots, tt.ie, tt.drives)
+				}
+			}
+			// A drive holds a tape if its cartridge could be opened.
+			for i, drive := range h.conf.Drives {
+				want := tt.drives[i] != "" && tt.key != scsi.SenseHardwareError
+				if loaded := drive.Tape() != nil; loaded != want {
+					t.Errorf("drive %d loaded: %v", i, loaded)
+				}
+			}
+		})
+	}
+}
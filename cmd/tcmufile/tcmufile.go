@@ -1,27 +1,79 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 
 	"github.com/alternative-storage/go-tcmu"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	readOnly := flag.Bool("readonly", false, "export the file write protected")
+	journal := flag.String("journal", "", "journal file used to support WRITE ATOMIC")
+	cdrom := flag.Bool("cdrom", false, "export the file as a CD/DVD-ROM drive holding it as a disc")
+	opal := flag.String("opal", "", "export the file as a self-encrypting drive with the given PSID")
+	flag.Parse()
 	logrus.SetLevel(logrus.DebugLevel)
-	if len(os.Args) != 2 {
+	if flag.NArg() != 1 {
 		die("not enough arguments")
 	}
-	filename := os.Args[1]
-	f, err := os.OpenFile(filename, os.O_RDWR, 0700)
+	var modes []string
+	for name, set := range map[string]bool{
+		"-readonly": *readOnly,
+		"-journal":  *journal != "",
+		"-cdrom":    *cdrom,
+		"-opal":     *opal != "",
+	} {
+		if set {
+			modes = append(modes, name)
+		}
+	}
+	if len(modes) > 1 {
+		sort.Strings(modes)
+		die("%s cannot be used together", strings.Join(modes, ", "))
+	}
+	filename := flag.Arg(0)
+	mode := os.O_RDWR
+	if *readOnly || *cdrom {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filename, mode, 0700)
 	if err != nil {
 		die("couldn't open: %v", err)
 	}
 	defer f.Close()
 	fi, _ := f.Stat()
 	handler := tcmu.BasicSCSIHandler(f)
+	if *cdrom {
+		handler = tcmu.MMCSCSIHandler(tcmu.NewMMCCmdHandler(f, fi.Size()))
+	} else if *readOnly {
+		handler = tcmu.ReadOnlySCSIHandler(f)
+	} else if *journal != "" {
+		jf, err := tcmu.OpenJournaledFile(f, *journal)
+		if err != nil {
+			die("couldn't open journal: %v", err)
+		}
+		defer jf.Close()
+		handler = tcmu.BasicSCSIHandler(jf)
+		// Allow atomic writes of up to 1MiB.
+		handler.AtomicLimits.MaxLength = uint32(1024 * 1024 / handler.DataSizes.BlockSize)
+	} else if *opal != "" {
+		o, err := tcmu.NewOpalCmdHandler(f, tcmu.OpalConfig{
+			Sizes:     tcmu.DataSizes{VolumeSize: fi.Size(), BlockSize: handler.DataSizes.BlockSize},
+			StatePath: filename + ".opal",
+			PSID:      *opal,
+		})
+		if err != nil {
+			die("couldn't open Opal state: %v", err)
+		}
+		defer o.Close()
+		handler = tcmu.OpalSCSIHandler(o)
+	}
 	handler.VolumeName = fi.Name()
 	handler.DataSizes.VolumeSize = fi.Size()
 	d, err := tcmu.OpenTCMUDevice("/dev/tcmufile", handler)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"sort"
 
 	"github.com/alternative-storage/go-tcmu/scsi"
 	"github.com/prometheus/common/log"
@@ -18,6 +19,9 @@ type SCSICmdHandler interface {
 type ReadWriterAtCmdHandler struct {
 	RW  ReadWriterAt
 	Inq *InquiryInfo
+	// Hand the commands it does not emulate to the kernel with Passthrough,
+	// rather than failing them with NotHandled.
+	PassthroughUnknown bool
 }
 
 // InquiryInfo holds the general vendor information for the emulated SCSI Device. Fields used from this will be padded or trunacted to meet the spec.
@@ -25,6 +29,36 @@ type InquiryInfo struct {
 	VendorID   string
 	ProductID  string
 	ProductRev string
+	// SerialNumber is reported in the Unit Serial Number VPD page (0x80). The page is omitted if empty.
+	SerialNumber string
+
+	// The peripheral device type (one of the scsi.Type constants) and peripheral qualifier.
+	DeviceType byte
+	Qualifier  byte
+	// Set the RMB bit, for removable media.
+	Removable bool
+	// Set the PROTECT bit, for devices supporting protection information.
+	Protect bool
+	// Set the 3PC bit, for devices supporting third-party copy commands.
+	ThirdPartyCopy bool
+	// The TPGS field (0-3), describing asymmetric logical unit access support.
+	TPGS byte
+	// Serve the ATA Information VPD page (0x89) of a disk, as a SCSI to ATA translation layer would.
+	// Linux stops sending WRITE SAME to disks that have the page.
+	ATAInformation bool
+	// Up to eight version descriptors, eg. 0x0460 for SPC-4, naming the standards the device claims.
+	VersionDescriptors []uint16
+	// Additional VPD pages served by EmulateEvpdInquiry, keyed by page code.
+	// These take precedence over the built in pages.
+	VPDPages map[byte]VPDPageFunc
+}
+
+// VPDPageFunc builds a complete VPD page, header included.
+type VPDPageFunc func(cmd *SCSICmd, inq *InquiryInfo) []byte
+
+// peripheral returns byte 0 of the standard INQUIRY data and every VPD page.
+func (inq *InquiryInfo) peripheral() byte {
+	return (inq.Qualifier&0x07)<<5 | inq.DeviceType&0x1f
 }
 
 var defaultInquiry = InquiryInfo{
@@ -34,6 +68,9 @@ var defaultInquiry = InquiryInfo{
 }
 
 func (h ReadWriterAtCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	if resp, ok := checkMediumAccess(cmd); !ok {
+		return resp, nil
+	}
 	switch cmd.Command() {
 	case scsi.Inquiry:
 		if h.Inq == nil {
@@ -52,12 +89,112 @@ func (h ReadWriterAtCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error
 		return EmulateRead(cmd, h.RW)
 	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16:
 		return EmulateWrite(cmd, h.RW)
+	case scsi.FormatUnit:
+		return EmulateFormatUnit(cmd, h.RW)
+	case scsi.Xdwriteread10:
+		return EmulateXdWriteRead(cmd, h.RW)
+	case scsi.Verify, scsi.Verify12, scsi.Verify16:
+		return EmulateVerify(cmd, h.RW)
+	case scsi.WriteSame, scsi.WriteSame16:
+		return EmulateWriteSame(cmd, h.RW)
+	case scsi.WriteAtomic16:
+		return EmulateWriteAtomic(cmd, h.RW)
+	case scsi.SendDiagnostic:
+		return EmulateSendDiagnostic(cmd, h.RW)
+	case scsi.ReceiveDiagnostic:
+		return EmulateReceiveDiagnostic(cmd)
+	case scsi.LogSense:
+		return EmulateLogSense(cmd)
+	case scsi.WriteBuffer:
+		return EmulateWriteBuffer(cmd)
+	case scsi.ReadBuffer:
+		return EmulateReadBuffer(cmd)
+	case scsi.MaintenanceIn:
+		if cmd.GetCDB(1)&0x1f == scsi.MiReportTargetPgs {
+			return EmulateReportTargetPortGroups(cmd)
+		}
+		log.Debugf("Ignore unknown MAINTENANCE IN service action 0x%x\n", cmd.GetCDB(1)&0x1f)
+	case scsi.MaintenanceOut:
+		if cmd.GetCDB(1)&0x1f == scsi.MoSetTargetPgs {
+			return EmulateSetTargetPortGroups(cmd)
+		}
+		log.Debugf("Ignore unknown MAINTENANCE OUT service action 0x%x\n", cmd.GetCDB(1)&0x1f)
+	case scsi.AtaPassThrough12, scsi.AtaPassThrough16:
+		if h.Inq == nil {
+			h.Inq = &defaultInquiry
+		}
+		return EmulateATAPassThrough(cmd, h.Inq)
+	case scsi.VariableLengthCmd:
+		if cmd.CdbLen() != 32 {
+			return cmd.IllegalRequest(), nil
+		}
+		switch cmd.ServiceAction() {
+		case scsi.Read32:
+			return EmulateRead(cmd, h.RW)
+		case scsi.Write32:
+			return EmulateWrite(cmd, h.RW)
+		case scsi.Verify32:
+			return EmulateVerify(cmd, h.RW)
+		case scsi.WriteSame32:
+			return EmulateWriteSame(cmd, h.RW)
+		case scsi.Xdwriteread32:
+			return EmulateXdWriteRead(cmd, h.RW)
+		}
+		log.Debugf("Ignore unknown variable length service action 0x%x\n", cmd.ServiceAction())
 	default:
 		log.Debugf("Ignore unknown SCSI command 0x%x\n", cmd.Command())
 	}
+	if h.PassthroughUnknown {
+		return cmd.Passthrough(), nil
+	}
 	return cmd.NotHandled(), nil
 }
 
+// checkMediumAccess rejects a read or write of the medium that the ALUA state, write protection or referrals
+// do not allow. Handlers that answer some reads or writes themselves check this first.
+func checkMediumAccess(cmd *SCSICmd) (SCSIResponse, bool) {
+	if resp, ok := checkALUAState(cmd); !ok {
+		return resp, false
+	}
+	if isWriteCommand(cmd) && cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), false
+	}
+	return checkReferrals(cmd)
+}
+
+// isWriteCommand reports whether the command modifies the medium, and so must be refused while the device
+// is write protected.
+func isWriteCommand(cmd *SCSICmd) bool {
+	switch cmd.Command() {
+	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16,
+		scsi.WriteVerify, scsi.WriteVerify12, scsi.WriteVerify16,
+		scsi.WriteSame, scsi.WriteSame16, scsi.WriteLong, scsi.WriteLong2,
+		scsi.Unmap, scsi.CompareAndWrite, scsi.Xdwriteread10, scsi.FormatUnit, scsi.WriteAtomic16:
+		return true
+	case scsi.VariableLengthCmd:
+		switch cmd.ServiceAction() {
+		case scsi.Xdwrite32, scsi.Xpwrite32, scsi.Xdwriteread32, scsi.Write32, scsi.WriteSame32:
+			return true
+		}
+	}
+	return false
+}
+
+// isReadCommand reports whether the command reads the medium.
+func isReadCommand(cmd *SCSICmd) bool {
+	switch cmd.Command() {
+	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16,
+		scsi.Verify, scsi.Verify12, scsi.Verify16, scsi.CompareAndWrite, scsi.Xdwriteread10:
+		return true
+	case scsi.VariableLengthCmd:
+		switch cmd.ServiceAction() {
+		case scsi.Read32, scsi.Verify32, scsi.Xdwriteread32:
+			return true
+		}
+	}
+	return false
+}
+
 func EmulateInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 	if (cmd.GetCDB(1) & 0x01) == 0 {
 		if cmd.GetCDB(2) == 0x00 {
@@ -78,44 +215,165 @@ func FixedString(s string, length int) []byte {
 	return append(p, sp...)
 }
 
+// inquiryAllocLen returns the allocation length of an INQUIRY command.
+func inquiryAllocLen(cmd *SCSICmd) int {
+	return int(binary.BigEndian.Uint16(cmd.cdb[3:5]))
+}
+
+// writeTruncated copies as much of data to the command as the initiator allocated room for.
+func writeTruncated(cmd *SCSICmd, data []byte, allocLen int) (SCSIResponse, error) {
+	if allocLen < len(data) {
+		data = data[:allocLen]
+	}
+	_, err := cmd.Write(data)
+	if err != nil {
+		return SCSIResponse{}, err
+	}
+	return cmd.Ok(), nil
+}
+
 func EmulateStdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
-	buf := make([]byte, 36)
+	buf := make([]byte, 96)
+	buf[0] = inq.peripheral()
+	if inq.Removable {
+		buf[1] = 0x80 // RMB
+	}
 	buf[2] = 0x05 // SPC-3
 	buf[3] = 0x02 // response data format
+	tpgs := inq.TPGS
+	if tpgs == 0 {
+		tpgs = cmd.Device().aluaTPGS()
+	}
+	buf[5] = (tpgs & 0x03) << 4
+	if inq.ThirdPartyCopy {
+		buf[5] |= 0x08 // 3PC
+	}
+	if inq.Protect || cmd.Device().ProtectionType() != ProtectionNone {
+		buf[5] |= 0x01 // PROTECT
+	}
 	buf[7] = 0x02 // CmdQue
 	vendorID := FixedString(inq.VendorID, 8)
 	copy(buf[8:16], vendorID)
 	productID := FixedString(inq.ProductID, 16)
 	copy(buf[16:32], productID)
-	productRev := FixedString(inq.ProductRev, 4)
+	productRev := FixedString(cmd.Device().productRev(inq), 4)
 	copy(buf[32:36], productRev)
+	// Version descriptors live in bytes 58-73.
+	for i, v := range inq.VersionDescriptors {
+		if i == 8 {
+			break
+		}
+		binary.BigEndian.PutUint16(buf[58+2*i:], v)
+	}
 
-	buf[4] = 31 // Set additional length to 31
-	_, err := cmd.Write(buf)
-	if err != nil {
-		return SCSIResponse{}, err
+	buf[4] = byte(len(buf) - 5) // additional length
+	return writeTruncated(cmd, buf, inquiryAllocLen(cmd))
+}
+
+// supportedVPDPages lists the VPD pages EmulateEvpdInquiry will answer for `inq`.
+func supportedVPDPages(cmd *SCSICmd, inq *InquiryInfo) []byte {
+	pages := []byte{0x00}
+	if inq.SerialNumber != "" {
+		pages = append(pages, 0x80)
 	}
-	return cmd.Ok(), nil
+	pages = append(pages, 0x83)
+	if hasExtendedInquiry(cmd) {
+		pages = append(pages, 0x86)
+	}
+	if hasATAInformation(inq) {
+		pages = append(pages, 0x89)
+	}
+	if isBlockDevice(inq) {
+		pages = append(pages, 0xb0)
+	}
+	if isBlockDevice(inq) && cmd.Device().scsi.Referrals != nil {
+		pages = append(pages, 0xb3)
+	}
+	for p := range inq.VPDPages {
+		if bytes.IndexByte(pages, p) == -1 {
+			pages = append(pages, p)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	return pages
+}
+
+// isBlockDevice reports whether the device type is one of the SBC (direct access) types.
+func isBlockDevice(inq *InquiryInfo) bool {
+	return inq.DeviceType == scsi.TypeDisk || inq.DeviceType == scsi.TypeZbc
+}
+
+// blockLimitsVPD builds the Block Limits VPD page (0xb0).
+func blockLimitsVPD(cmd *SCSICmd, inq *InquiryInfo) []byte {
+	data := make([]byte, 64)
+	data[0] = inq.peripheral()
+	data[1] = 0xb0
+	order := binary.BigEndian
+	order.PutUint16(data[2:4], uint16(len(data)-4))
+	data[4] = 0x01 // WSNZ: WRITE SAME needs a number of blocks
+	// Optimal transfer length granularity: one physical block.
+	order.PutUint16(data[6:8], uint16(1)<<cmd.Device().scsi.PhysicalBlockExponent)
+	atomic := cmd.Device().AtomicLimits()
+	order.PutUint32(data[44:48], atomic.MaxLength)
+	order.PutUint32(data[48:52], atomic.Alignment)
+	order.PutUint32(data[52:56], atomic.Granularity)
+	order.PutUint32(data[56:60], atomic.MaxLengthWithBoundary)
+	order.PutUint32(data[60:64], atomic.MaxBoundary)
+	return data
 }
 
 func EmulateEvpdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 	vpdType := cmd.GetCDB(2)
 	log.Debugf("SCSI EVPD Inquiry 0x%x\n", vpdType)
+	allocLen := inquiryAllocLen(cmd)
+	order := binary.BigEndian
+	if f, ok := inq.VPDPages[vpdType]; ok && vpdType != 0x0 {
+		return writeTruncated(cmd, f(cmd, inq), allocLen)
+	}
 	switch vpdType {
 	case 0x0: // Supported VPD pages
-		// The absolute minimum.
-		data := make([]byte, 6)
+		pages := supportedVPDPages(cmd, inq)
+		data := make([]byte, 4+len(pages))
+		data[0] = inq.peripheral()
+		order.PutUint16(data[2:4], uint16(len(pages)))
+		copy(data[4:], pages)
 
-		// We support 0x00 and 0x83 only
-		data[3] = 2
-		data[4] = 0x00
-		data[5] = 0x83
+		return writeTruncated(cmd, data, allocLen)
+	case 0x80: // Unit serial number
+		if inq.SerialNumber == "" {
+			return cmd.IllegalRequest(), nil
+		}
+		data := make([]byte, 4+len(inq.SerialNumber))
+		data[0] = inq.peripheral()
+		data[1] = 0x80
+		order.PutUint16(data[2:4], uint16(len(inq.SerialNumber)))
+		copy(data[4:], inq.SerialNumber)
 
-		cmd.Write(data)
-		return cmd.Ok(), nil
+		return writeTruncated(cmd, data, allocLen)
+	case 0x86: // Extended INQUIRY data
+		if !hasExtendedInquiry(cmd) {
+			return cmd.IllegalRequest(), nil
+		}
+		return writeTruncated(cmd, extendedInquiryVPD(cmd, inq), allocLen)
+	case 0x89: // ATA information
+		if !hasATAInformation(inq) {
+			return cmd.IllegalRequest(), nil
+		}
+		return writeTruncated(cmd, ataInformationVPD(cmd, inq), allocLen)
+	case 0xb0: // Block limits
+		if !isBlockDevice(inq) {
+			return cmd.IllegalRequest(), nil
+		}
+		return writeTruncated(cmd, blockLimitsVPD(cmd, inq), allocLen)
+	case 0xb3: // Referrals
+		if !isBlockDevice(inq) || cmd.Device().scsi.Referrals == nil {
+			return cmd.IllegalRequest(), nil
+		}
+		return writeTruncated(cmd, referralsVPD(cmd, inq), allocLen)
 	case 0x83: // Device identification
 		used := 4
 		data := make([]byte, 512)
+		data[0] = inq.peripheral()
 		data[1] = 0x83
 		wwn := []byte("") // TODO(barakmich): Report WWN. See tcmu_get_wwn;
 
@@ -173,11 +431,11 @@ func EmulateEvpdInquiry(cmd *SCSICmd, inq *InquiryInfo) (SCSIResponse, error) {
 
 		used += n + 1 + 4
 
-		order := binary.BigEndian
+		used += copy(data[used:], targetPortGroupDesignators(cmd.Device()))
+
 		order.PutUint16(data[2:4], uint16(used-4))
 
-		cmd.Write(data[:used])
-		return cmd.Ok(), nil
+		return writeTruncated(cmd, data[:used], allocLen)
 	default:
 		return cmd.IllegalRequest(), nil
 	}
@@ -191,6 +449,9 @@ func EmulateServiceActionIn(cmd *SCSICmd) (SCSIResponse, error) {
 	if cmd.GetCDB(1) == scsi.ReadCapacity16 {
 		return EmulateReadCapacity16(cmd)
 	}
+	if cmd.GetCDB(1)&0x1f == scsi.SaiReportReferrals {
+		return EmulateReportReferrals(cmd)
+	}
 	return cmd.NotHandled(), nil
 }
 
@@ -201,9 +462,15 @@ func EmulateReadCapacity16(cmd *SCSICmd) (SCSIResponse, error) {
 	order.PutUint64(buf[0:8], uint64(cmd.Device().Sizes().VolumeSize/cmd.Device().Sizes().BlockSize)-1)
 	// This is in BlockSize
 	order.PutUint32(buf[8:12], uint32(cmd.Device().Sizes().BlockSize))
+	// P_TYPE and PROT_EN
+	if t := cmd.Device().ProtectionType(); t != ProtectionNone {
+		buf[12] = byte(t-1)<<1 | 0x01
+	}
+	// Logical blocks per physical block exponent
+	buf[13] = cmd.Device().scsi.PhysicalBlockExponent & 0x0f
+	order.PutUint16(buf[14:16], cmd.Device().scsi.LowestAlignedLBA&0x3fff)
 	// All the rest is 0
-	cmd.Write(buf)
-	return cmd.Ok(), nil
+	return writeTruncated(cmd, buf, int(cmd.XferLen()))
 }
 
 func charToHex(c byte) (byte, bool) {
@@ -233,33 +500,45 @@ func CachingModePage(w io.Writer, wce bool) {
 // the SCSI "Write Cache Enabled" flag.
 func EmulateModeSense(cmd *SCSICmd, wce bool) (SCSIResponse, error) {
 	pgs := &bytes.Buffer{}
-	outlen := int(cmd.XferLen())
 
 	page := cmd.GetCDB(2)
 	if page == 0x3f || page == 0x08 {
 		CachingModePage(pgs, wce)
 	}
-	scsiCmd := cmd.Command()
-
 	dsp := byte(0x10) // Support DPO/FUA
+	if cmd.Device().WriteProtected() {
+		dsp |= 0x80 // WP
+	}
+	return writeModeSense(cmd, nil, pgs.Bytes(), dsp)
+}
 
-	pgdata := pgs.Bytes()
+// writeModeSense returns the block descriptor `bd` (which may be nil) and the mode pages in `pgdata` behind
+// a MODE SENSE (6) or (10) header. `dsp` is the device-specific parameter byte of the header.
+func writeModeSense(cmd *SCSICmd, bd []byte, pgdata []byte, dsp byte) (SCSIResponse, error) {
+	outlen := int(cmd.XferLen())
+	scsiCmd := cmd.Command()
+	if cmd.GetCDB(1)&0x08 != 0 { // DBD
+		bd = nil
+	}
 	var hdr []byte
 	if scsiCmd == scsi.ModeSense {
 		// MODE_SENSE_6
 		hdr = make([]byte, 4)
-		hdr[0] = byte(len(pgdata) + 3)
+		hdr[0] = byte(len(bd) + len(pgdata) + 3)
 		hdr[1] = 0x00 // Device type
 		hdr[2] = dsp
+		hdr[3] = byte(len(bd))
 	} else {
 		// MODE_SENSE_10
 		hdr = make([]byte, 8)
 		order := binary.BigEndian
-		order.PutUint16(hdr, uint16(len(pgdata)+6))
+		order.PutUint16(hdr, uint16(len(bd)+len(pgdata)+6))
 		hdr[2] = 0x00 // Device type
 		hdr[3] = dsp
+		order.PutUint16(hdr[6:8], uint16(len(bd)))
 	}
-	data := append(hdr, pgdata...)
+	data := append(hdr, bd...)
+	data = append(data, pgdata...)
 	if outlen < len(data) {
 		data = data[:outlen]
 	}
@@ -319,9 +598,28 @@ func EmulateModeSelect(cmd *SCSICmd, wce bool) (SCSIResponse, error) {
 	return cmd.Ok(), nil
 }
 
+// xferBlocks returns the number of logical blocks moved by a READ or WRITE command. For the six byte
+// variants, a transfer length of 0 means 256 blocks.
+func xferBlocks(cmd *SCSICmd) uint32 {
+	n := cmd.XferLen()
+	if n == 0 && cmd.CdbLen() == 6 {
+		return 256
+	}
+	return n
+}
+
 func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
-	offset := cmd.LBA() * uint64(cmd.Device().Sizes().BlockSize)
-	length := int(cmd.XferLen() * uint32(cmd.Device().Sizes().BlockSize))
+	lba := cmd.LBA()
+	blocks := xferBlocks(cmd)
+	if !cmd.Device().Sizes().InRange(lba, blocks) {
+		return cmd.LBAOutOfRange(), nil
+	}
+	pt := cmd.Device().ProtectionType()
+	if resp, ok := checkProtectField(cmd, pt); !ok {
+		return resp, nil
+	}
+	offset := lba * uint64(cmd.Device().Sizes().BlockSize)
+	length := int(blocks) * int(cmd.Device().Sizes().BlockSize)
 	if cmd.Buf == nil {
 		cmd.Buf = make([]byte, length)
 	}
@@ -329,14 +627,26 @@ func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
 		//realloc
 		cmd.Buf = make([]byte, length)
 	}
-	n, err := r.ReadAt(cmd.Buf[:length], int64(offset))
+	if resp, ok := cmd.aborted(false); ok {
+		return resp, nil
+	}
+	n, err := readAtFlags(r, cmd.Buf[:length], int64(offset), cmd.IOFlags())
+	if n == length && err == io.EOF {
+		// ReaderAt may report EOF along with the last bytes of the file.
+		err = nil
+	}
 	if err != nil {
 		log.Errorln("read/read failed: error:", err)
-		return cmd.MediumError(), nil
+		return cmd.BackendError(err, false), nil
 	}
 	if n < length {
 		log.Errorln("read/read failed: unable to copy enough")
-		return cmd.MediumError(), nil
+		return cmd.BackendError(io.ErrUnexpectedEOF, false), nil
+	}
+	if pt != ProtectionNone {
+		if resp, ok := readProtection(cmd, r, lba, cmd.Buf[:length], pt); !ok {
+			return resp, nil
+		}
 	}
 	n, err = cmd.Write(cmd.Buf[:length])
 	if err != nil {
@@ -351,8 +661,28 @@ func EmulateRead(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
 }
 
 func EmulateWrite(cmd *SCSICmd, r io.WriterAt) (SCSIResponse, error) {
-	offset := cmd.LBA() * uint64(cmd.Device().Sizes().BlockSize)
-	length := int(cmd.XferLen() * uint32(cmd.Device().Sizes().BlockSize))
+	if cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	lba := cmd.LBA()
+	blocks := xferBlocks(cmd)
+	if !cmd.Device().Sizes().InRange(lba, blocks) {
+		return cmd.LBAOutOfRange(), nil
+	}
+	pt := cmd.Device().ProtectionType()
+	if resp, ok := checkProtectField(cmd, pt); !ok {
+		return resp, nil
+	}
+	return writeBlocks(cmd, r, lba, blocks, pt, func(p []byte, off int64) (int, error) {
+		return writeAtFlags(r, p, off, cmd.IOFlags())
+	})
+}
+
+// writeBlocks copies `blocks` blocks from the data-out buffer, checks and stores their protection
+// information, and hands the data to `write` to put it on the medium at `lba`.
+func writeBlocks(cmd *SCSICmd, r io.WriterAt, lba uint64, blocks uint32, pt ProtectionType, write func(p []byte, off int64) (int, error)) (SCSIResponse, error) {
+	offset := lba * uint64(cmd.Device().Sizes().BlockSize)
+	length := int(blocks) * int(cmd.Device().Sizes().BlockSize)
 	if cmd.Buf == nil {
 		cmd.Buf = make([]byte, length)
 	}
@@ -369,14 +699,378 @@ func EmulateWrite(cmd *SCSICmd, r io.WriterAt) (SCSIResponse, error) {
 		log.Errorln("write/read failed: unable to copy enough")
 		return cmd.MediumError(), nil
 	}
-	n, err = r.WriteAt(cmd.Buf[:length], int64(offset))
+	storePI := func() error { return nil }
+	if pt != ProtectionNone {
+		var resp SCSIResponse
+		var ok bool
+		if storePI, resp, ok = writeProtection(cmd, r, lba, cmd.Buf[:length], pt); !ok {
+			return resp, nil
+		}
+	}
+	if resp, ok := cmd.aborted(true); ok {
+		return resp, nil
+	}
+	n, err = write(cmd.Buf[:length], int64(offset))
 	if err != nil {
 		log.Errorln("write/write failed: error:", err)
-		return cmd.MediumError(), nil
+		return cmd.BackendError(err, true), nil
 	}
 	if n < length {
 		log.Errorln("write/write failed: unable to copy enough")
+		return cmd.BackendError(io.ErrShortWrite, true), nil
+	}
+	if resp, ok := cmd.aborted(true); ok {
+		return resp, nil
+	}
+	if err := storePI(); err != nil {
+		log.Errorln("write/write pi failed: error:", err)
+		return cmd.BackendError(err, true), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// readAtFlags reads through FlagReaderAt if the backing store implements it. Otherwise FUA is already
+// satisfied, as there is no cache of our own between the command and the ReaderAt, and DPO is dropped.
+func readAtFlags(r io.ReaderAt, p []byte, off int64, flags IOFlags) (int, error) {
+	if fr, ok := r.(FlagReaderAt); ok {
+		return fr.ReadAtFlags(p, off, flags)
+	}
+	return r.ReadAt(p, off)
+}
+
+// writeAtFlags writes through FlagWriterAt if the backing store implements it. Otherwise a FUA write is
+// followed by a flush of the written range, or of the whole store if that is all the backend offers.
+func writeAtFlags(w io.WriterAt, p []byte, off int64, flags IOFlags) (int, error) {
+	if fw, ok := w.(FlagWriterAt); ok {
+		return fw.WriteAtFlags(p, off, flags)
+	}
+	n, err := w.WriteAt(p, off)
+	if err != nil || flags&FlagFUA == 0 {
+		return n, err
+	}
+	return n, syncRange(w, off, int64(n))
+}
+
+// syncRange flushes a range of the backing store, or the whole store if it cannot flush a range.
+func syncRange(w io.WriterAt, off, length int64) error {
+	switch s := w.(type) {
+	case RangeSyncer:
+		return s.SyncRange(off, length)
+	case Syncer:
+		return s.Sync()
+	}
+	log.Debugf("FUA write to a backend that cannot flush, ignoring")
+	return nil
+}
+
+// EmulateXdWriteRead handles XDWRITEREAD (10) and (32). The data-out buffer is written to the medium
+// (unless DISABLE WRITE is set), and the XOR of it with the data previously on the medium is returned in
+// the data-in buffer.
+func EmulateXdWriteRead(cmd *SCSICmd, rw ReadWriterAt) (SCSIResponse, error) {
+	if !cmd.Bidirectional() {
+		return cmd.IllegalRequest(), nil
+	}
+	if protectField(cmd) != 0 {
+		return cmd.IllegalRequest(), nil
+	}
+	disableWrite := cmd.rwFlags()&0x04 != 0
+	if !disableWrite && cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	lba := cmd.LBA()
+	blocks := cmd.XferLen()
+	if !cmd.Device().Sizes().InRange(lba, blocks) {
+		return cmd.LBAOutOfRange(), nil
+	}
+	offset := int64(lba) * cmd.Device().Sizes().BlockSize
+	length := int(blocks) * int(cmd.Device().Sizes().BlockSize)
+	if len(cmd.Buf) < length {
+		cmd.Buf = make([]byte, length)
+	}
+	old := cmd.Buf[:length]
+	if resp, ok := cmd.aborted(false); ok {
+		return resp, nil
+	}
+	n, err := readAtFlags(rw, old, offset, cmd.IOFlags())
+	if n == length && err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		log.Errorln("xdwriteread/read failed: error:", err)
+		return cmd.BackendError(err, false), nil
+	}
+	if n < length {
+		return cmd.BackendError(io.ErrUnexpectedEOF, false), nil
+	}
+	data := make([]byte, length)
+	n, err = cmd.Read(data)
+	if err != nil || n < length {
+		log.Errorln("xdwriteread/read data-out failed: error:", err)
 		return cmd.MediumError(), nil
 	}
+	if !disableWrite {
+		if resp, ok := cmd.aborted(true); ok {
+			return resp, nil
+		}
+		n, err = writeAtFlags(rw, data, offset, cmd.IOFlags())
+		if err != nil {
+			log.Errorln("xdwriteread/write failed: error:", err)
+			return cmd.BackendError(err, true), nil
+		}
+		if n < length {
+			return cmd.BackendError(io.ErrShortWrite, true), nil
+		}
+	}
+	for i := range old {
+		old[i] ^= data[i]
+	}
+	n, err = cmd.Write(old)
+	if err != nil || n < length {
+		log.Errorln("xdwriteread/write data-in failed: error:", err)
+		return cmd.MediumError(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// EmulateVerify handles VERIFY (10), (12), (16) and (32). With BYTCHK clear, the blocks (and any stored
+// protection information) are read back and checked. Otherwise the data-out buffer is compared against
+// the medium: either all of it, or, with BYTCHK 11b, a single block against every block in the range.
+func EmulateVerify(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
+	lba := cmd.LBA()
+	blocks := cmd.XferLen()
+	if !cmd.Device().Sizes().InRange(lba, blocks) {
+		return cmd.LBAOutOfRange(), nil
+	}
+	pt := cmd.Device().ProtectionType()
+	if resp, ok := checkProtectField(cmd, pt); !ok {
+		return resp, nil
+	}
+	bytchk := (cmd.rwFlags() >> 1) & 0x03
+	if bytchk == 2 {
+		return cmd.IllegalRequest(), nil
+	}
+	blockSize := int(cmd.Device().Sizes().BlockSize)
+	expected := make([]byte, blockSize)
+	if bytchk == 3 {
+		if n, err := cmd.Read(expected); err != nil || n < blockSize {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+		}
+	}
+	if len(cmd.Buf) < blockSize {
+		cmd.Buf = make([]byte, blockSize)
+	}
+	data := cmd.Buf[:blockSize]
+	exp := expectedPI(cmd, pt, lba)
+	for i := uint32(0); i < blocks; i++ {
+		if resp, ok := cmd.aborted(false); ok {
+			return resp, nil
+		}
+		block := lba + uint64(i)
+		n, err := r.ReadAt(data, int64(block)*int64(blockSize))
+		if n == blockSize && err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			log.Errorln("verify/read failed: error:", err)
+			return cmd.BackendError(err, false), nil
+		}
+		if n < blockSize {
+			return cmd.BackendError(io.ErrUnexpectedEOF, false), nil
+		}
+		if pt != ProtectionNone {
+			e := exp
+			e.ref += i
+			if resp, ok := verifyStoredPI(cmd, r, block, data, pt, e); !ok {
+				return resp, nil
+			}
+		}
+		if bytchk == 1 {
+			if n, err := cmd.Read(expected); err != nil || n < blockSize {
+				return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+			}
+		}
+		if bytchk == 0 {
+			continue
+		}
+		for j := range data {
+			if data[j] != expected[j] {
+				return cmd.CheckConditionSense(FixedSense{
+					Key:       scsi.SenseMiscompare,
+					ASC:       scsi.AscMiscompareDuringVerifyOperation,
+					Info:      uint32(int(i)*blockSize + j),
+					InfoValid: true,
+				}), nil
+			}
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+// EmulateWriteSame handles WRITE SAME (10), (16) and (32): the single block in the data-out buffer (or
+// zeroes, if NDOB is set) is written to every block in the range. The UNMAP and ANCHOR hints are accepted,
+// and satisfied by writing the data.
+func EmulateWriteSame(cmd *SCSICmd, w io.WriterAt) (SCSIResponse, error) {
+	if cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	flags := cmd.rwFlags()
+	if flags&0x06 != 0 {
+		// PBDATA and LBDATA are obsolete.
+		return cmd.IllegalRequest(), nil
+	}
+	ndob := cmd.CdbLen() != 10 && flags&0x01 != 0
+	lba := cmd.LBA()
+	blocks := cmd.XferLen()
+	if blocks == 0 {
+		return cmd.IllegalRequest(), nil
+	}
+	if !cmd.Device().Sizes().InRange(lba, blocks) {
+		return cmd.LBAOutOfRange(), nil
+	}
+	pt := cmd.Device().ProtectionType()
+	if resp, ok := checkProtectField(cmd, pt); !ok {
+		return resp, nil
+	}
+	blockSize := int(cmd.Device().Sizes().BlockSize)
+	block := make([]byte, blockSize)
+	if !ndob {
+		if n, err := cmd.Read(block); err != nil || n < blockSize {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+		}
+	}
+	exp := expectedPI(cmd, pt, lba)
+	tuple := make([]byte, piTupleSize)
+	if pt != ProtectionNone {
+		generatePI(tuple, block, blockSize, pt, exp)
+		if field := protectField(cmd); field != 0 && len(cmd.PIVecs()) != 0 {
+			if n, err := cmd.ReadPI(tuple); err != nil || n < piTupleSize {
+				return cmd.IllegalRequest(), nil
+			}
+			c, _ := checksFor(field, pt)
+			if resp, ok := verifyPI(cmd, tuple, block, lba, pt, c, exp); !ok {
+				return resp, nil
+			}
+		}
+	}
+	store, hasStore := w.(PIStore)
+
+	// Write in chunks of up to 1MiB worth of blocks.
+	chunk := (1024 * 1024) / blockSize
+	if chunk == 0 {
+		chunk = 1
+	}
+	if uint32(chunk) > blocks {
+		chunk = int(blocks)
+	}
+	buf := bytes.Repeat(block, chunk)
+	var pi []byte
+	if pt != ProtectionNone && hasStore {
+		pi = bytes.Repeat(tuple, chunk)
+	}
+	for done := uint32(0); done < blocks; {
+		if resp, ok := cmd.aborted(true); ok {
+			return resp, nil
+		}
+		n := uint32(chunk)
+		if blocks-done < n {
+			n = blocks - done
+		}
+		at := lba + uint64(done)
+		length := int(n) * blockSize
+		// WRITE SAME has no FUA or DPO; those bits are ANCHOR and UNMAP.
+		wrote, err := w.WriteAt(buf[:length], int64(at)*int64(blockSize))
+		if err != nil {
+			log.Errorln("writesame/write failed: error:", err)
+			return cmd.BackendError(err, true), nil
+		}
+		if wrote < length {
+			return cmd.BackendError(io.ErrShortWrite, true), nil
+		}
+		if pi != nil {
+			if pt != ProtectionType3 {
+				// The reference tag counts up with every block.
+				for i := uint32(0); i < n; i++ {
+					binary.BigEndian.PutUint32(pi[i*piTupleSize+4:], binary.BigEndian.Uint32(tuple[4:8])+done+i)
+				}
+			}
+			if _, err := store.WritePIAt(pi[:int(n)*piTupleSize], at); err != nil {
+				log.Errorln("writesame/write pi failed: error:", err)
+				return cmd.BackendError(err, true), nil
+			}
+		}
+		done += n
+	}
 	return cmd.Ok(), nil
 }
+
+// EmulateWriteAtomic handles WRITE ATOMIC (16). The backing store must implement AtomicWriterAt and the
+// device must advertise AtomicLimits. If the CDB sets an atomic boundary, each boundary sized piece of the
+// write is atomic on its own; otherwise the whole write is.
+func EmulateWriteAtomic(cmd *SCSICmd, w io.WriterAt) (SCSIResponse, error) {
+	aw, ok := w.(AtomicWriterAt)
+	limits := cmd.Device().AtomicLimits()
+	if !ok || limits.MaxLength == 0 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode), nil
+	}
+	if cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	lba := cmd.LBA()
+	blocks := cmd.XferLen()
+	if !cmd.Device().Sizes().InRange(lba, blocks) {
+		return cmd.LBAOutOfRange(), nil
+	}
+	boundary := uint32(binary.BigEndian.Uint16(cmd.cdb[10:12]))
+	if !limits.allows(lba, blocks, boundary) {
+		return cmd.IllegalRequest(), nil
+	}
+	if blocks == 0 {
+		return cmd.Ok(), nil
+	}
+	pt := cmd.Device().ProtectionType()
+	if resp, ok := checkProtectField(cmd, pt); !ok {
+		return resp, nil
+	}
+	chunk := int(blocks)
+	if boundary != 0 && boundary < blocks {
+		chunk = int(boundary)
+	}
+	chunk *= int(cmd.Device().Sizes().BlockSize)
+	fua := cmd.FUA()
+	return writeBlocks(cmd, w, lba, blocks, pt, func(p []byte, off int64) (int, error) {
+		done := 0
+		for done < len(p) {
+			if err := cmd.Context().Err(); err != nil {
+				return done, err
+			}
+			end := done + chunk
+			if end > len(p) {
+				end = len(p)
+			}
+			n, err := aw.WriteAtAtomic(p[done:end], off+int64(done))
+			done += n
+			if err != nil {
+				return done, err
+			}
+		}
+		if fua {
+			return done, syncRange(w, off, int64(done))
+		}
+		return done, nil
+	})
+}
+
+// allows reports whether a WRITE ATOMIC of `blocks` blocks at `lba`, with the given atomic boundary, is
+// within the limits.
+func (l AtomicLimits) allows(lba uint64, blocks, boundary uint32) bool {
+	if l.Alignment != 0 && lba%uint64(l.Alignment) != 0 {
+		return false
+	}
+	if l.Granularity != 0 && blocks%l.Granularity != 0 {
+		return false
+	}
+	if boundary == 0 {
+		return blocks <= l.MaxLength
+	}
+	return boundary <= l.MaxBoundary && blocks <= l.MaxLengthWithBoundary
+}
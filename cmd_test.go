@@ -0,0 +1,57 @@
+package tcmu
+
+import (
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+// memStore is a ReadWriterAt backed by memory.
+type memStore struct {
+	b []byte
+}
+
+func (m *memStore) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, m.b[off:]), nil
+}
+
+func (m *memStore) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m.b[off:], p), nil
+}
+
+// newTestDevice returns a Device of `size` bytes in blocks of `bs`, which is not attached to the kernel.
+func newTestDevice(size, bs int64) *Device {
+	return &Device{scsi: &SCSIHandler{
+		VolumeName: "test",
+		DataSizes:  DataSizes{VolumeSize: size, BlockSize: bs},
+	}}
+}
+
+// newTestCmd returns a command for `d` with the CDB `cdb`, sending `out` and with room for `in` bytes of
+// data in.
+func newTestCmd(d *Device, cdb []byte, out []byte, in int) *SCSICmd {
+	cmd := &SCSICmd{cdb: cdb, device: d}
+	switch {
+	case out != nil && in > 0:
+		cmd.dataOut = &iovCursor{vecs: [][]byte{out}}
+		cmd.dataIn = &iovCursor{vecs: [][]byte{make([]byte, in)}}
+	case in > 0:
+		cmd.dataOut = &iovCursor{vecs: [][]byte{make([]byte, in)}}
+		cmd.dataIn = cmd.dataOut
+	default:
+		cmd.dataOut = &iovCursor{vecs: [][]byte{out}}
+		cmd.dataIn = cmd.dataOut
+	}
+	return cmd
+}
+
+// dataIn returns the buffer a command returns its data in.
+func dataIn(cmd *SCSICmd) []byte {
+	return cmd.dataIn.vecs[0]
+}
+
+// senseOf returns the sense key and the ASC and ASCQ of a response, or zeroes if it is GOOD.
+func senseOf(r SCSIResponse) (byte, uint16) {
+	if r.status == scsi.SamStatGood {
+		return 0, 0
+	}
+	return r.senseBuffer[2] & 0x0f, uint16(r.senseBuffer[12])<<8 | uint16(r.senseBuffer[13])
+}
@@ -0,0 +1,650 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// ErrNoSpareBlocks is returned when a defective block cannot be remapped, as every spare block is in use.
+var ErrNoSpareBlocks = errors.New("no spare blocks left")
+
+// Defect list formats of READ DEFECT DATA.
+const (
+	defectFormatShortBlock = 0x0
+	defectFormatLongBlock  = 0x3
+)
+
+// DefectConfig describes the defect management of a DefectCmdHandler.
+type DefectConfig struct {
+	// The size of the device, which must match the SCSIHandler.
+	Sizes DataSizes
+	// The number of spare blocks. They follow the end of the device in the
+	// backing store, which must be large enough to hold them.
+	Spares int
+	// The sidecar file holding the defect list. If empty, the list is only
+	// kept in memory, and blocks remapped to a spare read their old contents
+	// after a restart.
+	StatePath string
+}
+
+// defect is an entry of the primary or the grown defect list.
+type defect struct {
+	LBA uint64 `json:"lba"`
+	// The spare block the LBA is remapped to, or -1.
+	Spare   int  `json:"spare"`
+	Primary bool `json:"primary,omitempty"`
+	// Reads of the block fail until it is reassigned.
+	Pending bool `json:"pending,omitempty"`
+}
+
+type defectState struct {
+	Defects []defect `json:"defects"`
+}
+
+// DefectCmdHandler is a ReadWriterAtCmdHandler with a list of defective blocks, for testing how initiators
+// handle media errors. Reads of a block in the grown defect list fail with MEDIUM ERROR, reporting the
+// block in the INFORMATION field, until REASSIGN BLOCKS remaps it to a spare block. Writes to such a block
+// succeed, as they would on a drive that only notices the defect when reading. Blocks of the primary
+// defect list are remapped from the start. READ DEFECT DATA reports both lists.
+type DefectCmdHandler struct {
+	ReadWriterAtCmdHandler
+
+	rw         ReadWriterAt
+	conf       DefectConfig
+	mu         sync.Mutex
+	defects    map[uint64]*defect
+	sparesUsed []bool
+	remapped   int
+	generation uint16
+}
+
+// NewDefectCmdHandler creates a handler with an empty defect list, or the one saved in conf.StatePath.
+func NewDefectCmdHandler(rw ReadWriterAt, conf DefectConfig) (*DefectCmdHandler, error) {
+	h := &DefectCmdHandler{
+		rw:         rw,
+		conf:       conf,
+		defects:    make(map[uint64]*defect),
+		sparesUsed: make([]bool, conf.Spares),
+	}
+	h.ReadWriterAtCmdHandler.RW = newDefectReadWriterAt(h)
+	if conf.StatePath == "" {
+		return h, nil
+	}
+	data, err := ioutil.ReadFile(conf.StatePath)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state defectState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Invalid defect list in %s: %v", conf.StatePath, err)
+	}
+	for i := range state.Defects {
+		d := state.Defects[i]
+		if d.Spare >= conf.Spares {
+			return nil, fmt.Errorf("Defect list in %s uses spare %d of %d", conf.StatePath, d.Spare, conf.Spares)
+		}
+		if d.Spare >= 0 {
+			h.sparesUsed[d.Spare] = true
+			h.remapped++
+		}
+		h.defects[d.LBA] = &d
+	}
+	return h, nil
+}
+
+// DefectSCSIHandler is BasicSCSIHandler for a device with a defect list.
+func DefectSCSIHandler(h *DefectCmdHandler) *SCSIHandler {
+	s := BasicSCSIHandler(h.rw)
+	s.DataSizes = h.conf.Sizes
+	s.DevReady = MultiThreadedDevReady(h, 2)
+	return s
+}
+
+// save must be called with mu held.
+func (h *DefectCmdHandler) save() error {
+	h.generation++
+	if h.conf.StatePath == "" {
+		return nil
+	}
+	var state defectState
+	for _, d := range h.defects {
+		state.Defects = append(state.Defects, *d)
+	}
+	sort.Slice(state.Defects, func(i, j int) bool { return state.Defects[i].LBA < state.Defects[j].LBA })
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := h.conf.StatePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.conf.StatePath)
+}
+
+func (h *DefectCmdHandler) checkLBA(lba uint64) error {
+	if !h.conf.Sizes.InRange(lba, 1) {
+		return fmt.Errorf("LBA %d is beyond the end of the device", lba)
+	}
+	return nil
+}
+
+// AddDefect adds `lba` to the grown defect list. Reads of it fail until it is reassigned, even if it was
+// already remapped to a spare block.
+func (h *DefectCmdHandler) AddDefect(lba uint64) error {
+	if err := h.checkLBA(lba); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.defects[lba]
+	if !ok {
+		d = &defect{LBA: lba, Spare: -1}
+		h.defects[lba] = d
+	}
+	d.Pending = true
+	return h.save()
+}
+
+// AddPrimaryDefect adds `lba` to the primary defect list, remapping it to a spare block as the factory
+// would have.
+func (h *DefectCmdHandler) AddPrimaryDefect(lba uint64) error {
+	if err := h.checkLBA(lba); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.reassign(lba); err != nil {
+		return err
+	}
+	h.defects[lba].Primary = true
+	return h.save()
+}
+
+// RemoveDefect takes `lba` off the defect lists. If it was remapped, the contents of its spare block are
+// copied back.
+func (h *DefectCmdHandler) RemoveDefect(lba uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.defects[lba]
+	if !ok {
+		return nil
+	}
+	if d.Spare >= 0 {
+		if err := h.copyBlock(h.spareOffset(d.Spare), h.blockOffset(lba)); err != nil {
+			return err
+		}
+		h.sparesUsed[d.Spare] = false
+		h.remapped--
+	}
+	delete(h.defects, lba)
+	return h.save()
+}
+
+// Defects returns the primary and the grown defect lists, in order of LBA.
+func (h *DefectCmdHandler) Defects() (primary, grown []uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for lba, d := range h.defects {
+		if d.Primary {
+			primary = append(primary, lba)
+		} else {
+			grown = append(grown, lba)
+		}
+	}
+	sort.Slice(primary, func(i, j int) bool { return primary[i] < primary[j] })
+	sort.Slice(grown, func(i, j int) bool { return grown[i] < grown[j] })
+	return primary, grown
+}
+
+func (h *DefectCmdHandler) blockOffset(lba uint64) int64 {
+	return int64(lba) * h.conf.Sizes.BlockSize
+}
+
+func (h *DefectCmdHandler) spareOffset(spare int) int64 {
+	return h.conf.Sizes.VolumeSize + int64(spare)*h.conf.Sizes.BlockSize
+}
+
+// copyBlock copies a block of the backing store, with its protection information if the store keeps it.
+func (h *DefectCmdHandler) copyBlock(from, to int64) error {
+	bs := h.conf.Sizes.BlockSize
+	buf := make([]byte, bs)
+	if _, err := h.rw.ReadAt(buf, from); err != nil && err != io.EOF {
+		return err
+	}
+	if _, err := h.rw.WriteAt(buf, to); err != nil {
+		return err
+	}
+	store, ok := h.rw.(PIStore)
+	if !ok {
+		return nil
+	}
+	pi := make([]byte, piTupleSize)
+	if _, err := store.ReadPIAt(pi, uint64(from/bs)); err != nil && err != io.EOF {
+		return err
+	}
+	_, err := store.WritePIAt(pi, uint64(to/bs))
+	return err
+}
+
+// reassign remaps `lba` to a free spare block, carrying its contents over, and adds it to the grown
+// defect list if it is not on a list already. Must be called with mu held.
+func (h *DefectCmdHandler) reassign(lba uint64) error {
+	spare := -1
+	for i, used := range h.sparesUsed {
+		if !used {
+			spare = i
+			break
+		}
+	}
+	if spare == -1 {
+		return ErrNoSpareBlocks
+	}
+	d, ok := h.defects[lba]
+	if !ok {
+		d = &defect{LBA: lba, Spare: -1}
+	}
+	from := h.blockOffset(lba)
+	if d.Spare >= 0 {
+		from = h.spareOffset(d.Spare)
+	}
+	if err := h.copyBlock(from, h.spareOffset(spare)); err != nil {
+		return err
+	}
+	h.sparesUsed[spare] = true
+	if d.Spare >= 0 {
+		h.sparesUsed[d.Spare] = false
+	} else {
+		h.remapped++
+	}
+	d.Spare = spare
+	d.Pending = false
+	h.defects[lba] = d
+	return nil
+}
+
+// firstPending returns the first block of [lba, lba+blocks) that reads fail on.
+func (h *DefectCmdHandler) firstPending(lba uint64, blocks uint32) (uint64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	found := false
+	var first uint64
+	for _, d := range h.defects {
+		if d.Pending && d.LBA >= lba && d.LBA < lba+uint64(blocks) && (!found || d.LBA < first) {
+			first = d.LBA
+			found = true
+		}
+	}
+	return first, found
+}
+
+func (h *DefectCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	if resp, ok := checkMediumAccess(cmd); !ok {
+		return resp, nil
+	}
+	if isReadCommand(cmd) {
+		return h.read(cmd)
+	}
+	switch cmd.Command() {
+	case scsi.ReassignBlocks:
+		return h.reassignBlocks(cmd)
+	case scsi.ReadDefectData, scsi.ReadDefectData12:
+		return h.readDefectData(cmd)
+	}
+	return h.ReadWriterAtCmdHandler.HandleCommand(cmd)
+}
+
+// read fails a READ or VERIFY that covers a block of the grown defect list which has not been reassigned.
+func (h *DefectCmdHandler) read(cmd *SCSICmd) (SCSIResponse, error) {
+	if lba, ok := h.firstPending(cmd.LBA(), xferBlocks(cmd)); ok {
+		return cmd.CheckConditionSense(FixedSense{
+			Key:       scsi.SenseMediumError,
+			ASC:       scsi.AscReadError,
+			Info:      uint32(lba),
+			InfoValid: lba <= 0xffffffff,
+		}), nil
+	}
+	return h.ReadWriterAtCmdHandler.HandleCommand(cmd)
+}
+
+// reassignBlocks remaps every LBA of the parameter list to a spare block.
+func (h *DefectCmdHandler) reassignBlocks(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	longLBA := cmd.GetCDB(1)&0x02 != 0
+	longList := cmd.GetCDB(1)&0x01 != 0
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(cmd, hdr); err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	listLen := int(binary.BigEndian.Uint16(hdr[2:4]))
+	if longList {
+		listLen = int(binary.BigEndian.Uint32(hdr))
+	}
+	size := 4
+	if longLBA {
+		size = 8
+	}
+	if listLen%size != 0 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	// No list can hold more LBAs than there are spares, and defects that
+	// are already remapped.
+	h.mu.Lock()
+	maxLen := (h.conf.Spares + len(h.defects)) * size
+	h.mu.Unlock()
+	if listLen > maxLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+	list := make([]byte, listLen)
+	if _, err := io.ReadFull(cmd, list); err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	lbas := make([]uint64, 0, listLen/size)
+	for off := 0; off < listLen; off += size {
+		var lba uint64
+		if longLBA {
+			lba = binary.BigEndian.Uint64(list[off:])
+		} else {
+			lba = uint64(binary.BigEndian.Uint32(list[off:]))
+		}
+		if !h.conf.Sizes.InRange(lba, 1) {
+			return cmd.LBAOutOfRange(), nil
+		}
+		lbas = append(lbas, lba)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, lba := range lbas {
+		err := h.reassign(lba)
+		if err == ErrNoSpareBlocks {
+			h.saveAfterFailure()
+			return cmd.CheckConditionSense(FixedSense{
+				Key:       scsi.SenseHardwareError,
+				ASC:       scsi.AscNoDefectSpareLocationAvailable,
+				Info:      uint32(lba),
+				InfoValid: lba <= 0xffffffff,
+			}), nil
+		}
+		if err != nil {
+			h.saveAfterFailure()
+			return cmd.BackendError(err, true), nil
+		}
+	}
+	if err := h.save(); err != nil {
+		log.Errorf("couldn't save the defect list: %v", err)
+		return cmd.TargetFailure(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// saveAfterFailure saves the blocks REASSIGN BLOCKS managed to reassign before it failed. The command
+// already reports the failure, so an error saving is only logged. Must be called with mu held.
+func (h *DefectCmdHandler) saveAfterFailure() {
+	if err := h.save(); err != nil {
+		log.Errorf("couldn't save the defect list: %v", err)
+	}
+}
+
+// readDefectData answers READ DEFECT DATA (10) and (12), in the short or long block format.
+func (h *DefectCmdHandler) readDefectData(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	ten := cmd.Command() == scsi.ReadDefectData
+	var flags byte
+	var allocLen, index int
+	if ten {
+		flags = cmd.GetCDB(2)
+		allocLen = int(order.Uint16(cmd.cdb[7:9]))
+	} else {
+		flags = cmd.GetCDB(1)
+		index = int(order.Uint32(cmd.cdb[2:6]))
+		allocLen = int(order.Uint32(cmd.cdb[6:10]))
+	}
+	wantPrimary := flags&0x10 != 0
+	wantGrown := flags&0x08 != 0
+	format := byte(defectFormatShortBlock)
+	size := 4
+	if flags&0x07 == defectFormatLongBlock {
+		format = defectFormatLongBlock
+		size = 8
+	}
+
+	primary, grown := h.Defects()
+	var lbas []uint64
+	if wantPrimary {
+		lbas = append(lbas, primary...)
+	}
+	if wantGrown {
+		lbas = append(lbas, grown...)
+	}
+	if index > len(lbas) {
+		index = len(lbas)
+	}
+	lbas = lbas[index:]
+	list := make([]byte, size*len(lbas))
+	for i, lba := range lbas {
+		if size == 8 {
+			order.PutUint64(list[8*i:], lba)
+		} else {
+			order.PutUint32(list[4*i:], uint32(lba))
+		}
+	}
+
+	flags = format
+	if wantPrimary {
+		flags |= 0x10 // PLISTV
+	}
+	if wantGrown {
+		flags |= 0x08 // GLISTV
+	}
+	var data []byte
+	if ten {
+		if len(list) > 0xffff {
+			list = list[:0xffff/size*size]
+		}
+		data = make([]byte, 4+len(list))
+		data[1] = flags
+		order.PutUint16(data[2:4], uint16(len(list)))
+		copy(data[4:], list)
+	} else {
+		data = make([]byte, 8+len(list))
+		data[1] = flags
+		h.mu.Lock()
+		order.PutUint16(data[2:4], h.generation)
+		h.mu.Unlock()
+		order.PutUint32(data[4:8], uint32(len(list)))
+		copy(data[8:], list)
+	}
+	return writeTruncated(cmd, data, allocLen)
+}
+
+// newDefectReadWriterAt returns the ReadWriterAt of `h`, which implements PIStore and AtomicWriterAt when
+// the backing store does.
+func newDefectReadWriterAt(h *DefectCmdHandler) ReadWriterAt {
+	r := defectReadWriterAt{h}
+	_, pi := h.rw.(PIStore)
+	_, atomic := h.rw.(AtomicWriterAt)
+	switch {
+	case pi && atomic:
+		return struct {
+			defectReadWriterAt
+			defectPIStore
+			defectAtomicWriterAt
+		}{r, defectPIStore{h}, defectAtomicWriterAt{h}}
+	case pi:
+		return struct {
+			defectReadWriterAt
+			defectPIStore
+		}{r, defectPIStore{h}}
+	case atomic:
+		return struct {
+			defectReadWriterAt
+			defectAtomicWriterAt
+		}{r, defectAtomicWriterAt{h}}
+	}
+	return r
+}
+
+// defectReadWriterAt redirects I/O to blocks remapped to a spare block.
+type defectReadWriterAt struct {
+	h *DefectCmdHandler
+}
+
+func (r defectReadWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.h.remap(p, off, r.h.rw.ReadAt)
+}
+
+func (r defectReadWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return r.h.remap(p, off, r.h.rw.WriteAt)
+}
+
+// WriteAtFlags passes FUA and DPO through to the wrapped store, for each run of the write.
+func (r defectReadWriterAt) WriteAtFlags(p []byte, off int64, flags IOFlags) (int, error) {
+	return r.h.remap(p, off, func(p []byte, off int64) (int, error) {
+		return writeAtFlags(r.h.rw, p, off, flags)
+	})
+}
+
+// SyncRange passes flushes through to the wrapped store. Once blocks have been remapped, the spare blocks
+// are flushed too, as some of the range may live there.
+func (r defectReadWriterAt) SyncRange(off, length int64) error {
+	h := r.h
+	h.mu.Lock()
+	remapped := h.remapped
+	h.mu.Unlock()
+	switch s := h.rw.(type) {
+	case RangeSyncer:
+		if err := s.SyncRange(off, length); err != nil || remapped == 0 {
+			return err
+		}
+		return s.SyncRange(h.spareOffset(0), int64(h.conf.Spares)*h.conf.Sizes.BlockSize)
+	case Syncer:
+		return s.Sync()
+	}
+	return nil
+}
+
+// defectPIStore redirects the protection information of remapped blocks to that of their spare blocks.
+type defectPIStore struct {
+	h *DefectCmdHandler
+}
+
+func (r defectPIStore) ReadPIAt(p []byte, lba uint64) (int, error) {
+	return r.h.remapPI(p, lba, r.h.rw.(PIStore).ReadPIAt)
+}
+
+func (r defectPIStore) WritePIAt(p []byte, lba uint64) (int, error) {
+	return r.h.remapPI(p, lba, r.h.rw.(PIStore).WritePIAt)
+}
+
+// defectAtomicWriterAt passes atomic writes through to the wrapped store. A write that touches a remapped
+// block is split over the device and its spare blocks, so it cannot be atomic and is refused.
+type defectAtomicWriterAt struct {
+	h *DefectCmdHandler
+}
+
+func (r defectAtomicWriterAt) WriteAtAtomic(p []byte, off int64) (int, error) {
+	runs := r.h.runs(p, off)
+	if len(runs) != 1 {
+		return 0, errAtomicRemapped
+	}
+	return r.h.rw.(AtomicWriterAt).WriteAtAtomic(runs[0].p, runs[0].off)
+}
+
+var errAtomicRemapped = errors.New("atomic write across a remapped block")
+
+// defectRun is a piece of an I/O that is stored contiguously in the backing store.
+type defectRun struct {
+	p   []byte
+	off int64
+}
+
+// runs splits `p`, to be read or written at `off`, into the runs that are stored contiguously in the
+// backing store.
+func (h *DefectCmdHandler) runs(p []byte, off int64) []defectRun {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.remapped == 0 {
+		return []defectRun{{p, off}}
+	}
+	bs := h.conf.Sizes.BlockSize
+	var runs []defectRun
+	for pos := int64(0); pos < int64(len(p)); {
+		end := ((off+pos)/bs+1)*bs - off
+		if end > int64(len(p)) {
+			end = int64(len(p))
+		}
+		target := off + pos
+		if d, ok := h.defects[uint64((off+pos)/bs)]; ok && d.Spare >= 0 {
+			target = h.spareOffset(d.Spare) + (off+pos)%bs
+		}
+		if n := len(runs); n > 0 && runs[n-1].off+int64(len(runs[n-1].p)) == target {
+			runs[n-1].p = p[pos-int64(len(runs[n-1].p)) : end]
+		} else {
+			runs = append(runs, defectRun{p[pos:end], target})
+		}
+		pos = end
+	}
+	return runs
+}
+
+// remap calls `do` for every run of `p` that is stored contiguously in the backing store.
+func (h *DefectCmdHandler) remap(p []byte, off int64, do func(p []byte, off int64) (int, error)) (int, error) {
+	total := 0
+	for _, r := range h.runs(p, off) {
+		n, err := do(r.p, r.off)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// remapPI calls `do` for every run of the protection information tuples in `p`, the first of which is
+// that of `lba`, whose blocks are stored contiguously in the backing store.
+func (h *DefectCmdHandler) remapPI(p []byte, lba uint64, do func(p []byte, lba uint64) (int, error)) (int, error) {
+	type run struct {
+		p   []byte
+		lba uint64
+	}
+	h.mu.Lock()
+	var runs []run
+	for pos := 0; pos+piTupleSize <= len(p); pos += piTupleSize {
+		target := lba + uint64(pos/piTupleSize)
+		if d, ok := h.defects[target]; ok && d.Spare >= 0 {
+			target = uint64(h.spareOffset(d.Spare) / h.conf.Sizes.BlockSize)
+		}
+		if n := len(runs); n > 0 && runs[n-1].lba+uint64(len(runs[n-1].p)/piTupleSize) == target {
+			runs[n-1].p = p[pos-len(runs[n-1].p) : pos+piTupleSize]
+		} else {
+			runs = append(runs, run{p[pos : pos+piTupleSize], target})
+		}
+	}
+	h.mu.Unlock()
+
+	total := 0
+	for _, r := range runs {
+		n, err := do(r.p, r.lba)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
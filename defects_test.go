@@ -0,0 +1,224 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+const (
+	defectTestBlocks = 64
+	defectTestBS     = 512
+)
+
+// newDefectTest returns a device with a DefectCmdHandler on a store whose blocks are filled with their
+// LBA, with the defect list saved in `state`.
+func newDefectTest(t *testing.T, store *memStore, state string, spares int) (*Device, *DefectCmdHandler) {
+	d := newTestDevice(defectTestBlocks*defectTestBS, defectTestBS)
+	h, err := NewDefectCmdHandler(store, DefectConfig{Sizes: d.Sizes(), Spares: spares, StatePath: state})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, h
+}
+
+func newDefectStore(spares int) *memStore {
+	store := &memStore{make([]byte, (defectTestBlocks+spares)*defectTestBS)}
+	for i := range store.b {
+		store.b[i] = byte(i / defectTestBS)
+	}
+	return store
+}
+
+func reassignBlocksCmd(d *Device, long bool, lbas ...uint64) *SCSICmd {
+	cdb := make([]byte, 6)
+	cdb[0] = scsi.ReassignBlocks
+	size := 4
+	if long {
+		cdb[1] = 0x02
+		size = 8
+	}
+	list := make([]byte, 4+size*len(lbas))
+	binary.BigEndian.PutUint16(list[2:4], uint16(size*len(lbas)))
+	for i, lba := range lbas {
+		if long {
+			binary.BigEndian.PutUint64(list[4+8*i:], lba)
+		} else {
+			binary.BigEndian.PutUint32(list[4+4*i:], uint32(lba))
+		}
+	}
+	return newTestCmd(d, cdb, list, 0)
+}
+
+func read10Cmd(d *Device, lba uint32, blocks uint16) *SCSICmd {
+	cdb := make([]byte, 10)
+	cdb[0] = scsi.Read10
+	binary.BigEndian.PutUint32(cdb[2:6], lba)
+	binary.BigEndian.PutUint16(cdb[7:9], blocks)
+	return newTestCmd(d, cdb, nil, int(blocks)*defectTestBS)
+}
+
+// readDefectList returns the primary and grown defects READ DEFECT DATA (12) reports in the long block
+// format.
+func readDefectList(t *testing.T, d *Device, h *DefectCmdHandler) []uint64 {
+	cdb := make([]byte, 12)
+	cdb[0] = scsi.ReadDefectData12
+	cdb[1] = 0x10 | 0x08 | defectFormatLongBlock
+	binary.BigEndian.PutUint32(cdb[6:10], 1024)
+	cmd := newTestCmd(d, cdb, nil, 1024)
+	resp, err := h.HandleCommand(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, asc := senseOf(resp); k != 0 {
+		t.Fatalf("READ DEFECT DATA: sense key 0x%x asc 0x%04x", k, asc)
+	}
+	data := dataIn(cmd)
+	if data[1] != 0x18|defectFormatLongBlock {
+		t.Fatalf("READ DEFECT DATA flags 0x%x", data[1])
+	}
+	var lbas []uint64
+	n := int(binary.BigEndian.Uint32(data[4:8]))
+	for i := 0; i < n; i += 8 {
+		lbas = append(lbas, binary.BigEndian.Uint64(data[8+i:]))
+	}
+	return lbas
+}
+
+func TestReassignBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		spares  int
+		primary []uint64
+		grown   []uint64
+		long    bool
+		list    []uint64
+		key     byte
+		asc     uint16
+		// The defect lists READ DEFECT DATA reports afterwards, primary
+		// first, and the blocks that read back their old contents.
+		defects  []uint64
+		readable []uint64
+	}{
+		{
+			name: "grown defect", spares: 2, grown: []uint64{5},
+			list: []uint64{5}, defects: []uint64{5}, readable: []uint64{5},
+		},
+		{
+			name: "new defects, long LBAs", spares: 2, long: true,
+			list: []uint64{7, 9}, defects: []uint64{7, 9}, readable: []uint64{7, 9},
+		},
+		{
+			name: "primary defects come first", spares: 3, primary: []uint64{40}, grown: []uint64{3},
+			list: []uint64{3, 20}, defects: []uint64{40, 3, 20}, readable: []uint64{3, 20, 40},
+		},
+		{
+			name: "out of spares", spares: 1, grown: []uint64{5, 6},
+			list: []uint64{5, 6}, key: scsi.SenseHardwareError, asc: scsi.AscNoDefectSpareLocationAvailable,
+			defects: []uint64{5, 6}, readable: []uint64{5},
+		},
+		{
+			name: "LBA out of range", spares: 2,
+			list: []uint64{defectTestBlocks}, key: scsi.SenseIllegalRequest, asc: scsi.AscLbaOutOfRange,
+		},
+		{
+			name: "list longer than the spares", spares: 1,
+			list: []uint64{1, 2}, key: scsi.SenseIllegalRequest, asc: scsi.AscInvalidFieldInParameterList,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := filepath.Join(t.TempDir(), "defects.json")
+			store := newDefectStore(tt.spares)
+			d, h := newDefectTest(t, store, state, tt.spares)
+			for _, lba := range tt.primary {
+				if err := h.AddPrimaryDefect(lba); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, lba := range tt.grown {
+				if err := h.AddDefect(lba); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resp, err := h.HandleCommand(reassignBlocksCmd(d, tt.long, tt.list...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k, asc := senseOf(resp); k != tt.key || asc != tt.asc {
+				t.Fatalf("sense key 0x%x asc 0x%04x, want 0x%x 0x%04x", k, asc, tt.key, tt.asc)
+			}
+			if got := readDefectList(t, d, h); !reflect.DeepEqual(got, tt.defects) {
+				t.Errorf("defects %v, want %v", got, tt.defects)
+			}
+
+			// The reassigned blocks survive a restart.
+			d, h = newDefectTest(t, store, state, tt.spares)
+			for _, lba := range tt.readable {
+				cmd := read10Cmd(d, uint32(lba), 1)
+				resp, err := h.HandleCommand(cmd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if k, asc := senseOf(resp); k != 0 {
+					t.Fatalf("read of LBA %d: sense key 0x%x asc 0x%04x", lba, k, asc)
+				}
+				if got := dataIn(cmd)[0]; got != byte(lba) {
+					t.Errorf("LBA %d reads block %d", lba, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDefectPrechecks(t *testing.T) {
+	tests := []struct {
+		name         string
+		standby      bool
+		writeProtect bool
+		cmd          func(d *Device) *SCSICmd
+		key          byte
+		asc          uint16
+	}{
+		{
+			name: "medium error", cmd: func(d *Device) *SCSICmd { return read10Cmd(d, 4, 2) },
+			key: scsi.SenseMediumError, asc: scsi.AscReadError,
+		},
+		{
+			name: "standby before medium error", standby: true,
+			cmd: func(d *Device) *SCSICmd { return read10Cmd(d, 4, 2) },
+			key: scsi.SenseNotReady, asc: scsi.AscTargetPortInStandbyState,
+		},
+		{
+			name: "write protected reassign", writeProtect: true,
+			cmd: func(d *Device) *SCSICmd { return reassignBlocksCmd(d, false, 5) },
+			key: scsi.SenseDataProtect, asc: scsi.AscWriteProtected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, h := newDefectTest(t, newDefectStore(1), "", 1)
+			if err := h.AddDefect(5); err != nil {
+				t.Fatal(err)
+			}
+			if tt.standby {
+				d.alua = []aluaGroup{{ALUAGroup: ALUAGroup{ID: 1, State: ALUAStandby}}}
+			}
+			d.writeProtect = tt.writeProtect
+			resp, err := h.HandleCommand(tt.cmd(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k, asc := senseOf(resp); k != tt.key || asc != tt.asc {
+				t.Fatalf("sense key 0x%x asc 0x%04x, want 0x%x 0x%04x", k, asc, tt.key, tt.asc)
+			}
+			if _, grown := h.Defects(); !reflect.DeepEqual(grown, []uint64{5}) {
+				t.Errorf("grown defects %v", grown)
+			}
+		})
+	}
+}
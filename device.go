@@ -3,6 +3,7 @@
 package tcmu
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -10,11 +11,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/alternative-storage/go-tcmu/scsi"
 	"github.com/prometheus/common/log"
 	"github.com/sirupsen/logrus"
 )
@@ -37,8 +40,40 @@ type Device struct {
 	cmdChan  chan *SCSICmd
 	respChan chan SCSIResponse
 	cmdTail  uint32
+	// Whether the kernel accepts out of order completions. Without it,
+	// responses wait in completions until every command before them in the
+	// ring has completed.
+	ooo         bool
+	completions map[uint16]SCSIResponse
 
 	toClean map[string]bool
+
+	// Serializes changes of the target port group states, which are written
+	// to configfs without holding mu.
+	aluaMu sync.Mutex
+	// Guards the runtime state below, which may be changed while commands are in flight.
+	mu             sync.Mutex
+	writeProtect   bool
+	protection     ProtectionType
+	unitAttentions []uint16
+	// Self-test results, newest first, and the sequence number of the
+	// newest. Whether a self-test is running, and the cancel function of the
+	// background one.
+	selfTests      []selfTestResult
+	selfTestSeq    uint64
+	selfTestBusy   bool
+	selfTestCancel func()
+	// When the device was opened, for the power on hours of self-test results.
+	opened time.Time
+	// What WRITE BUFFER sent, and the product revision of the microcode it
+	// activated, if any.
+	buffers  bufferState
+	revision string
+	// The target port groups, in their current state.
+	alua []aluaGroup
+	// Cancels the contexts of the commands fetched from the ring and not yet
+	// completed.
+	inflight map[uint16]context.CancelFunc
 }
 
 // WWN provides two WWNs, one for the device itself and one for the loopback
@@ -56,15 +91,48 @@ func (d *Device) Sizes() DataSizes {
 	return d.scsi.DataSizes
 }
 
+// AtomicLimits returns the WRITE ATOMIC limits the device was created with.
+func (d *Device) AtomicLimits() AtomicLimits {
+	return d.scsi.AtomicLimits
+}
+
+// WriteProtected reports whether the device currently refuses commands that modify the medium.
+func (d *Device) WriteProtected() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.writeProtect
+}
+
+// SetWriteProtected turns write protection on or off while the device is running. The initiator is told
+// about the change with a MODE PARAMETERS CHANGED unit attention, as the WP bit in MODE SENSE flips.
+func (d *Device) SetWriteProtected(wp bool) {
+	d.mu.Lock()
+	changed := d.writeProtect != wp
+	d.writeProtect = wp
+	d.mu.Unlock()
+	if changed {
+		d.RaiseUnitAttention(scsi.AscModeParametersChanged)
+	}
+}
+
 // OpenTCMUDevice creates the virtual device based on the details in the SCSIHandler, eventually creating a device under devPath (eg, "/dev") with the file name scsi.VolumeName.
 // The returned Device represents the open device connection to the kernel, and must be closed.
 func OpenTCMUDevice(devPath string, scsi *SCSIHandler) (*Device, error) {
+	if err := checkALUAGroups(scsi.ALUAGroups); err != nil {
+		return nil, err
+	}
 	d := &Device{
 		scsi:    scsi,
 		devPath: devPath,
 		uioFd:   -1,
 		hbaDir:  fmt.Sprintf(configDirFmt, scsi.HBA),
 		toClean: make(map[string]bool),
+
+		writeProtect: scsi.WriteProtect,
+		protection:   scsi.ProtectionType,
+		opened:       time.Now(),
+		alua:         newALUAGroups(scsi.ALUAGroups),
+		inflight:     make(map[uint16]context.CancelFunc),
 	}
 	if err := d.preEnableTcmu(); err != nil {
 		return d, err
@@ -77,6 +145,12 @@ func OpenTCMUDevice(devPath string, scsi *SCSIHandler) (*Device, error) {
 }
 
 func (d *Device) Close() error {
+	d.abortSelfTest()
+	d.mu.Lock()
+	for _, cancel := range d.inflight {
+		cancel()
+	}
+	d.mu.Unlock()
 	err := d.teardown()
 	if err != nil {
 		return err
@@ -98,9 +172,14 @@ func (d *Device) preEnableTcmu() error {
 		return err
 	}
 
-	return d.writeLines(path.Join(d.hbaDir, d.scsi.VolumeName, "enable"), []string{
+	err = d.writeLines(path.Join(d.hbaDir, d.scsi.VolumeName, "enable"), []string{
 		"1",
 	})
+	if err != nil {
+		return err
+	}
+
+	return d.createALUAGroups()
 }
 
 func (d *Device) getSCSIPrefixAndWnn() (string, string) {
@@ -136,6 +215,10 @@ func (d *Device) postEnableTcmu() error {
 	}
 	d.toClean[path.Join(d.hbaDir, d.scsi.VolumeName)] = true
 
+	if err := d.joinALUAGroup(lunPath); err != nil {
+		return err
+	}
+
 	return d.createDevEntry()
 }
 
@@ -309,6 +392,8 @@ func (d *Device) openDevice(user string, vol string, uio string) error {
 	}
 	d.mmap, err = syscall.Mmap(d.uioFd, 0, int(d.mapsize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 	d.cmdTail = d.mbCmdTail()
+	d.ooo = d.mbFlags()&tcmuMailboxFlagCapOOOC != 0
+	d.completions = make(map[uint16]SCSIResponse)
 	d.debugPrintMb()
 	return err
 }
@@ -334,6 +419,7 @@ func (d *Device) teardown() error {
 		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1/lun/lun_0
 		/sys/kernel/config/target/loopback/naa.<id>/tpgt_1
 		/sys/kernel/config/target/loopback/naa.<id>
+		/sys/kernel/config/target/core/user_42/<volume name>/alua/<group name>
 		/sys/kernel/config/target/core/user_42/<volume name>
 	*/
 	pathsToRemove := []string{
@@ -341,8 +427,11 @@ func (d *Device) teardown() error {
 		lunPath,
 		tpgtPath,
 		path.Dir(tpgtPath),
-		path.Join(d.hbaDir, d.scsi.VolumeName),
 	}
+	for _, g := range d.scsi.ALUAGroups {
+		pathsToRemove = append(pathsToRemove, d.aluaDir(g.Name))
+	}
+	pathsToRemove = append(pathsToRemove, path.Join(d.hbaDir, d.scsi.VolumeName))
 
 	for _, p := range pathsToRemove {
 		if k, _ := d.toClean[p]; k {
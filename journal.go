@@ -0,0 +1,147 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const journalHeaderSize = 24
+
+var (
+	journalMagic = []byte("GOTCMUJ1")
+	crc32c       = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// JournaledFile is a ReadWriterAt over a file that implements AtomicWriterAt with a shadow journal. An
+// atomic write is first written, under a checksummed header, to the journal and synced; only then is it
+// copied into the file. If the process or machine dies in between, OpenJournaledFile replays the journal
+// the next time the file is opened, so the initiator sees either the old blocks or the new ones.
+type JournaledFile struct {
+	f       *os.File
+	journal *os.File
+	// Plain reads and writes hold the read lock, so an atomic write, which holds the write lock, is never
+	// seen half applied.
+	mu sync.RWMutex
+}
+
+// OpenJournaledFile wraps `f` with the journal at `journalPath`, creating the journal if it does not exist
+// and replaying it if it holds an atomic write that was not finished.
+func OpenJournaledFile(f *os.File, journalPath string) (*JournaledFile, error) {
+	journal, err := os.OpenFile(journalPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &JournaledFile{f: f, journal: journal}
+	if err := j.replay(); err != nil {
+		journal.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *JournaledFile) ReadAt(p []byte, off int64) (int, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.f.ReadAt(p, off)
+}
+
+func (j *JournaledFile) WriteAt(p []byte, off int64) (int, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.f.WriteAt(p, off)
+}
+
+// WriteAtAtomic writes `p` at `off` all-or-nothing. The data is on stable storage once it returns.
+func (j *JournaledFile) WriteAtAtomic(p []byte, off int64) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rec := make([]byte, journalHeaderSize+len(p))
+	copy(rec, journalMagic)
+	binary.BigEndian.PutUint64(rec[8:16], uint64(off))
+	binary.BigEndian.PutUint32(rec[16:20], uint32(len(p)))
+	copy(rec[journalHeaderSize:], p)
+	binary.BigEndian.PutUint32(rec[20:24], journalChecksum(rec))
+	if _, err := j.journal.WriteAt(rec, 0); err != nil {
+		return 0, err
+	}
+	if err := j.journal.Sync(); err != nil {
+		return 0, err
+	}
+	if err := j.apply(p, off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (j *JournaledFile) Sync() error {
+	return j.f.Sync()
+}
+
+// Close closes the journal. The wrapped file is left open.
+func (j *JournaledFile) Close() error {
+	return j.journal.Close()
+}
+
+// apply copies a journalled write into the file, syncs it, and then retires the journal entry. The entry
+// must be retired durably, or a later replay could overwrite newer plain writes to the same blocks.
+func (j *JournaledFile) apply(p []byte, off int64) error {
+	if _, err := j.f.WriteAt(p, off); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	if _, err := j.journal.WriteAt(make([]byte, len(journalMagic)), 0); err != nil {
+		return err
+	}
+	return j.journal.Sync()
+}
+
+// replay finishes the atomic write left in the journal, if any. An entry with a bad checksum was torn
+// while being journalled, before the file was touched, and is dropped.
+func (j *JournaledFile) replay() error {
+	hdr := make([]byte, journalHeaderSize)
+	if _, err := j.journal.ReadAt(hdr, 0); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if !bytes.Equal(hdr[:8], journalMagic) {
+		return nil
+	}
+	length := binary.BigEndian.Uint32(hdr[16:20])
+	rec := make([]byte, journalHeaderSize+int(length))
+	if _, err := j.journal.ReadAt(rec, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return j.discard()
+		}
+		return err
+	}
+	if journalChecksum(rec) != binary.BigEndian.Uint32(hdr[20:24]) {
+		return j.discard()
+	}
+	off := int64(binary.BigEndian.Uint64(hdr[8:16]))
+	if off < 0 {
+		return errors.New("journal entry has a negative offset")
+	}
+	return j.apply(rec[journalHeaderSize:], off)
+}
+
+func (j *JournaledFile) discard() error {
+	if _, err := j.journal.WriteAt(make([]byte, len(journalMagic)), 0); err != nil {
+		return err
+	}
+	return j.journal.Sync()
+}
+
+// journalChecksum covers the header, less the checksum itself, and the data.
+func journalChecksum(rec []byte) uint32 {
+	crc := crc32.Checksum(rec[:20], crc32c)
+	return crc32.Update(crc, crc32c, rec[journalHeaderSize:])
+}
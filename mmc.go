@@ -0,0 +1,446 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	mmcBlockSize = 2048
+	// Discs larger than an 80 minute CD are reported as DVD-ROM.
+	cdMaxBlocks = 360000
+
+	mmcProfileCDROM  = 0x0008
+	mmcProfileDVDROM = 0x0010
+)
+
+// Media event codes reported by GET EVENT STATUS NOTIFICATION.
+const (
+	mediaEventNoChange     = 0x0
+	mediaEventEjectRequest = 0x1
+	mediaEventNewMedia     = 0x2
+	mediaEventMediaRemoval = 0x3
+)
+
+// ErrMediumRemovalPrevented is returned by MMCCmdHandler.Eject while the initiator has locked the tray.
+var ErrMediumRemovalPrevented = errors.New("medium removal prevented by the initiator")
+
+// MMCCmdHandler emulates a read-only CD/DVD-ROM drive (peripheral type 0x05) with a tray that media can
+// be loaded into and ejected from, both by the initiator and through Insert and Eject.
+type MMCCmdHandler struct {
+	Inq *InquiryInfo
+
+	mu      sync.Mutex
+	media   io.ReaderAt
+	size    int64
+	prevent bool
+	// The media event not yet reported by GET EVENT STATUS NOTIFICATION.
+	event byte
+	// The device the drive is serving, once it has seen a command. Loading a disc raises a unit attention
+	// on it.
+	dev *Device
+}
+
+// NewMMCCmdHandler creates a drive holding `media`, which is `size` bytes long. `media` may be nil for an
+// empty drive.
+func NewMMCCmdHandler(media io.ReaderAt, size int64) *MMCCmdHandler {
+	return &MMCCmdHandler{
+		media: media,
+		size:  size,
+	}
+}
+
+// MMCSCSIHandler is BasicSCSIHandler for an optical drive. The size given to the kernel is that of the
+// disc in the drive when the device is created; the initiator reads the real capacity with READ CAPACITY.
+func MMCSCSIHandler(h *MMCCmdHandler) *SCSIHandler {
+	size := h.size
+	if h.media == nil || size < mmcBlockSize {
+		size = mmcBlockSize
+	}
+	return &SCSIHandler{
+		HBA:        30,
+		LUN:        0,
+		WWN:        GenerateTestWWN(),
+		VolumeName: "testcd",
+		DataSizes:  DataSizes{VolumeSize: size, BlockSize: mmcBlockSize},
+		DevReady:   MultiThreadedDevReady(h, 2),
+		mmc:        true,
+	}
+}
+
+// Insert loads `media`, which is `size` bytes long, replacing any disc already in the drive.
+func (h *MMCCmdHandler) Insert(media io.ReaderAt, size int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.media = media
+	h.size = size
+	h.event = mediaEventNewMedia
+	if h.dev != nil {
+		h.dev.RaiseUnitAttention(scsi.AscNotReadyToReadyChange)
+	}
+}
+
+// Eject removes the disc, as if the eject button had been pressed. If the initiator has prevented medium
+// removal, the disc stays in, the initiator is sent an eject request event, and ErrMediumRemovalPrevented
+// is returned.
+func (h *MMCCmdHandler) Eject() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.prevent {
+		h.event = mediaEventEjectRequest
+		return ErrMediumRemovalPrevented
+	}
+	h.eject()
+	return nil
+}
+
+func (h *MMCCmdHandler) eject() {
+	if h.media == nil {
+		return
+	}
+	h.media = nil
+	h.size = 0
+	h.event = mediaEventMediaRemoval
+}
+
+// Loaded reports whether there is a disc in the drive.
+func (h *MMCCmdHandler) Loaded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.media != nil
+}
+
+func (h *MMCCmdHandler) inquiry() *InquiryInfo {
+	inq := defaultInquiry
+	if h.Inq != nil {
+		inq = *h.Inq
+	}
+	inq.DeviceType = scsi.TypeRom
+	inq.Removable = true
+	return &inq
+}
+
+// medium returns the disc in the drive and its size in blocks, or nil.
+func (h *MMCCmdHandler) medium() (io.ReaderAt, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.media, uint64(h.size / mmcBlockSize)
+}
+
+func (h *MMCCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	h.mu.Lock()
+	h.dev = cmd.Device()
+	h.mu.Unlock()
+	switch cmd.Command() {
+	case scsi.Inquiry:
+		return EmulateInquiry(cmd, h.inquiry())
+	case scsi.GetEventStatusNotification:
+		return h.getEventStatus(cmd)
+	}
+	switch cmd.Command() {
+	case scsi.TestUnitReady:
+		if !h.Loaded() {
+			return cmd.NotReady(), nil
+		}
+		return cmd.Ok(), nil
+	case scsi.ModeSense, scsi.ModeSense10:
+		return h.modeSense(cmd)
+	case scsi.GetConfiguration:
+		return h.getConfiguration(cmd)
+	case scsi.AllowMediumRemoval:
+		h.mu.Lock()
+		h.prevent = cmd.GetCDB(4)&0x01 != 0
+		h.mu.Unlock()
+		return cmd.Ok(), nil
+	case scsi.StartStop:
+		return h.startStop(cmd)
+	case scsi.ReadCapacity:
+		return h.readCapacity(cmd)
+	case scsi.ReadToc:
+		return h.readToc(cmd)
+	case scsi.ReadDiscInformation:
+		return h.readDiscInformation(cmd)
+	case scsi.Read10, scsi.Read12:
+		return h.read(cmd)
+	default:
+		log.Debugf("Ignore unknown SCSI command 0x%x\n", cmd.Command())
+	}
+	return cmd.NotHandled(), nil
+}
+
+// mmcAllocLen returns the 16 bit allocation length in bytes 7 and 8 of the MMC commands that have one.
+func mmcAllocLen(cmd *SCSICmd) int {
+	return int(binary.BigEndian.Uint16(cmd.cdb[7:9]))
+}
+
+// startStop handles START STOP UNIT. Only loading and ejecting do anything; the drive is always spun up.
+func (h *MMCCmdHandler) startStop(cmd *SCSICmd) (SCSIResponse, error) {
+	loej := cmd.GetCDB(4)&0x02 != 0
+	start := cmd.GetCDB(4)&0x01 != 0
+	if !loej || start {
+		return cmd.Ok(), nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.prevent {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscMediumRemovalPrevented), nil
+	}
+	h.eject()
+	return cmd.Ok(), nil
+}
+
+// getEventStatus handles GET EVENT STATUS NOTIFICATION. Only polled operation and the media event class
+// are supported.
+func (h *MMCCmdHandler) getEventStatus(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0x01 == 0 {
+		return cmd.IllegalRequest(), nil
+	}
+	const mediaClass = 0x10
+	data := make([]byte, 8)
+	data[3] = mediaClass // supported event classes
+	if cmd.GetCDB(4)&mediaClass == 0 {
+		// No Event Available
+		binary.BigEndian.PutUint16(data[0:2], 2)
+		data[2] = 0x80
+		return writeTruncated(cmd, data[:4], mmcAllocLen(cmd))
+	}
+	h.mu.Lock()
+	event := h.event
+	h.event = mediaEventNoChange
+	present := h.media != nil
+	h.mu.Unlock()
+	binary.BigEndian.PutUint16(data[0:2], 6)
+	data[2] = 0x04 // notification class: media
+	data[4] = event
+	if present {
+		data[5] = 0x02 // media present
+	}
+	return writeTruncated(cmd, data, mmcAllocLen(cmd))
+}
+
+func (h *MMCCmdHandler) readCapacity(cmd *SCSICmd) (SCSIResponse, error) {
+	media, blocks := h.medium()
+	if media == nil || blocks == 0 {
+		return cmd.NotReady(), nil
+	}
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], uint32(blocks-1))
+	binary.BigEndian.PutUint32(data[4:8], mmcBlockSize)
+	cmd.Write(data)
+	return cmd.Ok(), nil
+}
+
+func (h *MMCCmdHandler) read(cmd *SCSICmd) (SCSIResponse, error) {
+	media, nblocks := h.medium()
+	if media == nil {
+		return cmd.NotReady(), nil
+	}
+	lba := cmd.LBA()
+	blocks := uint64(cmd.XferLen())
+	if lba > nblocks || blocks > nblocks-lba {
+		return cmd.LBAOutOfRange(), nil
+	}
+	length := int(blocks) * mmcBlockSize
+	if len(cmd.Buf) < length {
+		cmd.Buf = make([]byte, length)
+	}
+	n, err := media.ReadAt(cmd.Buf[:length], int64(lba)*mmcBlockSize)
+	if n == length && err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		log.Errorln("read/read failed: error:", err)
+		return cmd.BackendError(err, false), nil
+	}
+	if n < length {
+		log.Errorln("read/read failed: unable to copy enough")
+		return cmd.BackendError(io.ErrUnexpectedEOF, false), nil
+	}
+	n, err = cmd.Write(cmd.Buf[:length])
+	if n < length {
+		log.Errorln("read/write failed: unable to copy enough")
+		return cmd.TargetFailure(), nil
+	}
+	if err != nil {
+		log.Errorln("read/write failed: error:", err)
+		return cmd.TargetFailure(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// putTocAddress writes an address in a READ TOC response, either as an LBA or in
+// minutes/seconds/frames.
+func putTocAddress(b []byte, lba uint64, msf bool) {
+	if !msf {
+		binary.BigEndian.PutUint32(b, uint32(lba))
+		return
+	}
+	// MSF addresses count from the start of the lead-in, 150 frames (2 seconds) before LBA 0.
+	frames := lba + 150
+	b[0] = 0
+	b[1] = byte(frames / (75 * 60))
+	b[2] = byte(frames / 75 % 60)
+	b[3] = byte(frames % 75)
+}
+
+// readToc handles READ TOC/PMA/ATIP for a disc with a single data track in a single session.
+func (h *MMCCmdHandler) readToc(cmd *SCSICmd) (SCSIResponse, error) {
+	media, blocks := h.medium()
+	if media == nil {
+		return cmd.NotReady(), nil
+	}
+	msf := cmd.GetCDB(1)&0x02 != 0
+	format := cmd.GetCDB(2) & 0x0f
+	track := cmd.GetCDB(6)
+	const leadOut = 0xaa
+	var data []byte
+	switch format {
+	case 0x0: // TOC
+		if track > 1 && track != leadOut {
+			return cmd.IllegalRequest(), nil
+		}
+		data = []byte{0, 0, 1, 1}
+		if track <= 1 {
+			desc := []byte{0, 0x14, 1, 0, 0, 0, 0, 0} // ADR 1, data track
+			putTocAddress(desc[4:], 0, msf)
+			data = append(data, desc...)
+		}
+		desc := []byte{0, 0x14, leadOut, 0, 0, 0, 0, 0}
+		putTocAddress(desc[4:], blocks, msf)
+		data = append(data, desc...)
+	case 0x1: // Session information
+		data = []byte{0, 0, 1, 1, 0, 0x14, 1, 0, 0, 0, 0, 0}
+		putTocAddress(data[8:], 0, msf)
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	binary.BigEndian.PutUint16(data[0:2], uint16(len(data)-2))
+	return writeTruncated(cmd, data, mmcAllocLen(cmd))
+}
+
+// readDiscInformation reports a finalized disc with one complete session.
+func (h *MMCCmdHandler) readDiscInformation(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0x07 != 0 {
+		return cmd.IllegalRequest(), nil
+	}
+	if media, _ := h.medium(); media == nil {
+		return cmd.NotReady(), nil
+	}
+	data := make([]byte, 34)
+	binary.BigEndian.PutUint16(data[0:2], uint16(len(data)-2))
+	data[2] = 0x0e // last session complete, disc finalized
+	data[3] = 1    // first track on disc
+	data[4] = 1    // number of sessions
+	data[5] = 1    // first track in last session
+	data[6] = 1    // last track in last session
+	data[7] = 0x20 // unrestricted use
+	// Last session lead-in and last possible lead-out start: not applicable to a finalized disc.
+	binary.BigEndian.PutUint32(data[16:20], 0xffffffff)
+	binary.BigEndian.PutUint32(data[20:24], 0xffffffff)
+	return writeTruncated(cmd, data, mmcAllocLen(cmd))
+}
+
+// mmcFeature is one feature descriptor of a GET CONFIGURATION response.
+type mmcFeature struct {
+	code    uint16
+	version byte
+	// Persistent features are always current.
+	persistent bool
+	current    bool
+	data       []byte
+}
+
+func (f mmcFeature) bytes() []byte {
+	b := make([]byte, 4+len(f.data))
+	binary.BigEndian.PutUint16(b[0:2], f.code)
+	b[2] = f.version << 2
+	if f.persistent {
+		b[2] |= 0x02
+	}
+	if f.current || f.persistent {
+		b[2] |= 0x01
+	}
+	b[3] = byte(len(f.data))
+	copy(b[4:], f.data)
+	return b
+}
+
+// features lists the features of the drive, in order of feature code.
+func (h *MMCCmdHandler) features() (uint16, []mmcFeature) {
+	media, blocks := h.medium()
+	profile := uint16(0)
+	if media != nil {
+		profile = mmcProfileCDROM
+		if blocks > cdMaxBlocks {
+			profile = mmcProfileDVDROM
+		}
+	}
+	profiles := []byte{
+		0, mmcProfileDVDROM, 0, 0,
+		0, mmcProfileCDROM, 0, 0,
+	}
+	if profile == mmcProfileDVDROM {
+		profiles[2] = 0x01
+	} else if profile == mmcProfileCDROM {
+		profiles[6] = 0x01
+	}
+	random := make([]byte, 8)
+	binary.BigEndian.PutUint32(random[0:4], mmcBlockSize)
+	binary.BigEndian.PutUint16(random[4:6], 1) // blocking
+	return profile, []mmcFeature{
+		{code: 0x0000, persistent: true, data: profiles},                                   // Profile List
+		{code: 0x0001, version: 2, persistent: true, data: []byte{0, 0, 0, 1, 0, 0, 0, 0}}, // Core: SCSI
+		{code: 0x0002, version: 1, persistent: true, data: []byte{0x02, 0, 0, 0}},          // Morphing: OCEvent
+		{code: 0x0003, persistent: true, data: []byte{0x29, 0, 0, 0}},                      // Removable Medium: tray, eject, lock
+		{code: 0x0010, current: media != nil, data: random},                                // Random Readable
+		{code: 0x001e, current: profile == mmcProfileCDROM, data: []byte{0, 0, 0, 0}},      // CD Read
+		{code: 0x001f, current: profile == mmcProfileDVDROM},                               // DVD Read
+	}
+}
+
+// getConfiguration handles GET CONFIGURATION. The requested type selects all features, the current ones,
+// or just the starting feature.
+func (h *MMCCmdHandler) getConfiguration(cmd *SCSICmd) (SCSIResponse, error) {
+	rt := cmd.GetCDB(1) & 0x03
+	start := binary.BigEndian.Uint16(cmd.cdb[2:4])
+	profile, features := h.features()
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint16(data[6:8], profile)
+	for _, f := range features {
+		switch {
+		case rt == 0x2 && f.code != start:
+			continue
+		case f.code < start:
+			continue
+		case rt == 0x1 && !f.current && !f.persistent:
+			continue
+		}
+		data = append(data, f.bytes()...)
+	}
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)-4))
+	return writeTruncated(cmd, data, mmcAllocLen(cmd))
+}
+
+// modeSense returns the CD/DVD Capabilities and Mechanical Status page (0x2a).
+func (h *MMCCmdHandler) modeSense(cmd *SCSICmd) (SCSIResponse, error) {
+	var pgdata []byte
+	page := cmd.GetCDB(2) & 0x3f
+	if page == 0x2a || page == 0x3f {
+		pgdata = make([]byte, 22)
+		pgdata[0] = 0x2a
+		pgdata[1] = byte(len(pgdata) - 2)
+		pgdata[2] = 0x08 // DVD-ROM read
+		pgdata[6] = 0x29 // tray loading mechanism, eject, lock
+		h.mu.Lock()
+		if h.prevent {
+			pgdata[6] |= 0x02 // lock state
+		}
+		h.mu.Unlock()
+	}
+	return writeModeSense(cmd, nil, pgdata, 0)
+}
@@ -23,4 +23,8 @@ const (
 
 	offRespSCSIStatus = entReqRespOff + 0
 	offRespSense      = entReqRespOff + 8
+
+	offTmrType   = entReqRespOff + 0
+	offTmrCmdCnt = entReqRespOff + 4
+	offTmrCmdIds = entReqRespOff + 24
 )
@@ -0,0 +1,1186 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// Security protocols of SECURITY PROTOCOL IN and OUT.
+const (
+	securityProtocolInfo = 0x00
+	securityProtocolTCG  = 0x01
+)
+
+const (
+	// The ComID of Level 0 Discovery, and the one sessions run on.
+	opalDiscoveryComID = 0x0001
+	opalBaseComID      = 0x07fe
+	opalMaxComPacket   = 64 * 1024
+	// The MBR shadow table covers this much of the start of the device.
+	opalMBRSize = 128 * 1024 * 1024
+	// Get on the MBR table returns at most this much at once.
+	opalMaxGet = 32 * 1024
+	opalAdmins = 4
+)
+
+// UIDs of the Opal SPs, authorities, tables and objects emulated.
+const (
+	uidSMU         = 0x00000000000000ff
+	uidThisSP      = 0x0000000000000001
+	uidAdminSP     = 0x0000020500000001
+	uidLockingSP   = 0x0000020500000002
+	uidAnybody     = 0x0000000900000001
+	uidSID         = 0x0000000900000006
+	uidPSID        = 0x000000090001ff01
+	uidAdmin1      = 0x0000000900010001
+	uidUser1       = 0x0000000900030001
+	uidCPINSID     = 0x0000000b00000001
+	uidCPINMSID    = 0x0000000b00008402
+	uidCPINAdmin1  = 0x0000000b00010001
+	uidCPINUser1   = 0x0000000b00030001
+	uidGlobalRange = 0x0000080200000001
+	uidRange1      = 0x0000080200030001
+	uidMBRControl  = 0x0000080300000001
+	uidMBR         = 0x0000080400000000
+)
+
+// Method UIDs.
+const (
+	methodProperties   = 0x000000000000ff01
+	methodStartSession = 0x000000000000ff02
+	methodSyncSession  = 0x000000000000ff03
+	methodGet          = 0x0000000600000016
+	methodSet          = 0x0000000600000017
+	methodRevertSP     = 0x0000000600000011
+	methodRevert       = 0x0000000600000202
+	methodActivate     = 0x0000000600000203
+)
+
+// Method status codes.
+const (
+	opalSuccess          = 0x00
+	opalNotAuthorized    = 0x01
+	opalInvalidParameter = 0x0c
+	opalFail             = 0x3f
+)
+
+// Columns of the tables emulated.
+const (
+	colPIN              = 3
+	colEnabled          = 5
+	colLifeCycle        = 6
+	colRangeStart       = 3
+	colRangeLength      = 4
+	colReadLockEnabled  = 5
+	colWriteLockEnabled = 6
+	colReadLocked       = 7
+	colWriteLocked      = 8
+	colLockOnReset      = 9
+	colMBREnable        = 1
+	colMBRDone          = 2
+	colMBRDoneOnReset   = 3
+)
+
+// Life cycle states of the Locking SP.
+const (
+	lifeCycleManufacturedInactive = 0x08
+	lifeCycleManufactured         = 0x09
+)
+
+// OpalConfig describes an OpalCmdHandler.
+type OpalConfig struct {
+	// The size of the device, which must match the SCSIHandler.
+	Sizes DataSizes
+	// The sidecar file holding the Opal state. It is created if it does not
+	// exist. The MBR shadow table is kept next to it, with a ".mbr" suffix.
+	StatePath string
+	// The PSID, as printed on the label of a drive, which reverts the device
+	// to its factory state.
+	PSID string
+	// The MSID, the initial SID password that anybody can read. Defaults to
+	// "MSID".
+	MSID string
+	// The number of locking ranges besides the global range. Defaults to 8.
+	Ranges int
+}
+
+type opalAuthority struct {
+	PIN     []byte `json:"pin,omitempty"`
+	Enabled bool   `json:"enabled,omitempty"`
+}
+
+type opalRange struct {
+	Start            uint64 `json:"start"`
+	Length           uint64 `json:"length"`
+	ReadLockEnabled  bool   `json:"read_lock_enabled,omitempty"`
+	WriteLockEnabled bool   `json:"write_lock_enabled,omitempty"`
+	ReadLocked       bool   `json:"read_locked,omitempty"`
+	WriteLocked      bool   `json:"write_locked,omitempty"`
+	LockOnReset      bool   `json:"lock_on_reset,omitempty"`
+}
+
+func (r *opalRange) locked(write bool) bool {
+	if write {
+		return r.WriteLockEnabled && r.WriteLocked
+	}
+	return r.ReadLockEnabled && r.ReadLocked
+}
+
+type opalState struct {
+	SIDPIN []byte `json:"sid_pin"`
+	// The Locking SP has been activated.
+	Active bool            `json:"active"`
+	Admins []opalAuthority `json:"admins"`
+	Users  []opalAuthority `json:"users"`
+	// The global range first.
+	Ranges         []opalRange `json:"ranges"`
+	MBREnable      bool        `json:"mbr_enable,omitempty"`
+	MBRDone        bool        `json:"mbr_done,omitempty"`
+	MBRDoneOnReset bool        `json:"mbr_done_on_reset,omitempty"`
+}
+
+// opalSession is the session open on the base ComID.
+type opalSession struct {
+	tsn, hsn  uint32
+	sp        uint64
+	authority uint64
+	write     bool
+}
+
+// OpalCmdHandler is a ReadWriterAtCmdHandler that emulates a self-encrypting drive, with a subset of the
+// TCG Opal SSC: Level 0 Discovery, sessions on a single ComID, the Admin SP C_PIN table, activation of the
+// Locking SP, its authorities, locking ranges and MBR shadowing, and Revert with the SID or the PSID.
+// Nothing is actually encrypted, and a revert does not erase the data.
+//
+// Reads and writes of a locked range fail with DATA PROTECT. While MBR shadowing is enabled and not done,
+// reads of the start of the device return the MBR table, and writes to it fail. Opening the handler
+// counts as a power cycle, which locks the ranges set to lock on reset.
+type OpalCmdHandler struct {
+	ReadWriterAtCmdHandler
+
+	rw      ReadWriterAt
+	conf    OpalConfig
+	mbr     *os.File
+	mu      sync.Mutex
+	state   opalState
+	session *opalSession
+	lastTSN uint32
+	// The response to the last ComPacket, waiting for SECURITY PROTOCOL IN.
+	response []byte
+}
+
+// NewOpalCmdHandler creates a handler in the factory state, or the one saved in conf.StatePath.
+func NewOpalCmdHandler(rw ReadWriterAt, conf OpalConfig) (*OpalCmdHandler, error) {
+	if conf.MSID == "" {
+		conf.MSID = "MSID"
+	}
+	if conf.Ranges == 0 {
+		conf.Ranges = 8
+	}
+	h := &OpalCmdHandler{
+		rw:   rw,
+		conf: conf,
+	}
+	h.ReadWriterAtCmdHandler.RW = newOpalReadWriterAt(h)
+	h.state.SIDPIN = []byte(conf.MSID)
+	h.resetLockingSP()
+	data, err := ioutil.ReadFile(conf.StatePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &h.state); err != nil {
+			return nil, fmt.Errorf("Invalid Opal state in %s: %v", conf.StatePath, err)
+		}
+		if len(h.state.Admins) != opalAdmins || len(h.state.Users) != conf.Ranges+1 || len(h.state.Ranges) != conf.Ranges+1 {
+			return nil, fmt.Errorf("Opal state in %s does not match %d locking ranges", conf.StatePath, conf.Ranges)
+		}
+	}
+	h.mbr, err = os.OpenFile(conf.StatePath+".mbr", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h.powerCycle()
+	if err := h.save(); err != nil {
+		h.mbr.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// OpalSCSIHandler is BasicSCSIHandler for a self-encrypting drive.
+func OpalSCSIHandler(h *OpalCmdHandler) *SCSIHandler {
+	s := BasicSCSIHandler(h.rw)
+	s.DataSizes = h.conf.Sizes
+	s.DevReady = MultiThreadedDevReady(h, 2)
+	return s
+}
+
+// Close closes the MBR table.
+func (h *OpalCmdHandler) Close() error {
+	return h.mbr.Close()
+}
+
+// resetLockingSP puts the Locking SP in its factory state. Must be called with mu held, or before the
+// handler is shared.
+func (h *OpalCmdHandler) resetLockingSP() {
+	s := &h.state
+	s.Active = false
+	s.Admins = make([]opalAuthority, opalAdmins)
+	s.Users = make([]opalAuthority, h.conf.Ranges+1)
+	s.Ranges = make([]opalRange, h.conf.Ranges+1)
+	for i := range s.Ranges {
+		s.Ranges[i].LockOnReset = true
+	}
+	s.MBREnable = false
+	s.MBRDone = false
+	s.MBRDoneOnReset = true
+}
+
+// copyState returns a copy of the state to go back to if a change cannot be saved. Must be called with mu
+// held.
+func (h *OpalCmdHandler) copyState() opalState {
+	old := h.state
+	old.Admins = append([]opalAuthority(nil), h.state.Admins...)
+	old.Users = append([]opalAuthority(nil), h.state.Users...)
+	old.Ranges = append([]opalRange(nil), h.state.Ranges...)
+	return old
+}
+
+// powerCycle locks the ranges set to lock on reset, and ends MBR shadowing if it is done on reset.
+func (h *OpalCmdHandler) powerCycle() {
+	for i := range h.state.Ranges {
+		r := &h.state.Ranges[i]
+		if r.LockOnReset {
+			r.ReadLocked = true
+			r.WriteLocked = true
+		}
+	}
+	if h.state.MBRDoneOnReset {
+		h.state.MBRDone = false
+	}
+}
+
+// save must be called with mu held, or before the handler is shared.
+func (h *OpalCmdHandler) save() error {
+	data, err := json.Marshal(h.state)
+	if err != nil {
+		return err
+	}
+	tmp := h.conf.StatePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.conf.StatePath)
+}
+
+func (h *OpalCmdHandler) blocks() uint64 {
+	return uint64(h.conf.Sizes.VolumeSize / h.conf.Sizes.BlockSize)
+}
+
+// shadowing reports whether reads of the start of the device return the MBR table. Must be called with mu
+// held.
+func (h *OpalCmdHandler) shadowing() bool {
+	return h.state.Active && h.state.MBREnable && !h.state.MBRDone
+}
+
+// locked reports whether any block of [lba, end) is in a range locked for reading, or for writing if
+// `write` is set. Must be called with mu held.
+func (h *OpalCmdHandler) locked(lba, end uint64, write bool) bool {
+	if !h.state.Active || lba >= end {
+		return false
+	}
+	var covered [][2]uint64
+	for i := 1; i < len(h.state.Ranges); i++ {
+		r := &h.state.Ranges[i]
+		start, stop := r.Start, r.Start+r.Length
+		if start < lba {
+			start = lba
+		}
+		if stop > end {
+			stop = end
+		}
+		if start >= stop {
+			continue
+		}
+		if r.locked(write) {
+			return true
+		}
+		covered = append(covered, [2]uint64{start, stop})
+	}
+	if !h.state.Ranges[0].locked(write) {
+		return false
+	}
+	// Any block not covered by another range is in the global range.
+	sort.Slice(covered, func(i, j int) bool { return covered[i][0] < covered[j][0] })
+	pos := lba
+	for _, c := range covered {
+		if c[0] > pos {
+			return true
+		}
+		if c[1] > pos {
+			pos = c[1]
+		}
+	}
+	return pos < end
+}
+
+// extent returns the blocks a READ or WRITE command accesses. Commands without a simple extent are taken
+// to access the whole device.
+func (h *OpalCmdHandler) extent(cmd *SCSICmd) (uint64, uint64) {
+	switch cmd.Command() {
+	case scsi.FormatUnit, scsi.Unmap, scsi.WriteLong, scsi.WriteLong2:
+		return 0, h.blocks()
+	}
+	lba := cmd.LBA()
+	return lba, lba + uint64(xferBlocks(cmd))
+}
+
+// checkAccess fails a command that reads or writes a locked range, or writes to the shadowed MBR.
+func (h *OpalCmdHandler) checkAccess(cmd *SCSICmd, write bool) (SCSIResponse, bool) {
+	lba, end := h.extent(cmd)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shadowing() {
+		shadow := uint64(opalMBRSize / h.conf.Sizes.BlockSize)
+		if lba < shadow {
+			if write {
+				return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscAccessDeniedNoAccessRights), false
+			}
+			lba = shadow
+		}
+	}
+	if h.locked(lba, end, write) {
+		return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscAccessDeniedNoAccessRights), false
+	}
+	return SCSIResponse{}, true
+}
+
+func (h *OpalCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	if resp, ok := checkMediumAccess(cmd); !ok {
+		return resp, nil
+	}
+	switch cmd.Command() {
+	case scsi.SecurityProtocolIn:
+		return h.securityProtocolIn(cmd)
+	case scsi.SecurityProtocolOut:
+		return h.securityProtocolOut(cmd)
+	}
+	if isReadCommand(cmd) {
+		if resp, ok := h.checkAccess(cmd, false); !ok {
+			return resp, nil
+		}
+	}
+	if isWriteCommand(cmd) {
+		if resp, ok := h.checkAccess(cmd, true); !ok {
+			return resp, nil
+		}
+	}
+	return h.ReadWriterAtCmdHandler.HandleCommand(cmd)
+}
+
+// securityTransferLength returns the allocation or transfer length of SECURITY PROTOCOL IN or OUT.
+func securityTransferLength(cmd *SCSICmd) int {
+	n := int(binary.BigEndian.Uint32(cmd.cdb[6:10]))
+	if cmd.GetCDB(4)&0x80 != 0 { // INC_512
+		n *= 512
+	}
+	return n
+}
+
+func (h *OpalCmdHandler) securityProtocolIn(cmd *SCSICmd) (SCSIResponse, error) {
+	protocol := cmd.GetCDB(1)
+	comID := binary.BigEndian.Uint16(cmd.cdb[2:4])
+	allocLen := securityTransferLength(cmd)
+	switch {
+	case protocol == securityProtocolInfo && comID == 0:
+		// The supported security protocols.
+		data := []byte{0, 0, 0, 0, 0, 0, 0, 2, securityProtocolInfo, securityProtocolTCG}
+		return writeTruncated(cmd, data, allocLen)
+	case protocol == securityProtocolTCG && comID == opalDiscoveryComID:
+		return writeTruncated(cmd, h.discovery(), allocLen)
+	case protocol == securityProtocolTCG && comID == opalBaseComID:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		resp := h.response
+		if resp == nil {
+			resp = make([]byte, comPacketHeaderSize)
+			binary.BigEndian.PutUint16(resp[4:6], opalBaseComID)
+		} else if len(resp) > allocLen {
+			// Tell the host how much room the response needs, and keep it.
+			hdr := make([]byte, comPacketHeaderSize)
+			binary.BigEndian.PutUint16(hdr[4:6], opalBaseComID)
+			binary.BigEndian.PutUint32(hdr[8:12], uint32(len(resp)-comPacketHeaderSize))
+			binary.BigEndian.PutUint32(hdr[12:16], uint32(len(resp)))
+			return writeTruncated(cmd, hdr, allocLen)
+		}
+		h.response = nil
+		return writeTruncated(cmd, resp, allocLen)
+	}
+	return cmd.IllegalRequest(), nil
+}
+
+func (h *OpalCmdHandler) securityProtocolOut(cmd *SCSICmd) (SCSIResponse, error) {
+	protocol := cmd.GetCDB(1)
+	comID := binary.BigEndian.Uint16(cmd.cdb[2:4])
+	if protocol != securityProtocolTCG || comID != opalBaseComID {
+		return cmd.IllegalRequest(), nil
+	}
+	// Nothing larger than a ComPacket is accepted, so longer transfers are
+	// refused before allocating for them.
+	n := securityTransferLength(cmd)
+	if n < 0 || n > opalMaxComPacket {
+		return cmd.IllegalRequest(), nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cmd, buf); err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	_, tsn, hsn, payload, err := parseComPacket(buf)
+	if err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+	items, err := parseOpalItems(payload)
+	if err != nil {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.session
+	switch {
+	case tsn == 0 && hsn == 0:
+		h.response = comPacket(opalBaseComID, 0, 0, h.sessionManager(items))
+	case s == nil || s.tsn != tsn || s.hsn != hsn:
+		log.Debugf("Opal packet for unknown session %d/%d\n", tsn, hsn)
+		h.response = comPacket(opalBaseComID, tsn, hsn, nil)
+	case len(items) > 0 && items[0].control == opalEndOfSession:
+		h.session = nil
+		h.response = comPacket(opalBaseComID, tsn, hsn, []byte{opalEndOfSession})
+	default:
+		h.response = comPacket(opalBaseComID, tsn, hsn, h.call(s, items))
+	}
+	return cmd.Ok(), nil
+}
+
+// discovery builds the Level 0 Discovery response, with the TPer, Locking and Opal SSC V2 features.
+func (h *OpalCmdHandler) discovery() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	order := binary.BigEndian
+	var b bytes.Buffer
+	hdr := make([]byte, 48)
+	order.PutUint32(hdr[4:8], 0x00000001)
+	b.Write(hdr)
+
+	b.Write([]byte{0x00, 0x01, 0x10, 0x0c, 0x11, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}) // sync and streaming
+
+	locking := byte(0x01) // locking supported
+	if h.state.Active {
+		locking |= 0x02
+	}
+	if h.locked(0, h.blocks(), false) || h.locked(0, h.blocks(), true) {
+		locking |= 0x04
+	}
+	if h.state.MBREnable {
+		locking |= 0x10
+	}
+	if h.state.MBRDone {
+		locking |= 0x20
+	}
+	b.Write([]byte{0x00, 0x02, 0x10, 0x0c, locking, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	opal := make([]byte, 20)
+	order.PutUint16(opal[0:2], 0x0203)
+	opal[2] = 0x10
+	opal[3] = 0x10
+	order.PutUint16(opal[4:6], opalBaseComID)
+	order.PutUint16(opal[6:8], 1)
+	order.PutUint16(opal[9:11], opalAdmins)
+	order.PutUint16(opal[11:13], uint16(len(h.state.Users)))
+	b.Write(opal)
+
+	data := b.Bytes()
+	order.PutUint32(data[0:4], uint32(len(data)-4))
+	return data
+}
+
+// uidOf returns the UID held by a byte atom.
+func uidOf(it opalItem) (uint64, bool) {
+	if !it.isBytes || len(it.bytes) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(it.bytes), true
+}
+
+func uidBytes(uid uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uid)
+	return b
+}
+
+// parseCall splits a method call into the invoking UID, the method UID and the parameters.
+func parseCall(items []opalItem) (invoking, method uint64, params []opalItem, ok bool) {
+	if len(items) < 4 || items[0].control != opalCall || !items[3].isList() {
+		return 0, 0, nil, false
+	}
+	invoking, ok1 := uidOf(items[1])
+	method, ok2 := uidOf(items[2])
+	return invoking, method, items[3].items, ok1 && ok2
+}
+
+// methodFailed is the response to a method that failed with status `st`.
+func methodFailed(st byte) []byte {
+	var e opalEncoder
+	e.token(opalStartList)
+	e.token(opalEndList)
+	e.status(st)
+	return e.Bytes()
+}
+
+// sessionManager answers the Properties and StartSession methods of the Session Manager. Must be called
+// with mu held.
+func (h *OpalCmdHandler) sessionManager(items []opalItem) []byte {
+	invoking, method, params, ok := parseCall(items)
+	if !ok || invoking != uidSMU {
+		return methodFailed(opalInvalidParameter)
+	}
+	var e opalEncoder
+	switch method {
+	case methodProperties:
+		e.token(opalCall)
+		e.bytes(uidBytes(uidSMU))
+		e.bytes(uidBytes(methodProperties))
+		e.token(opalStartList)
+		e.token(opalStartList)
+		for _, p := range []struct {
+			name  string
+			value uint64
+		}{
+			{"MaxComPacketSize", opalMaxComPacket},
+			{"MaxResponseComPacketSize", opalMaxComPacket},
+			{"MaxPacketSize", opalMaxComPacket - comPacketHeaderSize},
+			{"MaxIndTokenSize", opalMaxComPacket - comPacketHeaderSize - packetHeaderSize - subPacketHeaderSize},
+			{"MaxPackets", 1},
+			{"MaxSubpackets", 1},
+			{"MaxMethods", 1},
+			{"MaxSessions", 1},
+			{"MaxAuthentications", 1},
+			{"MaxTransactionLimit", 1},
+		} {
+			e.token(opalStartName)
+			e.bytes([]byte(p.name))
+			e.uint(p.value)
+			e.token(opalEndName)
+		}
+		e.token(opalEndList)
+		e.token(opalEndList)
+		e.status(opalSuccess)
+		return e.Bytes()
+	case methodStartSession:
+		if len(params) < 3 {
+			return methodFailed(opalInvalidParameter)
+		}
+		sp, ok := uidOf(params[1])
+		if !ok || params[0].isBytes || params[2].isBytes {
+			return methodFailed(opalInvalidParameter)
+		}
+		authority := uint64(uidAnybody)
+		if it, ok := named(params, 3); ok {
+			if authority, ok = uidOf(it); !ok {
+				return methodFailed(opalInvalidParameter)
+			}
+		}
+		var challenge []byte
+		if it, ok := named(params, 0); ok {
+			challenge = it.bytes
+		}
+		if st := h.authenticate(sp, authority, challenge); st != opalSuccess {
+			return methodFailed(st)
+		}
+		// A new session replaces one the host never ended.
+		h.lastTSN++
+		h.session = &opalSession{
+			tsn:       h.lastTSN,
+			hsn:       uint32(params[0].uint),
+			sp:        sp,
+			authority: authority,
+			write:     params[2].uint != 0,
+		}
+		e.token(opalCall)
+		e.bytes(uidBytes(uidSMU))
+		e.bytes(uidBytes(methodSyncSession))
+		e.token(opalStartList)
+		e.uint(uint64(h.session.hsn))
+		e.uint(uint64(h.session.tsn))
+		e.token(opalEndList)
+		e.status(opalSuccess)
+		return e.Bytes()
+	}
+	return methodFailed(opalInvalidParameter)
+}
+
+// authorityIndex returns the index of an AdminN or UserN authority, or of its C_PIN object, relative to
+// that of Admin1 or User1.
+func authorityIndex(uid, first uint64, n int) (int, bool) {
+	if uid < first || uid >= first+uint64(n) {
+		return 0, false
+	}
+	return int(uid - first), true
+}
+
+// authenticate checks the challenge for signing in to `sp` as `authority`. Must be called with mu held.
+func (h *OpalCmdHandler) authenticate(sp, authority uint64, challenge []byte) byte {
+	if authority == uidAnybody {
+		if sp == uidAdminSP || sp == uidLockingSP && h.state.Active {
+			return opalSuccess
+		}
+		return opalInvalidParameter
+	}
+	var pin []byte
+	switch sp {
+	case uidAdminSP:
+		switch authority {
+		case uidSID:
+			pin = h.state.SIDPIN
+		case uidPSID:
+			pin = []byte(h.conf.PSID)
+		default:
+			return opalNotAuthorized
+		}
+	case uidLockingSP:
+		if !h.state.Active {
+			return opalInvalidParameter
+		}
+		a := h.lockingAuthority(authority)
+		if a == nil || !a.Enabled {
+			return opalNotAuthorized
+		}
+		pin = a.PIN
+	default:
+		return opalInvalidParameter
+	}
+	if len(pin) == 0 || !bytes.Equal(pin, challenge) {
+		return opalNotAuthorized
+	}
+	return opalSuccess
+}
+
+// lockingAuthority returns the AdminN or UserN authority of the Locking SP. Must be called with mu held.
+func (h *OpalCmdHandler) lockingAuthority(uid uint64) *opalAuthority {
+	if i, ok := authorityIndex(uid, uidAdmin1, len(h.state.Admins)); ok {
+		return &h.state.Admins[i]
+	}
+	if i, ok := authorityIndex(uid, uidUser1, len(h.state.Users)); ok {
+		return &h.state.Users[i]
+	}
+	return nil
+}
+
+func (s *opalSession) isAdmin() bool {
+	_, ok := authorityIndex(s.authority, uidAdmin1, opalAdmins)
+	return s.sp == uidLockingSP && ok
+}
+
+// call runs a method within session `s`, and returns the response. Must be called with mu held.
+func (h *OpalCmdHandler) call(s *opalSession, items []opalItem) []byte {
+	invoking, method, params, ok := parseCall(items)
+	if !ok {
+		return methodFailed(opalInvalidParameter)
+	}
+	log.Debugf("Opal method 0x%x on 0x%x\n", method, invoking)
+	var e opalEncoder
+	e.token(opalStartList)
+	var st byte
+	switch method {
+	case methodGet:
+		st = h.get(&e, s, invoking, params)
+	case methodSet:
+		st = h.set(s, invoking, params)
+	case methodActivate:
+		st = h.activate(s, invoking)
+	case methodRevert:
+		st = h.revert(s, invoking)
+	case methodRevertSP:
+		st = h.revertSP(s, invoking)
+	default:
+		st = opalInvalidParameter
+	}
+	if st != opalSuccess {
+		return methodFailed(st)
+	}
+	e.token(opalEndList)
+	e.status(opalSuccess)
+	if method == methodRevert || method == methodRevertSP {
+		// Reverting an SP ends the session.
+		h.session = nil
+	}
+	return e.Bytes()
+}
+
+// cellBlock returns the first and last column, or row, of a Get. `first` and `last` are the defaults.
+func cellBlock(params []opalItem, startName, endName, first, last uint64) (uint64, uint64) {
+	if len(params) == 0 || !params[0].isList() {
+		return first, last
+	}
+	if it, ok := named(params[0].items, startName); ok {
+		first = it.uint
+	}
+	if it, ok := named(params[0].items, endName); ok {
+		last = it.uint
+	}
+	return first, last
+}
+
+// columns encodes the columns of an object within [first, last].
+func columns(e *opalEncoder, values map[uint64]uint64, first, last uint64) {
+	e.token(opalStartList)
+	for col := first; col <= last && col < 0x100; col++ {
+		if v, ok := values[col]; ok {
+			e.namedUint(col, v)
+		}
+	}
+	e.token(opalEndList)
+}
+
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// lockingRange returns the locking range object `uid`. Must be called with mu held.
+func (h *OpalCmdHandler) lockingRange(uid uint64) (*opalRange, int) {
+	if uid == uidGlobalRange {
+		return &h.state.Ranges[0], 0
+	}
+	if i, ok := authorityIndex(uid, uidRange1, len(h.state.Ranges)-1); ok {
+		return &h.state.Ranges[i+1], i + 1
+	}
+	return nil, 0
+}
+
+func (h *OpalCmdHandler) get(e *opalEncoder, s *opalSession, uid uint64, params []opalItem) byte {
+	switch s.sp {
+	case uidAdminSP:
+		switch uid {
+		case uidCPINMSID:
+			first, last := cellBlock(params, 3, 4, 0, colPIN)
+			e.token(opalStartList)
+			if first <= colPIN && colPIN <= last {
+				e.token(opalStartName)
+				e.uint(colPIN)
+				e.bytes([]byte(h.conf.MSID))
+				e.token(opalEndName)
+			}
+			e.token(opalEndList)
+			return opalSuccess
+		case uidLockingSP:
+			lifeCycle := uint64(lifeCycleManufacturedInactive)
+			if h.state.Active {
+				lifeCycle = lifeCycleManufactured
+			}
+			first, last := cellBlock(params, 3, 4, 0, colLifeCycle)
+			columns(e, map[uint64]uint64{colLifeCycle: lifeCycle}, first, last)
+			return opalSuccess
+		}
+	case uidLockingSP:
+		if !s.isAdmin() {
+			return opalNotAuthorized
+		}
+		if r, _ := h.lockingRange(uid); r != nil {
+			first, last := cellBlock(params, 3, 4, 0, colLockOnReset)
+			values := map[uint64]uint64{
+				colRangeStart:       r.Start,
+				colRangeLength:      r.Length,
+				colReadLockEnabled:  boolValue(r.ReadLockEnabled),
+				colWriteLockEnabled: boolValue(r.WriteLockEnabled),
+				colReadLocked:       boolValue(r.ReadLocked),
+				colWriteLocked:      boolValue(r.WriteLocked),
+				colLockOnReset:      boolValue(r.LockOnReset),
+			}
+			columns(e, values, first, last)
+			return opalSuccess
+		}
+		if a := h.lockingAuthority(uid); a != nil {
+			first, last := cellBlock(params, 3, 4, 0, colEnabled)
+			columns(e, map[uint64]uint64{colEnabled: boolValue(a.Enabled)}, first, last)
+			return opalSuccess
+		}
+		switch uid {
+		case uidMBRControl:
+			first, last := cellBlock(params, 3, 4, 0, colMBRDoneOnReset)
+			values := map[uint64]uint64{
+				colMBREnable:      boolValue(h.state.MBREnable),
+				colMBRDone:        boolValue(h.state.MBRDone),
+				colMBRDoneOnReset: boolValue(h.state.MBRDoneOnReset),
+			}
+			columns(e, values, first, last)
+			return opalSuccess
+		case uidMBR:
+			first, last := cellBlock(params, 1, 2, 0, opalMBRSize-1)
+			if first > last || last >= opalMBRSize || last-first >= opalMaxGet {
+				return opalInvalidParameter
+			}
+			buf := make([]byte, last-first+1)
+			if _, err := h.mbr.ReadAt(buf, int64(first)); err != nil && err != io.EOF {
+				log.Errorf("reading the MBR table: %v", err)
+				return opalFail
+			}
+			e.bytes(buf)
+			return opalSuccess
+		}
+	}
+	return opalInvalidParameter
+}
+
+// setValues returns the column values of a Set on an object.
+func setValues(params []opalItem) (map[uint64]opalItem, bool) {
+	it, ok := named(params, 1)
+	if !ok || !it.isList() {
+		return nil, false
+	}
+	values := make(map[uint64]opalItem)
+	for _, v := range it.items {
+		if !v.isName() || v.items[0].isBytes {
+			return nil, false
+		}
+		values[v.items[0].uint] = v.items[1]
+	}
+	return values, true
+}
+
+func (h *OpalCmdHandler) set(s *opalSession, uid uint64, params []opalItem) byte {
+	if !s.write {
+		return opalNotAuthorized
+	}
+	if s.sp == uidLockingSP && uid == uidMBR {
+		return h.setMBR(s, params)
+	}
+	values, ok := setValues(params)
+	if !ok {
+		return opalInvalidParameter
+	}
+	old := h.copyState()
+	st := h.setColumns(s, uid, values)
+	if st == opalSuccess {
+		if err := h.save(); err != nil {
+			log.Errorf("saving the Opal state: %v", err)
+			st = opalFail
+		}
+	}
+	if st != opalSuccess {
+		h.state = old
+	}
+	return st
+}
+
+// setColumns applies a Set to the state. Must be called with mu held.
+func (h *OpalCmdHandler) setColumns(s *opalSession, uid uint64, values map[uint64]opalItem) byte {
+	switch s.sp {
+	case uidAdminSP:
+		if uid != uidCPINSID || s.authority != uidSID {
+			return opalNotAuthorized
+		}
+		for col, v := range values {
+			if col != colPIN || !v.isBytes {
+				return opalInvalidParameter
+			}
+			h.state.SIDPIN = append([]byte(nil), v.bytes...)
+		}
+		return opalSuccess
+	case uidLockingSP:
+		if i, ok := authorityIndex(uid, uidCPINAdmin1, len(h.state.Admins)); ok {
+			return h.setPIN(s, &h.state.Admins[i], s.isAdmin(), values)
+		}
+		if i, ok := authorityIndex(uid, uidCPINUser1, len(h.state.Users)); ok {
+			return h.setPIN(s, &h.state.Users[i], s.isAdmin() || s.authority == uidUser1+uint64(i), values)
+		}
+		if a := h.lockingAuthority(uid); a != nil {
+			if !s.isAdmin() {
+				return opalNotAuthorized
+			}
+			for col, v := range values {
+				if col != colEnabled || v.isBytes {
+					return opalInvalidParameter
+				}
+				a.Enabled = v.uint != 0
+			}
+			return opalSuccess
+		}
+		if r, _ := h.lockingRange(uid); r != nil {
+			return h.setRange(s, r, uid == uidGlobalRange, values)
+		}
+		if uid == uidMBRControl {
+			if !s.isAdmin() {
+				return opalNotAuthorized
+			}
+			for col, v := range values {
+				if v.isBytes {
+					return opalInvalidParameter
+				}
+				switch col {
+				case colMBREnable:
+					h.state.MBREnable = v.uint != 0
+				case colMBRDone:
+					h.state.MBRDone = v.uint != 0
+				case colMBRDoneOnReset:
+					h.state.MBRDoneOnReset = v.uint != 0
+				default:
+					return opalInvalidParameter
+				}
+			}
+			return opalSuccess
+		}
+	}
+	return opalInvalidParameter
+}
+
+func (h *OpalCmdHandler) setPIN(s *opalSession, a *opalAuthority, allowed bool, values map[uint64]opalItem) byte {
+	if !allowed {
+		return opalNotAuthorized
+	}
+	for col, v := range values {
+		if col != colPIN || !v.isBytes {
+			return opalInvalidParameter
+		}
+		a.PIN = append([]byte(nil), v.bytes...)
+	}
+	return opalSuccess
+}
+
+// setRange changes a locking range. Users may only lock and unlock it; the global range has no start or
+// length.
+func (h *OpalCmdHandler) setRange(s *opalSession, r *opalRange, global bool, values map[uint64]opalItem) byte {
+	_, user := authorityIndex(s.authority, uidUser1, len(h.state.Users))
+	if !s.isAdmin() && !user {
+		return opalNotAuthorized
+	}
+	for col, v := range values {
+		if v.isBytes {
+			return opalInvalidParameter
+		}
+		if !s.isAdmin() && col != colReadLocked && col != colWriteLocked {
+			return opalNotAuthorized
+		}
+		switch col {
+		case colRangeStart, colRangeLength:
+			if global {
+				return opalInvalidParameter
+			}
+			if col == colRangeStart {
+				r.Start = v.uint
+			} else {
+				r.Length = v.uint
+			}
+		case colReadLockEnabled:
+			r.ReadLockEnabled = v.uint != 0
+		case colWriteLockEnabled:
+			r.WriteLockEnabled = v.uint != 0
+		case colReadLocked:
+			r.ReadLocked = v.uint != 0
+		case colWriteLocked:
+			r.WriteLocked = v.uint != 0
+		case colLockOnReset:
+			// A list of reset types; only a power cycle is emulated.
+			r.LockOnReset = v.isList() && len(v.items) > 0
+		default:
+			return opalInvalidParameter
+		}
+	}
+	if r.Start+r.Length > h.blocks() || r.Start+r.Length < r.Start {
+		return opalInvalidParameter
+	}
+	return opalSuccess
+}
+
+// setMBR writes to the MBR table: Where is the offset, and Values the data.
+func (h *OpalCmdHandler) setMBR(s *opalSession, params []opalItem) byte {
+	if !s.isAdmin() {
+		return opalNotAuthorized
+	}
+	where, ok1 := named(params, 0)
+	data, ok2 := named(params, 1)
+	if !ok1 || !ok2 || where.isBytes || !data.isBytes || where.uint+uint64(len(data.bytes)) > opalMBRSize {
+		return opalInvalidParameter
+	}
+	if _, err := h.mbr.WriteAt(data.bytes, int64(where.uint)); err != nil {
+		log.Errorf("writing the MBR table: %v", err)
+		return opalFail
+	}
+	return opalSuccess
+}
+
+// activate moves the Locking SP to the manufactured state. Admin1 gets the SID password.
+func (h *OpalCmdHandler) activate(s *opalSession, uid uint64) byte {
+	if uid != uidLockingSP || s.sp != uidAdminSP || s.authority != uidSID || !s.write {
+		return opalNotAuthorized
+	}
+	if h.state.Active {
+		return opalSuccess
+	}
+	old := h.copyState()
+	h.resetLockingSP()
+	h.state.Active = true
+	h.state.Admins[0] = opalAuthority{PIN: append([]byte(nil), h.state.SIDPIN...), Enabled: true}
+	if err := h.save(); err != nil {
+		log.Errorf("saving the Opal state: %v", err)
+		h.state = old
+		return opalFail
+	}
+	return opalSuccess
+}
+
+// revert returns the whole device to its factory state, signed in as the SID or with the PSID.
+func (h *OpalCmdHandler) revert(s *opalSession, uid uint64) byte {
+	if uid != uidAdminSP || s.sp != uidAdminSP || s.authority != uidSID && s.authority != uidPSID || !s.write {
+		return opalNotAuthorized
+	}
+	old := h.copyState()
+	h.state.SIDPIN = []byte(h.conf.MSID)
+	st := h.revertLockingSP()
+	if st != opalSuccess {
+		h.state = old
+	}
+	return st
+}
+
+// revertSP returns the Locking SP to its factory state, signed in as one of its admins.
+func (h *OpalCmdHandler) revertSP(s *opalSession, uid uint64) byte {
+	if uid != uidThisSP || !s.isAdmin() || !s.write {
+		return opalNotAuthorized
+	}
+	return h.revertLockingSP()
+}
+
+// revertLockingSP resets the Locking SP and clears the MBR table. If that fails, the state is left as it
+// was, though the MBR table may already be cleared.
+func (h *OpalCmdHandler) revertLockingSP() byte {
+	old := h.copyState()
+	h.resetLockingSP()
+	if err := h.mbr.Truncate(0); err != nil {
+		log.Errorf("clearing the MBR table: %v", err)
+		h.state = old
+		return opalFail
+	}
+	if err := h.save(); err != nil {
+		log.Errorf("saving the Opal state: %v", err)
+		h.state = old
+		return opalFail
+	}
+	return opalSuccess
+}
+
+// newOpalReadWriterAt returns the ReadWriterAt of `h`, which implements PIStore and AtomicWriterAt when the
+// backing store does.
+func newOpalReadWriterAt(h *OpalCmdHandler) ReadWriterAt {
+	r := opalReadWriterAt{h}
+	_, pi := h.rw.(PIStore)
+	_, atomic := h.rw.(AtomicWriterAt)
+	switch {
+	case pi && atomic:
+		return struct {
+			opalReadWriterAt
+			opalPIStore
+			opalAtomicWriterAt
+		}{r, opalPIStore{h}, opalAtomicWriterAt{h}}
+	case pi:
+		return struct {
+			opalReadWriterAt
+			opalPIStore
+		}{r, opalPIStore{h}}
+	case atomic:
+		return struct {
+			opalReadWriterAt
+			opalAtomicWriterAt
+		}{r, opalAtomicWriterAt{h}}
+	}
+	return r
+}
+
+// opalReadWriterAt returns the MBR table in place of the start of the device while MBR shadowing is on.
+type opalReadWriterAt struct {
+	h *OpalCmdHandler
+}
+
+func (r opalReadWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	h := r.h
+	h.mu.Lock()
+	shadowing := h.shadowing()
+	h.mu.Unlock()
+	if !shadowing || off >= opalMBRSize {
+		return h.rw.ReadAt(p, off)
+	}
+	n := len(p)
+	if off+int64(n) > opalMBRSize {
+		n = int(opalMBRSize - off)
+	}
+	got, err := h.mbr.ReadAt(p[:n], off)
+	if err != nil && err != io.EOF {
+		return got, err
+	}
+	// The table reads as zeroes past what was written to it.
+	for i := got; i < n; i++ {
+		p[i] = 0
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	m, err := h.rw.ReadAt(p[n:], opalMBRSize)
+	return n + m, err
+}
+
+func (r opalReadWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return r.h.rw.WriteAt(p, off)
+}
+
+// WriteAtFlags passes FUA and DPO through to the wrapped store.
+func (r opalReadWriterAt) WriteAtFlags(p []byte, off int64, flags IOFlags) (int, error) {
+	return writeAtFlags(r.h.rw, p, off, flags)
+}
+
+// SyncRange passes flushes through to the wrapped store.
+func (r opalReadWriterAt) SyncRange(off, length int64) error {
+	switch s := r.h.rw.(type) {
+	case RangeSyncer:
+		return s.SyncRange(off, length)
+	case Syncer:
+		return s.Sync()
+	}
+	return nil
+}
+
+// opalPIStore passes protection information through to the wrapped store. The MBR table has none of its
+// own, so the blocks it shadows keep theirs.
+type opalPIStore struct {
+	h *OpalCmdHandler
+}
+
+func (r opalPIStore) ReadPIAt(p []byte, lba uint64) (int, error) {
+	return r.h.rw.(PIStore).ReadPIAt(p, lba)
+}
+
+func (r opalPIStore) WritePIAt(p []byte, lba uint64) (int, error) {
+	return r.h.rw.(PIStore).WritePIAt(p, lba)
+}
+
+// opalAtomicWriterAt passes atomic writes through to the wrapped store. Writes to the shadowed MBR never
+// get this far.
+type opalAtomicWriterAt struct {
+	h *OpalCmdHandler
+}
+
+func (r opalAtomicWriterAt) WriteAtAtomic(p []byte, off int64) (int, error) {
+	return r.h.rw.(AtomicWriterAt).WriteAtAtomic(p, off)
+}
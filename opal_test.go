@@ -0,0 +1,281 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+// encodeOpalItem encodes an item as parsed by parseOpalItems.
+func encodeOpalItem(e *opalEncoder, it opalItem) {
+	switch {
+	case it.isList() || it.isName():
+		e.token(it.control)
+		for _, sub := range it.items {
+			encodeOpalItem(e, sub)
+		}
+		if it.isList() {
+			e.token(opalEndList)
+		} else {
+			e.token(opalEndName)
+		}
+	case it.control != 0:
+		e.token(it.control)
+	case it.isBytes:
+		e.bytes(it.bytes)
+	default:
+		e.uint(it.uint)
+	}
+}
+
+func opalUint(v uint64) opalItem {
+	return opalItem{uint: v}
+}
+
+func opalBytes(b []byte) opalItem {
+	return opalItem{isBytes: true, bytes: b}
+}
+
+func TestOpalTokenRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []opalItem
+		// The length of the encoding.
+		size int
+	}{
+		{"tiny atom", []opalItem{opalUint(0x3f)}, 1},
+		{"short uint", []opalItem{opalUint(0x40)}, 2},
+		{"largest uint", []opalItem{opalUint(1<<64 - 1)}, 9},
+		{"empty bytes", []opalItem{opalBytes([]byte{})}, 1},
+		{"short bytes", []opalItem{opalBytes(bytes.Repeat([]byte{1}, 15))}, 16},
+		{"medium bytes", []opalItem{opalBytes(bytes.Repeat([]byte{2}, 16))}, 18},
+		{"largest medium bytes", []opalItem{opalBytes(bytes.Repeat([]byte{3}, 0x7ff))}, 0x801},
+		{"long bytes", []opalItem{opalBytes(bytes.Repeat([]byte{4}, 0x800))}, 0x804},
+		{"control tokens", []opalItem{{control: opalCall}, {control: opalEndOfData}}, 2},
+		{
+			"named values in nested lists",
+			[]opalItem{{control: opalStartList, items: []opalItem{
+				{control: opalStartName, items: []opalItem{opalUint(colReadLocked), opalUint(1)}},
+				{control: opalStartList, items: []opalItem{opalBytes(uidBytes(uidRange1))}},
+				{control: opalStartList},
+			}}},
+			1 + 4 + 11 + 2 + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e opalEncoder
+			for _, it := range tt.items {
+				encodeOpalItem(&e, it)
+			}
+			enc := append([]byte(nil), e.Bytes()...)
+			if len(enc) != tt.size {
+				t.Errorf("encoded in %d bytes, want %d", len(enc), tt.size)
+			}
+			items, err := parseOpalItems(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(items, tt.items) {
+				t.Fatalf("parsed %+v, want %+v", items, tt.items)
+			}
+			var again opalEncoder
+			for _, it := range items {
+				encodeOpalItem(&again, it)
+			}
+			if !bytes.Equal(again.Bytes(), enc) {
+				t.Errorf("encoded again as % x, want % x", again.Bytes(), enc)
+			}
+		})
+	}
+}
+
+func TestOpalTokenErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		{0xa4, 1, 2},                    // short bytes atom past the end
+		{0x89, 1, 2, 3, 4, 5, 6, 7},     // integer longer than 8 bytes
+		{0xd0},                          // medium atom without its length
+		{opalStartList, 1},              // unterminated list
+		{opalStartName, 1, opalEndName}, // name without a value
+		{opalEndList},
+	} {
+		if _, err := parseOpalItems(b); err != errOpalTokens {
+			t.Errorf("% x: %v", b, err)
+		}
+	}
+}
+
+// opalTest drives an OpalCmdHandler through SECURITY PROTOCOL OUT and IN.
+type opalTest struct {
+	t *testing.T
+	d *Device
+	h *OpalCmdHandler
+	// The session numbers of the open session.
+	tsn, hsn uint32
+}
+
+// send sends a payload to the base ComID in the open session, and returns the items of the response.
+func (o *opalTest) send(payload []byte) []opalItem {
+	o.t.Helper()
+	pkt := comPacket(opalBaseComID, o.tsn, o.hsn, payload)
+	cdb := make([]byte, 12)
+	cdb[0] = scsi.SecurityProtocolOut
+	cdb[1] = securityProtocolTCG
+	binary.BigEndian.PutUint16(cdb[2:4], opalBaseComID)
+	binary.BigEndian.PutUint32(cdb[6:10], uint32(len(pkt)))
+	resp, err := o.h.HandleCommand(newTestCmd(o.d, cdb, pkt, 0))
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	if k, asc := senseOf(resp); k != 0 {
+		o.t.Fatalf("SECURITY PROTOCOL OUT: sense key 0x%x asc 0x%04x", k, asc)
+	}
+	cdb[0] = scsi.SecurityProtocolIn
+	binary.BigEndian.PutUint32(cdb[6:10], 4096)
+	cmd := newTestCmd(o.d, cdb, nil, 4096)
+	if resp, err = o.h.HandleCommand(cmd); err != nil {
+		o.t.Fatal(err)
+	}
+	if k, asc := senseOf(resp); k != 0 {
+		o.t.Fatalf("SECURITY PROTOCOL IN: sense key 0x%x asc 0x%04x", k, asc)
+	}
+	_, _, _, payload, err = parseComPacket(dataIn(cmd))
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	items, err := parseOpalItems(payload)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	return items
+}
+
+// call invokes `method` on `uid`, with the parameters `params` adds, and fails the test unless it succeeds.
+func (o *opalTest) call(uid, method uint64, params func(e *opalEncoder)) []opalItem {
+	o.t.Helper()
+	var e opalEncoder
+	e.token(opalCall)
+	e.bytes(uidBytes(uid))
+	e.bytes(uidBytes(method))
+	e.token(opalStartList)
+	if params != nil {
+		params(&e)
+	}
+	e.token(opalEndList)
+	e.status(opalSuccess)
+	items := o.send(e.Bytes())
+	if len(items) == 0 || !items[len(items)-1].isList() || items[len(items)-1].items[0].uint != opalSuccess {
+		o.t.Fatalf("method 0x%x of 0x%x failed: %+v", method, uid, items)
+	}
+	return items
+}
+
+// startSession opens a read-write session with `sp` as `authority`.
+func (o *opalTest) startSession(sp, authority uint64, pin string) {
+	o.t.Helper()
+	o.tsn, o.hsn = 0, 0
+	items := o.call(uidSMU, methodStartSession, func(e *opalEncoder) {
+		e.uint(1)
+		e.bytes(uidBytes(sp))
+		e.uint(1)
+		e.token(opalStartName)
+		e.uint(0)
+		e.bytes([]byte(pin))
+		e.token(opalEndName)
+		e.token(opalStartName)
+		e.uint(3)
+		e.bytes(uidBytes(authority))
+		e.token(opalEndName)
+	})
+	o.hsn, o.tsn = uint32(items[3].items[0].uint), uint32(items[3].items[1].uint)
+}
+
+func (o *opalTest) endSession() {
+	o.send([]byte{opalEndOfSession})
+}
+
+// set sets the columns of `uid`.
+func (o *opalTest) set(uid uint64, values map[uint64]uint64) {
+	o.t.Helper()
+	o.call(uid, methodSet, func(e *opalEncoder) {
+		e.token(opalStartName)
+		e.uint(1)
+		e.token(opalStartList)
+		for col, v := range values {
+			e.namedUint(col, v)
+		}
+		e.token(opalEndList)
+		e.token(opalEndName)
+	})
+}
+
+func TestOpalLockedRangeRead(t *testing.T) {
+	const blocks = 1024
+	state := filepath.Join(t.TempDir(), "opal.json")
+	store := &memStore{make([]byte, blocks*512)}
+	d := newTestDevice(blocks*512, 512)
+	open := func() *OpalCmdHandler {
+		h, err := NewOpalCmdHandler(store, OpalConfig{Sizes: d.Sizes(), StatePath: state})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	o := &opalTest{t: t, d: d, h: open()}
+
+	// Take ownership, activate the Locking SP, and lock range 1 for reading.
+	o.startSession(uidAdminSP, uidSID, "MSID")
+	o.call(uidLockingSP, methodActivate, nil)
+	o.endSession()
+	o.startSession(uidLockingSP, uidAdmin1, "MSID")
+	o.set(uidRange1, map[uint64]uint64{
+		colRangeStart:      100,
+		colRangeLength:     50,
+		colReadLockEnabled: 1,
+		colReadLocked:      1,
+	})
+	o.endSession()
+	o.h.Close()
+
+	tests := []struct {
+		name    string
+		lba     uint32
+		blocks  uint16
+		standby bool
+		key     byte
+		asc     uint16
+	}{
+		{name: "before the range", lba: 0, blocks: 100},
+		{name: "in the range", lba: 120, blocks: 1, key: scsi.SenseDataProtect, asc: scsi.AscAccessDeniedNoAccessRights},
+		{name: "overlapping the start", lba: 99, blocks: 2, key: scsi.SenseDataProtect, asc: scsi.AscAccessDeniedNoAccessRights},
+		{name: "overlapping the end", lba: 149, blocks: 2, key: scsi.SenseDataProtect, asc: scsi.AscAccessDeniedNoAccessRights},
+		{name: "after the range", lba: 150, blocks: 10},
+		{name: "standby before the lock", lba: 120, blocks: 1, standby: true, key: scsi.SenseNotReady, asc: scsi.AscTargetPortInStandbyState},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The range stays locked across a restart.
+			h := open()
+			defer h.Close()
+			d.alua = nil
+			if tt.standby {
+				d.alua = []aluaGroup{{ALUAGroup: ALUAGroup{ID: 1, State: ALUAStandby}}}
+			}
+			cdb := make([]byte, 10)
+			cdb[0] = scsi.Read10
+			binary.BigEndian.PutUint32(cdb[2:6], tt.lba)
+			binary.BigEndian.PutUint16(cdb[7:9], tt.blocks)
+			resp, err := h.HandleCommand(newTestCmd(d, cdb, nil, int(tt.blocks)*512))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k, asc := senseOf(resp); k != tt.key || asc != tt.asc {
+				t.Errorf("sense key 0x%x asc 0x%04x, want 0x%x 0x%04x", k, asc, tt.key, tt.asc)
+			}
+		})
+	}
+}
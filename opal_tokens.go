@@ -0,0 +1,233 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Control tokens of the TCG token stream.
+const (
+	opalStartList        = 0xf0
+	opalEndList          = 0xf1
+	opalStartName        = 0xf2
+	opalEndName          = 0xf3
+	opalCall             = 0xf8
+	opalEndOfData        = 0xf9
+	opalEndOfSession     = 0xfa
+	opalStartTransaction = 0xfb
+	opalEndTransaction   = 0xfc
+	opalEmpty            = 0xff
+)
+
+// Sizes of the headers framing a method call: a ComPacket holds a Packet, which holds a SubPacket.
+const (
+	comPacketHeaderSize = 20
+	packetHeaderSize    = 24
+	subPacketHeaderSize = 12
+)
+
+var errOpalTokens = errors.New("malformed token stream")
+
+// opalItem is a value of the token stream: an atom, a list of items, a named value, or a bare control
+// token such as Call or EndOfData.
+type opalItem struct {
+	control byte
+	// An atom is either a byte sequence or an unsigned integer.
+	isBytes bool
+	bytes   []byte
+	uint    uint64
+	// The items of a list, or the name and the value of a named value.
+	items []opalItem
+}
+
+func (it opalItem) isList() bool {
+	return it.control == opalStartList
+}
+
+func (it opalItem) isName() bool {
+	return it.control == opalStartName
+}
+
+// named returns the value named `name` among `items`.
+func named(items []opalItem, name uint64) (opalItem, bool) {
+	for _, it := range items {
+		if it.isName() && !it.items[0].isBytes && it.items[0].uint == name {
+			return it.items[1], true
+		}
+	}
+	return opalItem{}, false
+}
+
+// parseOpalItems decodes a token stream into a sequence of items. Empty tokens are dropped.
+func parseOpalItems(b []byte) ([]opalItem, error) {
+	var items []opalItem
+	for len(b) > 0 {
+		it, rest, err := parseOpalItem(b)
+		if err != nil {
+			return nil, err
+		}
+		if it.control != opalEmpty {
+			items = append(items, it)
+		}
+		b = rest
+	}
+	return items, nil
+}
+
+func parseOpalItem(b []byte) (opalItem, []byte, error) {
+	t := b[0]
+	switch {
+	case t < 0x80: // tiny atom
+		return opalItem{uint: uint64(t & 0x3f)}, b[1:], nil
+	case t < 0xc0: // short atom
+		return parseOpalAtom(b[1:], t&0x20 != 0, int(t&0x0f))
+	case t < 0xe0: // medium atom
+		if len(b) < 2 {
+			return opalItem{}, nil, errOpalTokens
+		}
+		return parseOpalAtom(b[2:], t&0x10 != 0, int(t&0x07)<<8|int(b[1]))
+	case t < 0xe4: // long atom
+		if len(b) < 4 {
+			return opalItem{}, nil, errOpalTokens
+		}
+		return parseOpalAtom(b[4:], t&0x02 != 0, int(b[1])<<16|int(b[2])<<8|int(b[3]))
+	case t == opalStartList, t == opalStartName:
+		end := byte(opalEndList)
+		if t == opalStartName {
+			end = opalEndName
+		}
+		it := opalItem{control: t}
+		b = b[1:]
+		for {
+			if len(b) == 0 {
+				return opalItem{}, nil, errOpalTokens
+			}
+			if b[0] == end {
+				break
+			}
+			sub, rest, err := parseOpalItem(b)
+			if err != nil {
+				return opalItem{}, nil, err
+			}
+			if sub.control != opalEmpty {
+				it.items = append(it.items, sub)
+			}
+			b = rest
+		}
+		if t == opalStartName && len(it.items) != 2 {
+			return opalItem{}, nil, errOpalTokens
+		}
+		return it, b[1:], nil
+	case t == opalEndList, t == opalEndName:
+		return opalItem{}, nil, errOpalTokens
+	}
+	return opalItem{control: t}, b[1:], nil
+}
+
+func parseOpalAtom(b []byte, isBytes bool, n int) (opalItem, []byte, error) {
+	if len(b) < n || !isBytes && n > 8 {
+		return opalItem{}, nil, errOpalTokens
+	}
+	if isBytes {
+		return opalItem{isBytes: true, bytes: b[:n]}, b[n:], nil
+	}
+	var v uint64
+	for _, c := range b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	return opalItem{uint: v}, b[n:], nil
+}
+
+// opalEncoder builds a token stream.
+type opalEncoder struct {
+	bytes.Buffer
+}
+
+func (e *opalEncoder) token(t byte) {
+	e.WriteByte(t)
+}
+
+func (e *opalEncoder) uint(v uint64) {
+	if v < 0x40 {
+		e.WriteByte(byte(v))
+		return
+	}
+	n := 8
+	for n > 1 && v>>(8*uint(n-1)) == 0 {
+		n--
+	}
+	e.WriteByte(0x80 | byte(n))
+	for i := n - 1; i >= 0; i-- {
+		e.WriteByte(byte(v >> (8 * uint(i))))
+	}
+}
+
+func (e *opalEncoder) bytes(b []byte) {
+	switch n := len(b); {
+	case n < 0x10:
+		e.WriteByte(0xa0 | byte(n))
+	case n < 0x800:
+		e.WriteByte(0xd0 | byte(n>>8))
+		e.WriteByte(byte(n))
+	default:
+		e.WriteByte(0xe2)
+		e.WriteByte(byte(n >> 16))
+		e.WriteByte(byte(n >> 8))
+		e.WriteByte(byte(n))
+	}
+	e.Write(b)
+}
+
+// namedUint encodes a named value with an unsigned integer name.
+func (e *opalEncoder) namedUint(name, v uint64) {
+	e.token(opalStartName)
+	e.uint(name)
+	e.uint(v)
+	e.token(opalEndName)
+}
+
+// status ends a method call or response with its status list.
+func (e *opalEncoder) status(st byte) {
+	e.token(opalEndOfData)
+	e.token(opalStartList)
+	e.uint(uint64(st))
+	e.uint(0)
+	e.uint(0)
+	e.token(opalEndList)
+}
+
+// comPacket frames a payload in a ComPacket, Packet and SubPacket for `comID` and the session `tsn`/`hsn`.
+func comPacket(comID uint16, tsn, hsn uint32, payload []byte) []byte {
+	padded := (len(payload) + 3) &^ 3
+	order := binary.BigEndian
+	b := make([]byte, comPacketHeaderSize+packetHeaderSize+subPacketHeaderSize+padded)
+	order.PutUint16(b[4:6], comID)
+	order.PutUint32(b[16:20], uint32(len(b)-comPacketHeaderSize))
+	p := b[comPacketHeaderSize:]
+	order.PutUint32(p[0:4], tsn)
+	order.PutUint32(p[4:8], hsn)
+	order.PutUint32(p[20:24], uint32(subPacketHeaderSize+padded))
+	s := p[packetHeaderSize:]
+	order.PutUint32(s[8:12], uint32(len(payload)))
+	copy(s[subPacketHeaderSize:], payload)
+	return b
+}
+
+// parseComPacket returns the session numbers and the payload of the first SubPacket of a ComPacket.
+func parseComPacket(b []byte) (comID uint16, tsn, hsn uint32, payload []byte, err error) {
+	order := binary.BigEndian
+	if len(b) < comPacketHeaderSize+packetHeaderSize+subPacketHeaderSize {
+		return 0, 0, 0, nil, errOpalTokens
+	}
+	comID = order.Uint16(b[4:6])
+	p := b[comPacketHeaderSize:]
+	tsn = order.Uint32(p[0:4])
+	hsn = order.Uint32(p[4:8])
+	s := p[packetHeaderSize:]
+	n := order.Uint32(s[8:12])
+	if uint64(n) > uint64(len(s)-subPacketHeaderSize) {
+		return 0, 0, 0, nil, errOpalTokens
+	}
+	return comID, tsn, hsn, s[subPacketHeaderSize : subPacketHeaderSize+int(n)], nil
+}
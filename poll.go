@@ -33,6 +33,10 @@ func (d *Device) beginPoll() {
 			if cmd == nil {
 				break
 			}
+			if resp, ok := d.pendingUnitAttention(cmd); ok {
+				d.respChan <- resp
+				continue
+			}
 			d.cmdChan <- cmd
 		}
 	}
@@ -44,6 +48,7 @@ func (d *Device) recvResponse() {
 	var err error
 	buf := make([]byte, 4)
 	for resp := range d.respChan {
+		d.endCommand(resp.id)
 		d.completeCommand(resp)
 		/* Tell the fd there's something new */
 		n, err = unix.Write(d.uioFd, buf)
@@ -54,14 +59,50 @@ func (d *Device) recvResponse() {
 	}
 }
 
+// completeCommand hands a response back to the kernel. If the kernel takes completions out of order, the
+// response goes in the entry at the tail of the ring, whichever command that entry held. Otherwise it waits
+// until the commands ahead of it in the ring have completed, and goes in the entry of its own command.
 func (d *Device) completeCommand(resp SCSIResponse) {
+	if d.ooo {
+		off := d.skipToCmdEntry()
+		// The tail entry may hold another command, which is still being
+		// handled. With out of order completion the kernel finds the command
+		// a response completes by the cmd_id of the entry holding it, so the
+		// entry must name the command answered, not the one it was queued
+		// for.
+		d.setEntCmdId(off, resp.id)
+		d.writeResponse(off, resp)
+		return
+	}
+	d.completions[resp.id] = resp
+	// A pending response means the ring holds at least one command, so the
+	// tail is a live entry.
+	for len(d.completions) > 0 {
+		off := d.skipToCmdEntry()
+		resp, ok := d.completions[d.entCmdId(off)]
+		if !ok {
+			return
+		}
+		delete(d.completions, resp.id)
+		d.writeResponse(off, resp)
+	}
+}
+
+// skipToCmdEntry moves the tail past any entries that are not commands, and returns the offset of the entry
+// at the tail.
+func (d *Device) skipToCmdEntry() int {
 	off := d.tailEntryOff()
 	for d.entHdrOp(off) != tcmuOpCmd {
 		d.mbSetTail((d.mbCmdTail() + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize())
 		off = d.tailEntryOff()
 	}
-	if d.entCmdId(off) != resp.id {
-		d.setEntCmdId(off, resp.id)
+	return off
+}
+
+// writeResponse fills in the entry at the tail, and moves the tail past it.
+func (d *Device) writeResponse(off int, resp SCSIResponse) {
+	if resp.unknownOp {
+		d.setEntUflagUnknownOp(off)
 	}
 	d.setEntRespSCSIStatus(off, resp.status)
 	if resp.status != scsi.SamStatGood {
@@ -86,15 +127,37 @@ func (d *Device) getNextCommand() (*SCSICmd, error) {
 			}
 			out.cdb = d.entCdb(off)
 			vecs := int(d.entReqIovCnt(off))
-			out.vecs = make([][]byte, vecs)
+			out.dataOut = &iovCursor{vecs: make([][]byte, vecs)}
 			for i := 0; i < vecs; i++ {
 				v := d.entIovecN(off, i)
-				out.vecs[i] = v
+				out.dataOut.vecs[i] = v
+			}
+			// For bidirectional commands the data-in buffers follow the data-out ones.
+			out.dataIn = out.dataOut
+			bidis := int(d.entReqIovBidiCnt(off))
+			if bidis > 0 {
+				out.dataIn = &iovCursor{vecs: make([][]byte, bidis)}
+				for i := 0; i < bidis; i++ {
+					out.dataIn.vecs[i] = d.entIovecN(off, vecs+i)
+				}
+			}
+			// Protection information follows the data and bidirectional buffers.
+			difStart := vecs + bidis
+			difs := int(d.entReqIovDifCnt(off))
+			out.pi.vecs = make([][]byte, difs)
+			for i := 0; i < difs; i++ {
+				out.pi.vecs[i] = d.entIovecN(off, difStart+i)
 			}
 			d.cmdTail = (d.cmdTail + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize()
+			d.beginCommand(out)
 			return out, nil
+		} else if d.entHdrOp(off) == tcmuOpTmr {
+			d.handleTMR(off)
+			d.cmdTail = (d.cmdTail + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize()
 		} else {
-			panic(fmt.Sprintf("unsupported command from tcmu? %d", d.entHdrOp(off)))
+			// completeCommand steps over it along with PAD and TMR entries.
+			log.Errorf("skipping unsupported entry from tcmu, opcode %d", d.entHdrOp(off))
+			d.cmdTail = (d.cmdTail + uint32(d.entHdrGetLen(off))) % d.mbCmdrSize()
 		}
 	}
 	return nil, nil
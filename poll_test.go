@@ -0,0 +1,230 @@
+package tcmu
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+const (
+	testCmdrOffset = 128
+	testCmdrSize   = 4096
+	// Where the fake kernel puts the CDB every command points at.
+	testCdbOffset = testCmdrOffset + testCmdrSize
+	// The smallest entry that has room for a response.
+	testEntrySize = entReqRespOff + 8 + tcmuSenseBufferSize
+)
+
+// fakeKernel plays the kernel side of the command ring of a Device: it queues commands at the head, and
+// checks the responses the device leaves behind as it moves the tail.
+type fakeKernel struct {
+	t    *testing.T
+	d    *Device
+	ooo  bool
+	head uint32
+	tail uint32
+	next uint16
+	// The commands queued and not yet completed, by ID, and the ID of the
+	// command queued in each entry.
+	pending map[uint16]bool
+	queued  map[uint32]uint16
+}
+
+func newFakeKernel(t *testing.T, ooo bool) *fakeKernel {
+	d := &Device{
+		mmap:        make([]byte, testCdbOffset+16),
+		ooo:         ooo,
+		completions: make(map[uint16]SCSIResponse),
+		inflight:    make(map[uint16]context.CancelFunc),
+		scsi:        &SCSIHandler{},
+	}
+	binary.LittleEndian.PutUint32(d.mmap[4:], testCmdrOffset)
+	binary.LittleEndian.PutUint32(d.mmap[8:], testCmdrSize)
+	d.mmap[testCdbOffset] = scsi.TestUnitReady
+	return &fakeKernel{t: t, d: d, ooo: ooo, next: 1, pending: make(map[uint16]bool), queued: make(map[uint32]uint16)}
+}
+
+func (k *fakeKernel) setHead(h uint32) {
+	k.head = h
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&k.d.mmap[12])), h)
+}
+
+func (k *fakeKernel) putHdr(pos uint32, length uint32, op tcmuOpcode, id uint16) {
+	e := k.d.mmap[testCmdrOffset+pos:]
+	binary.LittleEndian.PutUint32(e[offLenOp:], length|uint32(op))
+	binary.LittleEndian.PutUint16(e[offCmdId:], id)
+	e[offKFlags] = 0
+	e[offUFlags] = 0
+}
+
+// queue adds a command of `length` bytes at the head, preceded by a PAD entry if it does not fit before
+// the end of the ring. It returns false if the ring is too full.
+func (k *fakeKernel) queue(length uint32) bool {
+	pad := uint32(0)
+	if k.head+length > testCmdrSize {
+		pad = testCmdrSize - k.head
+	}
+	used := (k.head - k.tail + testCmdrSize) % testCmdrSize
+	if used+pad+length >= testCmdrSize {
+		return false
+	}
+	head := k.head
+	if pad != 0 {
+		k.putHdr(head, pad, tcmuOpPad, 0)
+		head = 0
+	}
+	id := k.next
+	k.next++
+	k.pending[id] = true
+	k.queued[head] = id
+	k.putHdr(head, length, tcmuOpCmd, id)
+	e := k.d.mmap[testCmdrOffset+head:]
+	binary.LittleEndian.PutUint32(e[offReqIovCnt:], 0)
+	binary.LittleEndian.PutUint32(e[offReqIovBidiCnt:], 0)
+	binary.LittleEndian.PutUint32(e[offReqIovDifCnt:], 0)
+	binary.LittleEndian.PutUint64(e[offReqCdbOff:], testCdbOffset)
+	k.setHead((head + length) % testCmdrSize)
+	return true
+}
+
+// reap checks the entries the device has moved the tail past, and returns how many commands they held.
+func (k *fakeKernel) reap() int {
+	tail := atomic.LoadUint32((*uint32)(unsafe.Pointer(&k.d.mmap[64])))
+	n := 0
+	for k.tail != tail {
+		e := k.d.mmap[testCmdrOffset+k.tail:]
+		lenOp := binary.LittleEndian.Uint32(e[offLenOp:])
+		if tcmuOpcode(lenOp&0x7) == tcmuOpCmd {
+			id := binary.LittleEndian.Uint16(e[offCmdId:])
+			// Without out of order completion, every command is
+			// completed in its own entry.
+			if !k.ooo && id != k.queued[k.tail] {
+				k.t.Fatalf("entry of command %d completed as command %d", k.queued[k.tail], id)
+			}
+			if !k.pending[id] {
+				k.t.Fatalf("response for command %d, which is not pending", id)
+			}
+			delete(k.pending, id)
+			// The response echoes the ID of its command in the ASC and ASCQ.
+			if e[offRespSCSIStatus] != scsi.SamStatCheckCondition {
+				k.t.Fatalf("command %d: status 0x%x", id, e[offRespSCSIStatus])
+			}
+			sense := e[offRespSense:]
+			if got := binary.BigEndian.Uint16(sense[12:14]); got != id {
+				k.t.Fatalf("entry of command %d holds the response of command %d", id, got)
+			}
+			n++
+		}
+		k.tail = (k.tail + lenOp&^0x7) % testCmdrSize
+	}
+	return n
+}
+
+// testRing runs `count` commands through the ring of a Device, with several handlers completing them in
+// whatever order they finish.
+func testRing(t *testing.T, ooo bool, count int) {
+	k := newFakeKernel(t, ooo)
+	d := k.d
+	cmds := make(chan *SCSICmd, 64)
+	resps := make(chan SCSIResponse, 64)
+	stop := make(chan struct{})
+
+	// The poll loop: commands must come out in the order they were queued.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(cmds)
+		last := uint16(0)
+		for {
+			cmd, err := d.getNextCommand()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if cmd == nil {
+				select {
+				case <-stop:
+					return
+				default:
+					runtime.Gosched()
+					continue
+				}
+			}
+			if cmd.ID() != last+1 {
+				t.Errorf("command %d after command %d", cmd.ID(), last)
+			}
+			if cmd.Command() != scsi.TestUnitReady {
+				t.Errorf("command %d: CDB % x", cmd.ID(), cmd.cdb)
+			}
+			last = cmd.ID()
+			cmds <- cmd
+		}
+	}()
+	var handlers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			for cmd := range cmds {
+				for j := rand.Intn(4); j > 0; j-- {
+					runtime.Gosched()
+				}
+				resps <- cmd.CheckCondition(scsi.SenseIllegalRequest, cmd.ID())
+			}
+		}()
+	}
+	go func() {
+		handlers.Wait()
+		close(resps)
+	}()
+	// The completion loop.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for resp := range resps {
+			d.endCommand(resp.id)
+			d.completeCommand(resp)
+		}
+	}()
+
+	queued, done := 0, 0
+	for done < count && !t.Failed() {
+		for queued < count && k.queue(testEntrySize+8*uint32(rand.Intn(4))) {
+			queued++
+		}
+		done += k.reap()
+		runtime.Gosched()
+	}
+	close(stop)
+	wg.Wait()
+	if len(k.pending) != 0 {
+		t.Errorf("%d commands never completed", len(k.pending))
+	}
+	if len(d.inflight) != 0 {
+		t.Errorf("%d commands still in flight", len(d.inflight))
+	}
+}
+
+func TestRingInOrder(t *testing.T) {
+	count := 20000
+	if testing.Short() {
+		count = 2000
+	}
+	testRing(t, false, count)
+}
+
+func TestRingOutOfOrder(t *testing.T) {
+	count := 20000
+	if testing.Short() {
+		count = 2000
+	}
+	testRing(t, true, count)
+}
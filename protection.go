@@ -0,0 +1,379 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// ProtectionType is a T10 protection information format (SBC-3 4.22.2).
+type ProtectionType uint8
+
+const (
+	ProtectionNone ProtectionType = iota
+	// Type 1: the reference tag is the low 32 bits of the LBA.
+	ProtectionType1
+	// Type 2: the reference tag starts at a value given in the 32 byte CDB.
+	ProtectionType2
+	// Type 3: the reference tag is owned by the application, and not checked.
+	ProtectionType3
+)
+
+// piTupleSize is the size of the protection information following each logical block.
+const piTupleSize = 8
+
+// PIStore is implemented by backing stores that keep the protection information of each logical block.
+// p holds eight bytes (guard, application tag, reference tag; big endian) per block, starting at `lba`.
+// Without a PIStore, protection information is checked on the way in and generated on the way out.
+type PIStore interface {
+	ReadPIAt(p []byte, lba uint64) (n int, err error)
+	WritePIAt(p []byte, lba uint64) (n int, err error)
+}
+
+// ProtectionType returns the protection information format the device is currently formatted with.
+func (d *Device) ProtectionType() ProtectionType {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.protection
+}
+
+func (d *Device) setProtectionType(t ProtectionType) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.protection = t
+}
+
+// piChecks says which fields of a protection information tuple are verified.
+type piChecks struct {
+	guard, app, ref bool
+}
+
+// protectField returns the RDPROTECT or WRPROTECT field of a READ or WRITE command.
+func protectField(cmd *SCSICmd) byte {
+	return cmd.rwFlags() >> 5
+}
+
+// checksFor decodes RDPROTECT/WRPROTECT (SBC-3 tables 86 and 115). The application tag is only checked when
+// the CDB supplies the expected value, which only 32 byte CDBs do.
+func checksFor(field byte, t ProtectionType) (piChecks, bool) {
+	var c piChecks
+	switch field {
+	case 0, 1, 5:
+		c = piChecks{guard: true, app: true, ref: true}
+	case 2:
+		c = piChecks{app: true, ref: true}
+	case 3:
+	case 4:
+		c = piChecks{guard: true}
+	default:
+		return c, false
+	}
+	if t == ProtectionType3 {
+		c.ref = false
+	}
+	return c, true
+}
+
+// piExpect holds what the tuples of a command are checked against.
+type piExpect struct {
+	ref     uint32
+	app     uint16
+	appMask uint16
+	appSet  bool
+}
+
+// expectedPI returns the tags expected for the first block of a command. Only 32 byte CDBs carry expected
+// tags; otherwise the reference tag follows the LBA and application tags are not checked.
+func expectedPI(cmd *SCSICmd, t ProtectionType, lba uint64) piExpect {
+	exp := piExpect{ref: uint32(lba)}
+	if cmd.CdbLen() != 32 {
+		return exp
+	}
+	if t == ProtectionType2 {
+		exp.ref = cmd.ExpectedRefTag()
+	}
+	exp.app, exp.appMask = cmd.ExpectedAppTag()
+	exp.appSet = true
+	return exp
+}
+
+// checkProtectField validates RDPROTECT/WRPROTECT against the format of the device.
+func checkProtectField(cmd *SCSICmd, t ProtectionType) (SCSIResponse, bool) {
+	field := protectField(cmd)
+	if field == 0 {
+		return SCSIResponse{}, true
+	}
+	if t == ProtectionNone {
+		return cmd.IllegalRequest(), false
+	}
+	if t == ProtectionType2 && cmd.CdbLen() != 32 {
+		// Type 2 protection information can only be exchanged with 32 byte CDBs.
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidCommandOperationCode), false
+	}
+	if _, ok := checksFor(field, t); !ok {
+		return cmd.IllegalRequest(), false
+	}
+	return SCSIResponse{}, true
+}
+
+// generatePI fills pi with freshly computed tuples for data.
+func generatePI(pi, data []byte, blockSize int, t ProtectionType, exp piExpect) {
+	order := binary.BigEndian
+	for i := 0; i < len(pi)/piTupleSize; i++ {
+		tuple := pi[i*piTupleSize : (i+1)*piTupleSize]
+		order.PutUint16(tuple[0:2], crc16T10DIF(data[i*blockSize:(i+1)*blockSize]))
+		order.PutUint16(tuple[2:4], exp.app)
+		ref := uint32(0)
+		if t != ProtectionType3 {
+			ref = exp.ref + uint32(i)
+		}
+		order.PutUint32(tuple[4:8], ref)
+	}
+}
+
+// verifyPI checks every tuple in pi against data, returning the failing response if one does not match.
+func verifyPI(cmd *SCSICmd, pi, data []byte, lba uint64, t ProtectionType, c piChecks, exp piExpect) (SCSIResponse, bool) {
+	order := binary.BigEndian
+	blockSize := len(data) / (len(pi) / piTupleSize)
+	for i := 0; i < len(pi)/piTupleSize; i++ {
+		tuple := pi[i*piTupleSize : (i+1)*piTupleSize]
+		app := order.Uint16(tuple[2:4])
+		ref := order.Uint32(tuple[4:8])
+		// An application tag of 0xffff (and, for type 3, a reference tag of
+		// 0xffffffff) disables checking of the block.
+		if app == 0xffff && (t != ProtectionType3 || ref == 0xffffffff) {
+			continue
+		}
+		var asc uint16
+		switch {
+		case c.guard && order.Uint16(tuple[0:2]) != crc16T10DIF(data[i*blockSize:(i+1)*blockSize]):
+			asc = scsi.AscLogicalBlockGuardCheckFailed
+		case c.app && exp.appSet && app&exp.appMask != exp.app&exp.appMask:
+			asc = scsi.AscLogicalBlockAppTagCheckFailed
+		case c.ref && ref != exp.ref+uint32(i):
+			asc = scsi.AscLogicalBlockRefTagCheckFailed
+		default:
+			continue
+		}
+		return cmd.CheckConditionSense(FixedSense{
+			Key:       scsi.SenseAbortedCommand,
+			ASC:       asc,
+			Info:      uint32(lba + uint64(i)),
+			InfoValid: true,
+		}), false
+	}
+	return SCSIResponse{}, true
+}
+
+// writeProtection deals with the protection information of a WRITE whose data is in `data`. It checks
+// what the initiator sent, or generates tuples if it sent none, and hands them to the PIStore if w is one.
+// This must happen before the data is written, so that a failing check leaves the medium untouched; the
+// returned function stores the tuples once the data is down.
+func writeProtection(cmd *SCSICmd, w io.WriterAt, lba uint64, data []byte, t ProtectionType) (func() error, SCSIResponse, bool) {
+	blocks := len(data) / int(cmd.Device().Sizes().BlockSize)
+	pi := make([]byte, blocks*piTupleSize)
+	exp := expectedPI(cmd, t, lba)
+	field := protectField(cmd)
+	if field == 0 || len(cmd.PIVecs()) == 0 {
+		if field != 0 {
+			log.Debugf("WRPROTECT %d without protection information buffers, generating", field)
+		}
+		generatePI(pi, data, int(cmd.Device().Sizes().BlockSize), t, exp)
+	} else {
+		n, err := cmd.ReadPI(pi)
+		if err != nil || n < len(pi) {
+			log.Errorln("write/read pi failed: error:", err)
+			return nil, cmd.IllegalRequest(), false
+		}
+		c, _ := checksFor(field, t)
+		if resp, ok := verifyPI(cmd, pi, data, lba, t, c, exp); !ok {
+			return nil, resp, false
+		}
+	}
+	store, ok := w.(PIStore)
+	if !ok {
+		return func() error { return nil }, SCSIResponse{}, true
+	}
+	return func() error {
+		_, err := store.WritePIAt(pi, lba)
+		return err
+	}, SCSIResponse{}, true
+}
+
+// readProtection deals with the protection information of a READ whose data has been read into `data`.
+// Stored tuples are checked against the data, and tuples are passed to the initiator if RDPROTECT asks
+// for them.
+func readProtection(cmd *SCSICmd, r io.ReaderAt, lba uint64, data []byte, t ProtectionType) (SCSIResponse, bool) {
+	field := protectField(cmd)
+	store, stored := r.(PIStore)
+	if field == 0 && !stored {
+		return SCSIResponse{}, true
+	}
+	blocks := len(data) / int(cmd.Device().Sizes().BlockSize)
+	pi := make([]byte, blocks*piTupleSize)
+	exp := expectedPI(cmd, t, lba)
+	if stored {
+		n, err := store.ReadPIAt(pi, lba)
+		if n == len(pi) && err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			log.Errorln("read/read pi failed: error:", err)
+			return cmd.BackendError(err, false), false
+		}
+		if n < len(pi) {
+			return cmd.BackendError(io.ErrUnexpectedEOF, false), false
+		}
+		c, _ := checksFor(field, t)
+		if resp, ok := verifyPI(cmd, pi, data, lba, t, c, exp); !ok {
+			return resp, false
+		}
+	} else {
+		generatePI(pi, data, int(cmd.Device().Sizes().BlockSize), t, exp)
+	}
+	if field == 0 {
+		return SCSIResponse{}, true
+	}
+	if _, err := cmd.WritePI(pi); err != nil {
+		log.Errorln("read/write pi failed: error:", err)
+		return cmd.MediumError(), false
+	}
+	return SCSIResponse{}, true
+}
+
+// verifyStoredPI checks the stored protection information of the single block at `lba`, if r keeps any.
+func verifyStoredPI(cmd *SCSICmd, r io.ReaderAt, lba uint64, data []byte, t ProtectionType, exp piExpect) (SCSIResponse, bool) {
+	store, ok := r.(PIStore)
+	if !ok {
+		return SCSIResponse{}, true
+	}
+	pi := make([]byte, piTupleSize)
+	n, err := store.ReadPIAt(pi, lba)
+	if n == len(pi) && err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		log.Errorln("verify/read pi failed: error:", err)
+		return cmd.BackendError(err, false), false
+	}
+	if n < len(pi) {
+		return cmd.BackendError(io.ErrUnexpectedEOF, false), false
+	}
+	c, _ := checksFor(protectField(cmd), t)
+	return verifyPI(cmd, pi, data, lba, t, c, exp)
+}
+
+// EmulateFormatUnit accepts a FORMAT UNIT command. No data is touched, but the protection information
+// format requested with FMTPINFO and PROTECTION FIELD USAGE becomes the format of the device. If `w` is a
+// PIStore, every tuple is set to the escape values, so that no block is checked until it is written again.
+// A change of format raises a CAPACITY DATA HAS CHANGED unit attention.
+func EmulateFormatUnit(cmd *SCSICmd, w io.WriterAt) (SCSIResponse, error) {
+	fmtpinfo := cmd.GetCDB(1) >> 6
+	fmtdata := cmd.GetCDB(1)&0x10 != 0
+	pfu := byte(0)
+	if fmtdata {
+		hdr := make([]byte, 4)
+		n, err := cmd.Read(hdr)
+		if err != nil || n < len(hdr) {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+		}
+		pfu = hdr[0] & 0x07
+	}
+	var t ProtectionType
+	switch {
+	case fmtpinfo == 0 && pfu == 0:
+		t = ProtectionNone
+	case fmtpinfo == 2 && pfu == 0:
+		t = ProtectionType1
+	case fmtpinfo == 3 && pfu == 0:
+		t = ProtectionType2
+	case fmtpinfo == 3 && pfu == 1:
+		t = ProtectionType3
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	if store, ok := w.(PIStore); ok && t != ProtectionNone {
+		if err := clearPI(cmd, store); err != nil {
+			log.Errorln("format unit/write pi failed: error:", err)
+			return cmd.BackendError(err, true), nil
+		}
+	}
+	d := cmd.Device()
+	if d.ProtectionType() != t {
+		d.setProtectionType(t)
+		d.RaiseUnitAttention(scsi.AscCapacityDataHasChanged)
+	}
+	return cmd.Ok(), nil
+}
+
+// clearPI sets every protection information tuple of the device to the escape values.
+func clearPI(cmd *SCSICmd, store PIStore) error {
+	const chunk = 1024
+	blocks := uint64(cmd.Device().Sizes().VolumeSize / cmd.Device().Sizes().BlockSize)
+	pi := bytes.Repeat([]byte{0xff}, chunk*piTupleSize)
+	for lba := uint64(0); lba < blocks; lba += chunk {
+		n := blocks - lba
+		if n > chunk {
+			n = chunk
+		}
+		if _, err := store.WritePIAt(pi[:n*piTupleSize], lba); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasExtendedInquiry reports whether the Extended INQUIRY Data VPD page has anything to advertise: support
+// for protection information or for referrals.
+func hasExtendedInquiry(cmd *SCSICmd) bool {
+	return cmd.Device().ProtectionType() != ProtectionNone || cmd.Device().scsi.Referrals != nil
+}
+
+// extendedInquiryVPD builds the Extended INQUIRY Data VPD page (0x86).
+func extendedInquiryVPD(cmd *SCSICmd, inq *InquiryInfo) []byte {
+	data := make([]byte, 64)
+	data[0] = inq.peripheral()
+	data[1] = 0x86
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-4))
+	switch cmd.Device().ProtectionType() {
+	case ProtectionType1:
+		data[4] = 0x00<<3 | 0x07 // SPT: type 1; GRD_CHK, APP_CHK, REF_CHK
+	case ProtectionType2:
+		data[4] = 0x02<<3 | 0x07 // SPT: type 2
+	case ProtectionType3:
+		data[4] = 0x04<<3 | 0x06 // SPT: type 3; no REF_CHK
+	}
+	data[6] = 0x01 // V_SUP
+	if cmd.Device().scsi.Referrals != nil {
+		data[8] = 0x10 // R_SUPP
+	}
+	return data
+}
+
+var crc16T10DIFTable = func() (t [256]uint16) {
+	const poly = 0x8bb7
+	for i := range t {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return
+}()
+
+// crc16T10DIF computes the guard tag of a logical block.
+func crc16T10DIF(b []byte) uint16 {
+	var crc uint16
+	for _, x := range b {
+		crc = crc<<8 ^ crc16T10DIFTable[byte(crc>>8)^x]
+	}
+	return crc
+}
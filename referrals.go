@@ -0,0 +1,144 @@
+package tcmu
+
+import (
+	"encoding/binary"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// ReferralTargetPortGroup is a target port group through which a user data segment can be accessed.
+type ReferralTargetPortGroup struct {
+	ID uint16
+	// The asymmetric access state of the segment through the group, eg. 0x0
+	// for active/optimized or 0x1 for active/non-optimized.
+	State byte
+}
+
+// ReferralSegment is a range of LBAs owned by the same target port groups.
+type ReferralSegment struct {
+	FirstLBA uint64
+	LastLBA  uint64
+	Groups   []ReferralTargetPortGroup
+	// The segment can be accessed through this port. Reads and writes
+	// touching a segment that is not are rejected with a referral.
+	Local bool
+}
+
+// ReferralProvider supplies the referral map of a device whose LBAs are owned by different target port
+// groups, as reported by REPORT REFERRALS. The segments must be in LBA order and must not overlap.
+type ReferralProvider interface {
+	Referrals() []ReferralSegment
+}
+
+// referralDescriptor encodes a user data segment referral descriptor, as found in both the REPORT
+// REFERRALS parameter data and the referral sense data descriptor.
+func referralDescriptor(seg ReferralSegment) []byte {
+	order := binary.BigEndian
+	data := make([]byte, 20+4*len(seg.Groups))
+	data[3] = byte(len(seg.Groups))
+	order.PutUint64(data[4:12], seg.FirstLBA)
+	order.PutUint64(data[12:20], seg.LastLBA)
+	for i, g := range seg.Groups {
+		p := data[20+4*i:]
+		p[0] = g.State & 0x0f
+		order.PutUint16(p[2:4], g.ID)
+	}
+	return data
+}
+
+// referralsVPD builds the Referrals VPD page (0xb3). Segments vary in size, so neither a segment size nor
+// a multiplier is reported.
+func referralsVPD(cmd *SCSICmd, inq *InquiryInfo) []byte {
+	data := make([]byte, 16)
+	data[0] = inq.peripheral()
+	data[1] = 0xb3
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-4))
+	return data
+}
+
+// EmulateReportReferrals answers REPORT REFERRALS with the segments of the ReferralProvider of the
+// SCSIHandler, starting with the one holding the LBA in the CDB.
+func EmulateReportReferrals(cmd *SCSICmd) (SCSIResponse, error) {
+	p := cmd.Device().scsi.Referrals
+	if p == nil {
+		return cmd.NotHandled(), nil
+	}
+	lba := binary.BigEndian.Uint64(cmd.cdb[2:10])
+	oneSeg := cmd.GetCDB(14)&0x01 != 0
+	if !cmd.Device().Sizes().InRange(lba, 1) {
+		return cmd.LBAOutOfRange(), nil
+	}
+	log.Debugf("REPORT REFERRALS from LBA %d\n", lba)
+
+	data := make([]byte, 4)
+	for _, seg := range p.Referrals() {
+		if seg.LastLBA < lba {
+			continue
+		}
+		desc := referralDescriptor(seg)
+		if len(data)-4+len(desc) > 0xffff {
+			// The rest would not fit in the length field.
+			break
+		}
+		data = append(data, desc...)
+		if oneSeg {
+			break
+		}
+	}
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-4))
+	return writeTruncated(cmd, data, int(cmd.XferLen()))
+}
+
+// checkReferrals rejects a read or write of a segment this port cannot access, with a referral sense data
+// descriptor naming the segments the command touches and the groups to send it to instead.
+func checkReferrals(cmd *SCSICmd) (SCSIResponse, bool) {
+	p := cmd.Device().scsi.Referrals
+	if p == nil || !isReadCommand(cmd) && !isWriteCommand(cmd) {
+		return SCSIResponse{}, true
+	}
+	switch cmd.Command() {
+	case scsi.FormatUnit, scsi.Unmap, scsi.WriteLong, scsi.WriteLong2:
+		return SCSIResponse{}, true
+	}
+	lba := cmd.LBA()
+	last := lba
+	if n := xferBlocks(cmd); n > 0 {
+		last = lba + uint64(n) - 1
+	}
+	var touched []ReferralSegment
+	remote := false
+	for _, seg := range p.Referrals() {
+		if seg.LastLBA < lba || seg.FirstLBA > last {
+			continue
+		}
+		touched = append(touched, seg)
+		remote = remote || !seg.Local
+	}
+	if !remote {
+		return SCSIResponse{}, true
+	}
+	return referralResponse(cmd, touched), false
+}
+
+// referralResponse returns CHECK CONDITION, INSPECT REFERRALS SENSE DESCRIPTORS with a referral sense data
+// descriptor holding as many of `segs` as fit.
+func referralResponse(cmd *SCSICmd, segs []ReferralSegment) SCSIResponse {
+	buf := make([]byte, 8, tcmuSenseBufferSize)
+	buf[0] = 0x72 /* descriptor, current */
+	buf[1] = scsi.SenseAbortedCommand
+	binary.BigEndian.PutUint16(buf[2:4], scsi.AscInspectReferralsSenseDescriptors)
+	desc := []byte{0x0b, 2, 0, 0}
+	for _, seg := range segs {
+		d := referralDescriptor(seg)
+		if len(buf)+len(desc)+len(d) > tcmuSenseBufferSize {
+			desc[2] |= 0x01 // NOT_ALL_R
+			break
+		}
+		desc = append(desc, d...)
+	}
+	desc[1] = byte(len(desc) - 2)
+	buf[7] = byte(len(desc))
+	buf = append(buf, desc...)
+	return cmd.RespondSenseData(scsi.SamStatCheckCondition, buf)
+}
@@ -15,6 +15,7 @@ package scsi
 const (
 	TestUnitReady              = 0x00
 	RezeroUnit                 = 0x01
+	Rewind                     = 0x01
 	RequestSense               = 0x03
 	FormatUnit                 = 0x04
 	ReadBlockLimits            = 0x05
@@ -35,6 +36,7 @@ const (
 	Erase                      = 0x19
 	ModeSense                  = 0x1a
 	StartStop                  = 0x1b
+	LoadUnload                 = 0x1b
 	ReceiveDiagnostic          = 0x1c
 	SendDiagnostic             = 0x1d
 	AllowMediumRemoval         = 0x1e
@@ -69,9 +71,11 @@ const (
 	Unmap                      = 0x42
 	ReadToc                    = 0x43
 	ReadHeader                 = 0x44
+	GetConfiguration           = 0x46
 	GetEventStatusNotification = 0x4a
 	LogSelect                  = 0x4c
 	LogSense                   = 0x4d
+	ReadDiscInformation        = 0x51
 	Xdwriteread10              = 0x53
 	ModeSelect10               = 0x55
 	Reserve10                  = 0x56
@@ -81,6 +85,7 @@ const (
 	PersistentReserveOut       = 0x5f
 	VariableLengthCmd          = 0x7f
 	ReportLuns                 = 0xa0
+	AtaPassThrough12           = 0xa1
 	SecurityProtocolIn         = 0xa2
 	MaintenanceIn              = 0xa3
 	MaintenanceOut             = 0xa4
@@ -99,9 +104,11 @@ const (
 	SecurityProtocolOut        = 0xb5
 	ReadElementStatus          = 0xb8
 	SendVolumeTag              = 0xb6
+	ReadDefectData12           = 0xb7
 	WriteLong2                 = 0xea
 	ExtendedCopy               = 0x83
 	ReceiveCopyResults         = 0x84
+	AtaPassThrough16           = 0x85
 	AccessControlIn            = 0x86
 	AccessControlOut           = 0x87
 	Read16                     = 0x88
@@ -113,6 +120,9 @@ const (
 	Verify16                   = 0x8f
 	SynchronizeCache16         = 0x91
 	WriteSame16                = 0x93
+	WriteAtomic16              = 0x9c
+	ZbcOut                     = 0x94
+	ZbcIn                      = 0x95
 	ServiceActionBidirectional = 0x9d
 	ServiceActionIn16          = 0x9e
 	ServiceActionOut16         = 0x9f
@@ -123,6 +133,13 @@ const (
 	/* values for VariableLengthCmd service action codes
 	 * see spc4r17 Section D.3.5, table D.7 and D.8 */
 	VlcSaReceiveCredential = 0x1800
+	/* values for ZbcIn service action */
+	ZiReportZones = 0x00
+	/* values for ZbcOut service action */
+	ZoCloseZone         = 0x01
+	ZoFinishZone        = 0x02
+	ZoOpenZone          = 0x03
+	ZoResetWritePointer = 0x04
 	/* values for maintenance in */
 	MiReportIdentifyingInformation           = 0x05
 	MiReportTargetPgs                        = 0x0a
@@ -156,6 +173,26 @@ const (
 	ReadCapacity16 = 0x10
 )
 
+/*
+ * Peripheral device types, as reported in byte 0 of INQUIRY data.
+ */
+const (
+	TypeDisk          = 0x00
+	TypeTape          = 0x01
+	TypeProcessor     = 0x03
+	TypeWorm          = 0x04
+	TypeRom           = 0x05
+	TypeScanner       = 0x06
+	TypeMod           = 0x07
+	TypeMediumChanger = 0x08
+	TypeRaid          = 0x0c
+	TypeEnclosure     = 0x0d
+	TypeRbc           = 0x0e
+	TypeOsd           = 0x11
+	TypeZbc           = 0x14
+	TypeNoLun         = 0x7f
+)
+
 /*
  *  SCSI Architecture Model (Sam) Status codes. Taken from Sam-3 draft
  *  T10/1561-D Revision 4 Draft dated 7th November 2002.
@@ -178,12 +215,52 @@ const (
  * Sense codes
  */
 const (
-	AscReadError                       = 0x1100
-	AscParameterListLengthError        = 0x1a00
-	AscInternalTargetFailure           = 0x4400
-	AscMiscompareDuringVerifyOperation = 0x1d00
-	AscInvalidFieldInCdb               = 0x2400
-	AscInvalidFieldInParameterList     = 0x2600
+	AscNoAdditionalSense                 = 0x0000
+	AscFilemarkDetected                  = 0x0001
+	AscEndOfMediumDetected               = 0x0002
+	AscBeginningOfMediumDetected         = 0x0004
+	AscEndOfDataDetected                 = 0x0005
+	AscAtaInformationAvailable           = 0x001d
+	AscAsymmetricAccessStateTransition   = 0x040a
+	AscTargetPortInStandbyState          = 0x040b
+	AscTargetPortInUnavailableState      = 0x040c
+	AscLogicalUnitNotReadyOffline        = 0x0412
+	AscWriteError                        = 0x0c00
+	AscLogicalBlockGuardCheckFailed      = 0x1001
+	AscLogicalBlockAppTagCheckFailed     = 0x1002
+	AscLogicalBlockRefTagCheckFailed     = 0x1003
+	AscReadError                         = 0x1100
+	AscParameterListLengthError          = 0x1a00
+	AscInternalTargetFailure             = 0x4400
+	AscMiscompareDuringVerifyOperation   = 0x1d00
+	AscInvalidCommandOperationCode       = 0x2000
+	AscAccessDeniedNoAccessRights        = 0x2002
+	AscLbaOutOfRange                     = 0x2100
+	AscInvalidElementAddress             = 0x2101
+	AscUnalignedWriteCommand             = 0x2104
+	AscWriteBoundaryViolation            = 0x2105
+	AscInvalidFieldInCdb                 = 0x2400
+	AscInvalidFieldInParameterList       = 0x2600
+	AscWriteProtected                    = 0x2700
+	AscSpaceAllocationFailedWriteProtect = 0x2707
+	AscZoneIsReadOnly                    = 0x2708
+	AscNotReadyToReadyChange             = 0x2800
+	AscNoDefectSpareLocationAvailable    = 0x3200
+	AscBusDeviceResetFunctionOccurred    = 0x2903
+	AscModeParametersChanged             = 0x2a01
+	AscAsymmetricAccessStateChanged      = 0x2a06
+	AscCapacityDataHasChanged            = 0x2a09
+	AscZoneIsOffline                     = 0x2c0e
+	AscCommandTimeoutDuringProcessing    = 0x2e02
+	AscMediumNotPresent                  = 0x3a00
+	AscMediumDestinationElementFull      = 0x3b0d
+	AscMediumSourceElementEmpty          = 0x3b0e
+	AscLogicalUnitFailedSelfTest         = 0x3e03
+	AscMicrocodeHasBeenChanged           = 0x3f01
+	AscInspectReferralsSenseDescriptors  = 0x3f15
+	AscMediumRemovalPrevented            = 0x5302
+	AscAuxiliaryMemoryOutOfSpace         = 0x5506
+	AscInsufficientZoneResources         = 0x550e
 )
 
 /*
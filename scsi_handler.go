@@ -1,6 +1,7 @@
 package tcmu
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
@@ -8,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"syscall"
 
 	"github.com/alternative-storage/go-tcmu/scsi"
 	"github.com/prometheus/common/log"
@@ -15,12 +17,16 @@ import (
 
 // SCSICmd represents a single SCSI command recieved from the kernel to the virtual target.
 type SCSICmd struct {
-	id        uint16
-	cdb       []byte
-	vecs      [][]byte
-	offset    int
-	vecoffset int
-	device    *Device
+	id  uint16
+	cdb []byte
+	// dataOut holds the data sent by the initiator, and dataIn the data
+	// returned to it. Except for bidirectional commands, the kernel provides
+	// a single set of buffers, and both point to the same cursor.
+	dataOut *iovCursor
+	dataIn  *iovCursor
+	pi      iovCursor
+	device  *Device
+	ctx     context.Context
 
 	// Buf, if provided, may be used as a scratch buffer for copying data to and from the kernel.
 	Buf []byte
@@ -57,17 +63,16 @@ func (c *SCSICmd) LBA() uint64 {
 
 	switch c.CdbLen() {
 	case 6:
-		val6 := uint8(order.Uint16(c.cdb[2:4]))
-		if val6 == 0 {
-			return 256
-		}
-		return uint64(val6)
+		// 21 bits, in the low bits of bytes 1-3.
+		return uint64(order.Uint32(c.cdb[0:4]) & 0x1fffff)
 	case 10:
 		return uint64(order.Uint32(c.cdb[2:6]))
 	case 12:
 		return uint64(order.Uint32(c.cdb[2:6]))
 	case 16:
 		return uint64(order.Uint64(c.cdb[2:10]))
+	case 32:
+		return uint64(order.Uint64(c.cdb[12:20]))
 	default:
 		log.Errorf("What LBA has this length: %d", c.CdbLen())
 		panic("unusal scsi command length")
@@ -85,16 +90,135 @@ func (c *SCSICmd) XferLen() uint32 {
 	case 12:
 		return uint32(order.Uint32(c.cdb[6:10]))
 	case 16:
+		if c.Command() == scsi.WriteAtomic16 {
+			return uint32(order.Uint16(c.cdb[12:14]))
+		}
 		return uint32(order.Uint32(c.cdb[10:14]))
+	case 32:
+		return uint32(order.Uint32(c.cdb[28:32]))
 	default:
 		log.Errorf("What XferLen has this length: %d", c.CdbLen())
 		panic("unusal scsi command length")
 	}
 }
 
+// ServiceAction returns the service action of a 32 byte variable length CDB, eg. scsi.Read32.
+func (c *SCSICmd) ServiceAction() uint16 {
+	if c.CdbLen() != 32 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(c.cdb[8:10])
+}
+
+// ExpectedRefTag returns the EXPECTED INITIAL LOGICAL BLOCK REFERENCE TAG of a 32 byte CDB, the reference
+// tag of the first block with type 2 protection.
+func (c *SCSICmd) ExpectedRefTag() uint32 {
+	if c.CdbLen() != 32 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(c.cdb[20:24])
+}
+
+// ExpectedAppTag returns the EXPECTED LOGICAL BLOCK APPLICATION TAG of a 32 byte CDB, and the mask of
+// the bits to be checked.
+func (c *SCSICmd) ExpectedAppTag() (tag uint16, mask uint16) {
+	if c.CdbLen() != 32 {
+		return 0, 0
+	}
+	order := binary.BigEndian
+	return order.Uint16(c.cdb[24:26]), order.Uint16(c.cdb[26:28])
+}
+
+// rwFlags returns the byte of a READ or WRITE style CDB holding the RDPROTECT/WRPROTECT, DPO and FUA
+// fields. The six byte commands have none of them.
+func (c *SCSICmd) rwFlags() byte {
+	switch c.CdbLen() {
+	case 6:
+		return 0
+	case 32:
+		return c.cdb[10]
+	}
+	return c.cdb[1]
+}
+
+// FUA reports whether the Force Unit Access bit is set. The six byte READ and WRITE commands do not
+// carry it.
+func (c *SCSICmd) FUA() bool {
+	return c.rwFlags()&0x08 != 0
+}
+
+// DPO reports whether the Disable Page Out bit is set. The six byte READ and WRITE commands do not
+// carry it.
+func (c *SCSICmd) DPO() bool {
+	return c.rwFlags()&0x10 != 0
+}
+
+// IOFlags collects the FUA and DPO bits of the command.
+func (c *SCSICmd) IOFlags() IOFlags {
+	var f IOFlags
+	if c.FUA() {
+		f |= FlagFUA
+	}
+	if c.DPO() {
+		f |= FlagDPO
+	}
+	return f
+}
+
 // Write, for a SCSICmd, is a io.Writer to the data buffer attached to this SCSI command.
 // It's writing *to* the buffer, which happens most commonly when responding to Read commands (take data and write it back to the kernel buffer)
+// For bidirectional commands, this is the data-in buffer.
 func (c *SCSICmd) Write(b []byte) (n int, err error) {
+	return c.dataIn.Write(b)
+}
+
+// Read, for a SCSICmd, is a io.Reader from the data buffer attached to this SCSI command.
+// If there's data to be written to the virtual device, this is the way to access it.
+// For bidirectional commands, this is the data-out buffer.
+func (c *SCSICmd) Read(b []byte) (n int, err error) {
+	return c.dataOut.Read(b)
+}
+
+// Bidirectional reports whether the command has separate data-out and data-in buffers, as XDWRITEREAD does.
+func (c *SCSICmd) Bidirectional() bool {
+	return c.dataIn != c.dataOut
+}
+
+// DataOutVecs returns the buffers holding the data sent by the initiator. Read consumes them.
+func (c *SCSICmd) DataOutVecs() [][]byte {
+	return c.dataOut.vecs
+}
+
+// DataInVecs returns the buffers for the data returned to the initiator. Write fills them. Unless the
+// command is bidirectional, these are the same buffers as DataOutVecs.
+func (c *SCSICmd) DataInVecs() [][]byte {
+	return c.dataIn.vecs
+}
+
+// PIVecs returns the buffers holding the T10 protection information of this command, eight bytes per
+// logical block. It is empty unless the kernel passed protection information separately from the data.
+func (c *SCSICmd) PIVecs() [][]byte {
+	return c.pi.vecs
+}
+
+// ReadPI reads protection information sent by the initiator, eg. with a WRITE command.
+func (c *SCSICmd) ReadPI(b []byte) (n int, err error) {
+	return c.pi.Read(b)
+}
+
+// WritePI writes protection information to be returned to the initiator, eg. for a READ command.
+func (c *SCSICmd) WritePI(b []byte) (n int, err error) {
+	return c.pi.Write(b)
+}
+
+// iovCursor is a read/write position within a set of buffers.
+type iovCursor struct {
+	vecs      [][]byte
+	offset    int
+	vecoffset int
+}
+
+func (c *iovCursor) Write(b []byte) (n int, err error) {
 	toWrite := len(b)
 	boff := 0
 	for toWrite != 0 {
@@ -113,9 +237,7 @@ func (c *SCSICmd) Write(b []byte) (n int, err error) {
 	return boff, nil
 }
 
-// Read, for a SCSICmd, is a io.Reader from the data buffer attached to this SCSI command.
-// If there's data to be written to the virtual device, this is the way to access it.
-func (c *SCSICmd) Read(b []byte) (n int, err error) {
+func (c *iovCursor) Read(b []byte) (n int, err error) {
 	toRead := len(b)
 	boff := 0
 	for toRead != 0 {
@@ -134,6 +256,29 @@ func (c *SCSICmd) Read(b []byte) (n int, err error) {
 	return boff, nil
 }
 
+// ID returns the identifier the kernel gave the command, as listed in TaskManagement.
+func (c *SCSICmd) ID() uint16 {
+	return c.id
+}
+
+// Context returns a context that is cancelled if the command is aborted by a task management function.
+// The built in handlers check it between calls to the backing store, and give up with ABORTED COMMAND.
+func (c *SCSICmd) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// aborted returns the response to a command that a task management function aborted while it was being
+// handled, or false if it has not been. `write` is as for BackendError.
+func (c *SCSICmd) aborted(write bool) (SCSIResponse, bool) {
+	if err := c.Context().Err(); err != nil {
+		return c.BackendError(err, write), true
+	}
+	return SCSIResponse{}, false
+}
+
 // Device accesses the details of the SCSI device this command is handling.
 func (c *SCSICmd) Device() *Device {
 	return c.device
@@ -185,19 +330,75 @@ func (c *SCSICmd) NotHandled() SCSIResponse {
 	}
 }
 
+// Passthrough creates a response that hands the command back to the kernel with the UNKNOWN_OP flag, so
+// that the target core answers it in place of the device. What the kernel then does depends on its version:
+// it may emulate the command, or fail it with CHECK CONDITION. Commands the kernel always emulates, such as
+// REPORT LUNS, never reach the device.
+func (c *SCSICmd) Passthrough() SCSIResponse {
+	return SCSIResponse{
+		id:        c.id,
+		unknownOp: true,
+	}
+}
+
 // CheckCondition returns a response providing extra sense data. Takes a Sense Key and an Additional Sense Code.
 func (c *SCSICmd) CheckCondition(key byte, asc uint16) SCSIResponse {
-	buf := make([]byte, tcmuSenseBufferSize)
-	buf[0] = 0x70 /* fixed, current */
-	buf[2] = key
-	buf[7] = 0xa
-	buf[12] = byte(uint8((asc >> 8) & 0xff))
-	buf[13] = byte(uint8(asc & 0xff))
+	return c.CheckConditionSense(FixedSense{Key: key, ASC: asc})
+}
+
+// CheckConditionSense returns a response carrying the given sense data, for conditions that need more
+// than a Sense Key and an Additional Sense Code.
+func (c *SCSICmd) CheckConditionSense(s FixedSense) SCSIResponse {
 	return SCSIResponse{
 		id:          c.id,
 		status:      scsi.SamStatCheckCondition,
-		senseBuffer: buf,
+		senseBuffer: s.Bytes(),
+	}
+}
+
+// FixedSense describes fixed format sense data for the current command.
+type FixedSense struct {
+	Key byte
+	ASC uint16
+	// If InfoValid is set, Info is reported in the INFORMATION field, eg. the
+	// LBA of a failing block.
+	Info      uint32
+	InfoValid bool
+	// The stream command bits, used by tape devices: a filemark was read,
+	// the end (or beginning) of the medium was reached, or the length of a
+	// block did not match the length requested.
+	Filemark bool
+	EOM      bool
+	ILI      bool
+}
+
+// Bytes encodes the sense data.
+func (s FixedSense) Bytes() []byte {
+	buf := make([]byte, tcmuSenseBufferSize)
+	buf[0] = 0x70 /* fixed, current */
+	if s.InfoValid {
+		buf[0] |= 0x80
+		binary.BigEndian.PutUint32(buf[3:7], s.Info)
+	}
+	buf[2] = s.Key
+	if s.Filemark {
+		buf[2] |= 0x80
 	}
+	if s.EOM {
+		buf[2] |= 0x40
+	}
+	if s.ILI {
+		buf[2] |= 0x20
+	}
+	buf[7] = 0xa
+	buf[12] = byte(uint8((s.ASC >> 8) & 0xff))
+	buf[13] = byte(uint8(s.ASC & 0xff))
+	return buf
+}
+
+// NotReady is a preset response for a command that needs a medium, sent to a drive without one.
+func (c *SCSICmd) NotReady() SCSIResponse {
+	return c.CheckCondition(scsi.SenseNotReady, scsi.AscMediumNotPresent)
 }
 
 // MediumError is a preset response for a read error condition from the device
@@ -205,6 +406,25 @@ func (c *SCSICmd) MediumError() SCSIResponse {
 	return c.CheckCondition(scsi.SenseMediumError, scsi.AscReadError)
 }
 
+// LBAOutOfRange is a preset response for a command addressing blocks beyond the end of the device.
+func (c *SCSICmd) LBAOutOfRange() SCSIResponse {
+	return c.CheckCondition(scsi.SenseIllegalRequest, scsi.AscLbaOutOfRange)
+}
+
+// BackendError creates a response for an error returned by the backing store while reading (or, if `write`
+// is set, writing) data. The error is mapped through the TranslateError function of the device's SCSIHandler.
+func (c *SCSICmd) BackendError(err error, write bool) SCSIResponse {
+	if c.device != nil && c.device.scsi.TranslateError != nil {
+		return c.device.scsi.TranslateError(c, err, write)
+	}
+	return DefaultTranslateError(c, err, write)
+}
+
+// DataProtect is a preset response for a command that would modify a write protected device.
+func (c *SCSICmd) DataProtect() SCSIResponse {
+	return c.CheckCondition(scsi.SenseDataProtect, scsi.AscWriteProtected)
+}
+
 // IllegalRequest is a preset response for a request that is malformed or unexpected.
 func (c *SCSICmd) IllegalRequest() SCSIResponse {
 	return c.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInCdb)
@@ -220,6 +440,8 @@ type SCSIResponse struct {
 	id          uint16
 	status      byte
 	senseBuffer []byte
+	// Hand the command back to the kernel unanswered.
+	unknownOp bool
 }
 
 // SCSIHandler is the high-level data for the emulated SCSI device.
@@ -228,6 +450,13 @@ type SCSIHandler struct {
 	VolumeName string
 	// The size of the device and the blocksize for the device.
 	DataSizes DataSizes
+	// The physical block size is BlockSize << PhysicalBlockExponent. For a
+	// 512e drive (4K physical, 512 byte logical blocks) this is 3. If the
+	// backing store cannot handle I/O smaller than a physical block, wrap it
+	// with NewAlignedReadWriterAt.
+	PhysicalBlockExponent uint8
+	// The first LBA that is aligned to a physical block boundary.
+	LowestAlignedLBA uint16
 	// The loopback HBA for the emulated SCSI device
 	HBA int
 	// The LUN for the emulated HBA
@@ -238,15 +467,104 @@ type SCSIHandler struct {
 	// to handle commands coming in the first channel, and send their associated
 	// responses down the second channel, ordering optional.
 	DevReady DevReadyFunc
+	// Maps errors returned by the backing store to the response seen by the
+	// initiator. If nil, DefaultTranslateError is used.
+	TranslateError TranslateErrorFunc
+	// Start the device write protected. This can be changed at runtime with
+	// Device.SetWriteProtected.
+	WriteProtect bool
+	// The T10 protection information format of the device. This can be
+	// changed by the initiator with FORMAT UNIT.
+	ProtectionType ProtectionType
+	// The limits advertised for WRITE ATOMIC (16). The zero value disables
+	// atomic writes. The backing store must implement AtomicWriterAt.
+	AtomicLimits AtomicLimits
+	// Supplies the SMART attributes reported through ATA PASS-THROUGH. If
+	// nil, only the power on hours and power cycle count are reported.
+	Health HealthProvider
+	// Installs microcode downloaded with WRITE BUFFER. If nil, microcode
+	// downloads are refused.
+	Firmware FirmwareFunc
+	// The length of the microcode images downloaded in segments with WRITE
+	// BUFFER, which are complete once that much has arrived. If zero, an
+	// image is complete once a segment shorter than the first arrives, so
+	// an image that is a multiple of the segment length must be followed by
+	// an empty segment.
+	FirmwareSize int
+	// Supplies the referral map of a device whose LBAs are owned by
+	// different target port groups. If nil, referrals are not supported.
+	Referrals ReferralProvider
+	// The target port groups of a device with asymmetric logical unit
+	// access. The LUN of the loopback port joins the first group. If empty,
+	// ALUA is not supported.
+	ALUAGroups []ALUAGroup
+	// Told about task management functions, such as ABORT TASK and LUN
+	// RESET. May be nil.
+	TaskManagement TaskManagementFunc
+
+	// Set by MMCSCSIHandler, for the unit attention rules of MMC devices.
+	mmc bool
 }
 
 type DevReadyFunc func(chan *SCSICmd, chan SCSIResponse) error
 
+// TranslateErrorFunc turns an error from the backing store into a SCSIResponse. `write` is set if the error
+// happened while writing to the backing store.
+type TranslateErrorFunc func(cmd *SCSICmd, err error, write bool) SCSIResponse
+
+// DefaultTranslateError maps common backing store errors to their SCSI equivalents:
+//
+//	ENOSPC             DATA PROTECT / SPACE ALLOCATION FAILED WRITE PROTECT
+//	EROFS              DATA PROTECT / WRITE PROTECTED
+//	context deadline   ABORTED COMMAND / COMMAND TIMEOUT DURING PROCESSING
+//	context canceled   ABORTED COMMAND
+//	anything else      MEDIUM ERROR / WRITE ERROR or UNRECOVERED READ ERROR
+func DefaultTranslateError(cmd *SCSICmd, err error, write bool) SCSIResponse {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscSpaceAllocationFailedWriteProtect)
+	case errors.Is(err, syscall.EROFS):
+		return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscWriteProtected)
+	case errors.Is(err, context.DeadlineExceeded):
+		return cmd.CheckCondition(scsi.SenseAbortedCommand, scsi.AscCommandTimeoutDuringProcessing)
+	case errors.Is(err, context.Canceled):
+		return cmd.CheckCondition(scsi.SenseAbortedCommand, scsi.AscNoAdditionalSense)
+	}
+	if write {
+		return cmd.CheckCondition(scsi.SenseMediumError, scsi.AscWriteError)
+	}
+	return cmd.MediumError()
+}
+
 type DataSizes struct {
 	VolumeSize int64
 	BlockSize  int64
 }
 
+// AtomicLimits describes the atomic writes a device supports, as reported in
+// the Block Limits VPD page. All values are in logical blocks.
+type AtomicLimits struct {
+	// The largest atomic write without an atomic boundary. Zero disables
+	// WRITE ATOMIC.
+	MaxLength uint32
+	// Atomic writes must start at an LBA that is a multiple of Alignment. Zero
+	// means any LBA.
+	Alignment uint32
+	// The length of an atomic write must be a multiple of Granularity. Zero
+	// means any length.
+	Granularity uint32
+	// The largest atomic write that sets an atomic boundary, and the largest
+	// boundary it may set. Zero disables atomic boundaries.
+	MaxLengthWithBoundary uint32
+	MaxBoundary           uint32
+}
+
+// InRange reports whether `blocks` logical blocks starting at `lba` lie within the volume.
+func (s DataSizes) InRange(lba uint64, blocks uint32) bool {
+	nblocks := uint64(s.VolumeSize / s.BlockSize)
+	return lba <= nblocks && uint64(blocks) <= nblocks-lba
+}
+
 // NaaWWN represents the World Wide Name of the SCSI device we are emulating, using the
 // Network Address Authority standard.
 type NaaWWN struct {
@@ -316,7 +634,7 @@ func BasicSCSIHandler(rw ReadWriterAt) *SCSIHandler {
 		WWN:        GenerateTestWWN(),
 		VolumeName: "testvol",
 		// 1GiB, 1K
-		DataSizes: DataSizes{1024 * 1024 * 1024, 1024},
+		DataSizes: DataSizes{VolumeSize: 1024 * 1024 * 1024, BlockSize: 1024},
 		DevReady: MultiThreadedDevReady(
 			ReadWriterAtCmdHandler{
 				RW: rw,
@@ -324,6 +642,42 @@ func BasicSCSIHandler(rw ReadWriterAt) *SCSIHandler {
 	}
 }
 
+// ATASCSIHandler is BasicSCSIHandler for a disk that presents itself as an ATA disk behind a SCSI to ATA
+// translation layer, with the ATA Information VPD page.
+func ATASCSIHandler(rw ReadWriterAt) *SCSIHandler {
+	inq := defaultInquiry
+	inq.ATAInformation = true
+	h := BasicSCSIHandler(rw)
+	h.DevReady = MultiThreadedDevReady(
+		ReadWriterAtCmdHandler{
+			RW:  rw,
+			Inq: &inq,
+		}, 2)
+	return h
+}
+
+// ReadOnly adapts an io.ReaderAt to a ReadWriterAt. Every write fails with EROFS, which reaches the
+// initiator as DATA PROTECT / WRITE PROTECTED.
+func ReadOnly(r io.ReaderAt) ReadWriterAt {
+	return readOnly{r}
+}
+
+type readOnly struct {
+	io.ReaderAt
+}
+
+func (readOnly) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EROFS
+}
+
+// ReadOnlySCSIHandler is BasicSCSIHandler for a read-only image. The device starts write protected, and
+// stays unwritable even if write protection is later turned off.
+func ReadOnlySCSIHandler(r io.ReaderAt) *SCSIHandler {
+	h := BasicSCSIHandler(ReadOnly(r))
+	h.WriteProtect = true
+	return h
+}
+
 func SingleThreadedDevReady(h SCSICmdHandler) DevReadyFunc {
 	return func(in chan *SCSICmd, out chan SCSIResponse) error {
 		go func(h SCSICmdHandler, in chan *SCSICmd, out chan SCSIResponse) {
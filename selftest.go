@@ -0,0 +1,312 @@
+package tcmu
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// SELF-TEST CODE values of SEND DIAGNOSTIC.
+const (
+	selfTestBackgroundShort    = 0x1
+	selfTestBackgroundExtended = 0x2
+	selfTestAbortBackground    = 0x4
+	selfTestForegroundShort    = 0x5
+	selfTestForegroundExtended = 0x6
+)
+
+// SELF-TEST RESULTS values of the Self-Test Results log page.
+const (
+	selfTestPassed     = 0x0
+	selfTestAborted    = 0x1
+	selfTestFailed     = 0x4
+	selfTestInProgress = 0xf
+)
+
+const (
+	// The Self-Test Results log page holds this many results.
+	maxSelfTestResults = 20
+	// A short self-test reads this much from the start and the end of the device.
+	shortSelfTestSpan = 16 * 1024 * 1024
+	selfTestChunk     = 1024 * 1024
+)
+
+// selfTestResult is one parameter of the Self-Test Results log page.
+type selfTestResult struct {
+	seq     uint64
+	code    byte
+	result  byte
+	hours   uint16
+	failLBA uint64
+	failed  bool
+}
+
+// selfTestSpans returns the byte ranges a self-test reads.
+func selfTestSpans(size int64, extended bool) [][2]int64 {
+	if extended || size <= 2*shortSelfTestSpan {
+		return [][2]int64{{0, size}}
+	}
+	return [][2]int64{{0, shortSelfTestSpan}, {size - shortSelfTestSpan, shortSelfTestSpan}}
+}
+
+// runSelfTest reads, or verifies if the backing store can, the ranges of a self-test. It returns the LBA
+// of the first block that failed, and the error. It stops early if `ctx` is cancelled.
+func runSelfTest(ctx context.Context, r io.ReaderAt, sizes DataSizes, extended bool) (uint64, error) {
+	v, verify := r.(RangeVerifier)
+	buf := make([]byte, selfTestChunk)
+	for _, span := range selfTestSpans(sizes.VolumeSize, extended) {
+		for off := span[0]; off < span[0]+span[1]; off += selfTestChunk {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			n := span[0] + span[1] - off
+			if n > selfTestChunk {
+				n = selfTestChunk
+			}
+			var err error
+			if verify {
+				err = v.VerifyRange(off, n)
+			} else {
+				var got int
+				got, err = r.ReadAt(buf[:n], off)
+				if int64(got) == n && err == io.EOF {
+					err = nil
+				}
+			}
+			if err != nil {
+				return firstBadBlock(r, sizes, off, n), err
+			}
+		}
+	}
+	return 0, nil
+}
+
+// firstBadBlock finds the block of the `n` bytes at `off` that failed a self-test, by checking them one
+// block at a time. If every block passes on its own, the first block of the range is
+// blamed.
+func firstBadBlock(r io.ReaderAt, sizes DataSizes, off, n int64) uint64 {
+	if v, ok := r.(RangeVerifier); ok {
+		for b := off; b < off+n; b += sizes.BlockSize {
+			if v.VerifyRange(b, sizes.BlockSize) != nil {
+				return uint64(b / sizes.BlockSize)
+			}
+		}
+		return uint64(off / sizes.BlockSize)
+	}
+	buf := make([]byte, sizes.BlockSize)
+	for b := off; b < off+n; b += sizes.BlockSize {
+		if got, err := r.ReadAt(buf, b); int64(got) != sizes.BlockSize || err != nil && err != io.EOF {
+			return uint64(b / sizes.BlockSize)
+		}
+	}
+	return uint64(off / sizes.BlockSize)
+}
+
+// powerOnHours is reported with each self-test result.
+func (d *Device) powerOnHours() uint16 {
+	h := time.Since(d.opened) / time.Hour
+	if h > 0xffff {
+		return 0xffff
+	}
+	return uint16(h)
+}
+
+// pushSelfTest records a new self-test result, and returns its sequence number. Must be called with mu held.
+func (d *Device) pushSelfTest(r selfTestResult) uint64 {
+	d.selfTestSeq++
+	r.seq = d.selfTestSeq
+	d.selfTests = append([]selfTestResult{r}, d.selfTests...)
+	if len(d.selfTests) > maxSelfTestResults {
+		d.selfTests = d.selfTests[:maxSelfTestResults]
+	}
+	return r.seq
+}
+
+// finishSelfTest fills in the outcome of the self-test for which pushSelfTest recorded a result in
+// progress under `seq`. Must be called with mu held.
+func (d *Device) finishSelfTest(seq uint64, failLBA uint64, err error) {
+	var r *selfTestResult
+	for i := range d.selfTests {
+		if d.selfTests[i].seq == seq {
+			r = &d.selfTests[i]
+			break
+		}
+	}
+	if r == nil {
+		// Pushed out of the log by newer results.
+		r = &selfTestResult{}
+	}
+	r.hours = d.powerOnHours()
+	switch {
+	case err == nil:
+		r.result = selfTestPassed
+	case err == context.Canceled:
+		r.result = selfTestAborted
+	default:
+		log.Errorf("self-test failed at LBA %d: %v", failLBA, err)
+		r.result = selfTestFailed
+		r.failLBA = failLBA
+		r.failed = true
+	}
+}
+
+// abortSelfTest stops the background self-test in progress, if any, and reports whether there was one.
+func (d *Device) abortSelfTest() bool {
+	d.mu.Lock()
+	cancel := d.selfTestCancel
+	d.mu.Unlock()
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// EmulateSendDiagnostic runs the default self-test, or a short or extended self-test in the foreground or
+// background, or aborts a background self-test. The short self-test reads the start and the end of the
+// device; the extended one reads all of it. Results are reported in the Self-Test Results log page.
+func EmulateSendDiagnostic(cmd *SCSICmd, r io.ReaderAt) (SCSIResponse, error) {
+	d := cmd.Device()
+	code := cmd.GetCDB(1) >> 5
+	selfTest := cmd.GetCDB(1)&0x04 != 0
+	paramLen := binary.BigEndian.Uint16(cmd.cdb[3:5])
+	if code != 0 && (selfTest || paramLen != 0) {
+		return cmd.IllegalRequest(), nil
+	}
+	if code == 0 && !selfTest {
+		// No diagnostic pages are supported on a disk.
+		if paramLen != 0 {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+		return cmd.Ok(), nil
+	}
+	if code == selfTestAbortBackground {
+		if !d.abortSelfTest() {
+			return cmd.IllegalRequest(), nil
+		}
+		return cmd.Ok(), nil
+	}
+
+	d.mu.Lock()
+	if d.selfTestBusy {
+		d.mu.Unlock()
+		return cmd.IllegalRequest(), nil
+	}
+	switch code {
+	case 0:
+		// The default self-test is not logged.
+		d.selfTestBusy = true
+		d.mu.Unlock()
+		_, err := runSelfTest(cmd.Context(), r, d.Sizes(), false)
+		d.mu.Lock()
+		d.selfTestBusy = false
+		d.mu.Unlock()
+		if resp, ok := cmd.aborted(false); ok {
+			return resp, nil
+		}
+		if err != nil {
+			return cmd.CheckCondition(scsi.SenseHardwareError, scsi.AscLogicalUnitFailedSelfTest), nil
+		}
+		return cmd.Ok(), nil
+	case selfTestForegroundShort, selfTestForegroundExtended:
+		d.selfTestBusy = true
+		seq := d.pushSelfTest(selfTestResult{code: code, result: selfTestInProgress})
+		d.mu.Unlock()
+		lba, err := runSelfTest(cmd.Context(), r, d.Sizes(), code == selfTestForegroundExtended)
+		d.mu.Lock()
+		d.finishSelfTest(seq, lba, err)
+		d.selfTestBusy = false
+		d.mu.Unlock()
+		if resp, ok := cmd.aborted(false); ok {
+			return resp, nil
+		}
+		if err != nil {
+			return cmd.CheckCondition(scsi.SenseHardwareError, scsi.AscLogicalUnitFailedSelfTest), nil
+		}
+		return cmd.Ok(), nil
+	case selfTestBackgroundShort, selfTestBackgroundExtended:
+		ctx, cancel := context.WithCancel(context.Background())
+		d.selfTestBusy = true
+		d.selfTestCancel = cancel
+		seq := d.pushSelfTest(selfTestResult{code: code, result: selfTestInProgress})
+		d.mu.Unlock()
+		go func() {
+			lba, err := runSelfTest(ctx, r, d.Sizes(), code == selfTestBackgroundExtended)
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.finishSelfTest(seq, lba, err)
+			d.selfTestBusy = false
+			d.selfTestCancel = nil
+			cancel()
+		}()
+		return cmd.Ok(), nil
+	}
+	d.mu.Unlock()
+	return cmd.IllegalRequest(), nil
+}
+
+// EmulateReceiveDiagnostic answers RECEIVE DIAGNOSTIC RESULTS for a disk, which supports no diagnostic
+// pages other than the list of them.
+func EmulateReceiveDiagnostic(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.GetCDB(1)&0x01 != 0 && cmd.GetCDB(2) != 0x00 {
+		return cmd.IllegalRequest(), nil
+	}
+	data := []byte{0x00, 0, 0, 1, 0x00}
+	return writeTruncated(cmd, data, int(binary.BigEndian.Uint16(cmd.cdb[3:5])))
+}
+
+// EmulateLogSense returns the Supported Log Pages (0x00) and Self-Test Results (0x10) log pages.
+func EmulateLogSense(cmd *SCSICmd) (SCSIResponse, error) {
+	page := cmd.GetCDB(2) & 0x3f
+	allocLen := int(binary.BigEndian.Uint16(cmd.cdb[7:9]))
+	if cmd.GetCDB(3) != 0 { // subpage
+		return cmd.IllegalRequest(), nil
+	}
+	var body []byte
+	switch page {
+	case 0x00:
+		body = []byte{0x00, 0x10}
+	case 0x10:
+		body = cmd.Device().selfTestLog()
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	data := make([]byte, 4+len(body))
+	data[0] = page
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(body)))
+	copy(data[4:], body)
+	return writeTruncated(cmd, data, allocLen)
+}
+
+// selfTestLog builds the parameters of the Self-Test Results log page: twenty of them, the newest result
+// first, with unused ones left empty.
+func (d *Device) selfTestLog() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	order := binary.BigEndian
+	body := make([]byte, 20*maxSelfTestResults)
+	for i := 0; i < maxSelfTestResults; i++ {
+		p := body[20*i : 20*(i+1)]
+		order.PutUint16(p[0:2], uint16(i+1))
+		p[2] = 0x03 // binary format list
+		p[3] = 0x10
+		if i >= len(d.selfTests) {
+			continue
+		}
+		r := d.selfTests[i]
+		p[4] = r.code<<5 | r.result
+		p[5] = 1 // self-test number: there are no segments
+		order.PutUint16(p[6:8], r.hours)
+		order.PutUint64(p[8:16], 0xffffffffffffffff)
+		if r.failed {
+			order.PutUint64(p[8:16], r.failLBA)
+			p[16] = scsi.SenseMediumError
+			order.PutUint16(p[17:19], scsi.AscReadError)
+		}
+	}
+	return body
+}
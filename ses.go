@@ -0,0 +1,473 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// SES element types.
+const (
+	sesTypeDeviceSlot  = 0x01
+	sesTypeCooling     = 0x03
+	sesTypeTemperature = 0x04
+)
+
+// SES element status codes.
+const (
+	sesStatusOK           = 0x1
+	sesStatusCritical     = 0x2
+	sesStatusNotInstalled = 0x5
+)
+
+// EnclosureConfig describes the elements of an EnclosureCmdHandler.
+type EnclosureConfig struct {
+	Slots       int
+	Fans        int
+	TempSensors int
+	// The enclosure logical identifier, an NAA identifier. The device slots
+	// report SAS addresses following it in the Additional Element Status page.
+	LogicalID uint64
+}
+
+// EnclosureSlot is the state of a device slot.
+type EnclosureSlot struct {
+	// A device is in the slot.
+	Installed bool
+	// The fault and identify (locate) LEDs, as requested by the initiator.
+	Fault bool
+	Ident bool
+	// The enclosure has detected a fault on the device.
+	FaultSensed bool
+}
+
+// EnclosureFan is the state of a cooling element.
+type EnclosureFan struct {
+	RPM   int
+	Off   bool
+	Fail  bool
+	Ident bool
+}
+
+// EnclosureSensor is the state of a temperature sensor.
+type EnclosureSensor struct {
+	Celsius int
+	Fail    bool
+	Ident   bool
+}
+
+// EnclosureCmdHandler emulates a SCSI enclosure services (SES) device (peripheral type 0x0d) with device
+// slots, fans and temperature sensors. The initiator drives the LEDs with the Enclosure Control page; the
+// rest of the state is set through the Go API.
+type EnclosureCmdHandler struct {
+	Inq *InquiryInfo
+
+	conf  EnclosureConfig
+	mu    sync.Mutex
+	slots []EnclosureSlot
+	fans  []EnclosureFan
+	temps []EnclosureSensor
+	// The page returned by RECEIVE DIAGNOSTIC RESULTS without PCV, as
+	// selected by the last SEND DIAGNOSTIC.
+	page byte
+}
+
+// NewEnclosureCmdHandler creates an enclosure with empty slots, fans at rest and sensors at 25 degrees.
+func NewEnclosureCmdHandler(conf EnclosureConfig) *EnclosureCmdHandler {
+	h := &EnclosureCmdHandler{
+		conf:  conf,
+		slots: make([]EnclosureSlot, conf.Slots),
+		fans:  make([]EnclosureFan, conf.Fans),
+		temps: make([]EnclosureSensor, conf.TempSensors),
+	}
+	for i := range h.temps {
+		h.temps[i].Celsius = 25
+	}
+	return h
+}
+
+// EnclosureSCSIHandler is BasicSCSIHandler for an enclosure.
+func EnclosureSCSIHandler(h *EnclosureCmdHandler) *SCSIHandler {
+	return &SCSIHandler{
+		HBA:        30,
+		LUN:        0,
+		WWN:        GenerateTestWWN(),
+		VolumeName: "testses",
+		// The kernel wants a size, though an enclosure has none.
+		DataSizes: DataSizes{VolumeSize: 1024 * 1024, BlockSize: 512},
+		DevReady:  SingleThreadedDevReady(h),
+	}
+}
+
+func (h *EnclosureCmdHandler) Slot(i int) EnclosureSlot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.slots[i]
+}
+
+func (h *EnclosureCmdHandler) SetSlot(i int, s EnclosureSlot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.slots[i] = s
+}
+
+func (h *EnclosureCmdHandler) Fan(i int) EnclosureFan {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fans[i]
+}
+
+func (h *EnclosureCmdHandler) SetFan(i int, f EnclosureFan) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fans[i] = f
+}
+
+func (h *EnclosureCmdHandler) Temperature(i int) EnclosureSensor {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.temps[i]
+}
+
+func (h *EnclosureCmdHandler) SetTemperature(i int, s EnclosureSensor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.temps[i] = s
+}
+
+func (h *EnclosureCmdHandler) inquiry() *InquiryInfo {
+	inq := defaultInquiry
+	if h.Inq != nil {
+		inq = *h.Inq
+	}
+	inq.DeviceType = scsi.TypeEnclosure
+	return &inq
+}
+
+func (h *EnclosureCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	switch cmd.Command() {
+	case scsi.Inquiry:
+		return EmulateInquiry(cmd, h.inquiry())
+	case scsi.TestUnitReady:
+		return EmulateTestUnitReady(cmd)
+	case scsi.ReceiveDiagnostic:
+		return h.receiveDiagnostic(cmd)
+	case scsi.SendDiagnostic:
+		return h.sendDiagnostic(cmd)
+	default:
+		log.Debugf("Ignore unknown SCSI command 0x%x\n", cmd.Command())
+	}
+	return cmd.NotHandled(), nil
+}
+
+// sesType describes one type descriptor header of the Configuration page, in page order.
+type sesType struct {
+	typ   byte
+	count int
+	text  string
+}
+
+func (h *EnclosureCmdHandler) types() []sesType {
+	return []sesType{
+		{sesTypeDeviceSlot, len(h.slots), "Device Slot"},
+		{sesTypeCooling, len(h.fans), "Cooling"},
+		{sesTypeTemperature, len(h.temps), "Temperature Sensor"},
+	}
+}
+
+// diagnosticPage builds a diagnostic page with a generation code, which is always zero as the
+// configuration never changes.
+func diagnosticPage(code, flags byte, body []byte) []byte {
+	data := make([]byte, 8+len(body))
+	data[0] = code
+	data[1] = flags
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-4))
+	copy(data[8:], body)
+	return data
+}
+
+func (h *EnclosureCmdHandler) receiveDiagnostic(cmd *SCSICmd) (SCSIResponse, error) {
+	allocLen := int(binary.BigEndian.Uint16(cmd.cdb[3:5]))
+	page := cmd.GetCDB(2)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cmd.GetCDB(1)&0x01 == 0 { // PCV
+		page = h.page
+	}
+	var data []byte
+	switch page {
+	case 0x00: // Supported Diagnostic Pages
+		pages := []byte{0x00, 0x01, 0x02, 0x07, 0x0a}
+		data = make([]byte, 4+len(pages))
+		binary.BigEndian.PutUint16(data[2:4], uint16(len(pages)))
+		copy(data[4:], pages)
+	case 0x01:
+		data = h.configurationPage()
+	case 0x02:
+		data = h.statusPage()
+	case 0x07:
+		data = h.elementDescriptorPage()
+	case 0x0a:
+		data = h.additionalStatusPage()
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	return writeTruncated(cmd, data, allocLen)
+}
+
+// sendDiagnostic accepts the Enclosure Control page. Any other page only selects the page returned by
+// the next RECEIVE DIAGNOSTIC RESULTS without PCV. A default self-test always passes.
+func (h *EnclosureCmdHandler) sendDiagnostic(cmd *SCSICmd) (SCSIResponse, error) {
+	length := int(binary.BigEndian.Uint16(cmd.cdb[3:5]))
+	if length == 0 {
+		return cmd.Ok(), nil
+	}
+	if cmd.GetCDB(1)&0x10 == 0 { // PF
+		return cmd.IllegalRequest(), nil
+	}
+	buf := make([]byte, length)
+	if n, err := cmd.Read(buf); err != nil || n < length || length < 4 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch buf[0] {
+	case 0x00, 0x01, 0x07, 0x0a:
+		h.page = buf[0]
+		return cmd.Ok(), nil
+	case 0x02:
+		h.page = buf[0]
+		if !h.control(buf) {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+		}
+		return cmd.Ok(), nil
+	}
+	return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+}
+
+func (h *EnclosureCmdHandler) configurationPage() []byte {
+	types := h.types()
+	desc := make([]byte, 40)
+	desc[0] = 0x11 // one enclosure services process, and this is it
+	desc[2] = byte(len(types))
+	desc[3] = byte(len(desc) - 4)
+	binary.BigEndian.PutUint64(desc[4:12], h.conf.LogicalID)
+	inq := h.inquiry()
+	copy(desc[12:20], FixedString(inq.VendorID, 8))
+	copy(desc[20:36], FixedString(inq.ProductID, 16))
+	copy(desc[36:40], FixedString(inq.ProductRev, 4))
+	body := desc
+	for _, t := range types {
+		body = append(body, t.typ, byte(t.count), 0, byte(len(t.text)))
+	}
+	for _, t := range types {
+		body = append(body, t.text...)
+	}
+	return diagnosticPage(0x01, 0, body)
+}
+
+// slotStatus, fanStatus and tempStatus encode status elements.
+func slotStatus(s EnclosureSlot) []byte {
+	b := make([]byte, 4)
+	switch {
+	case !s.Installed:
+		b[0] = sesStatusNotInstalled
+	case s.FaultSensed:
+		b[0] = sesStatusCritical
+	default:
+		b[0] = sesStatusOK
+	}
+	if s.Ident {
+		b[2] |= 0x02
+	}
+	if s.FaultSensed {
+		b[3] |= 0x40
+	}
+	if s.Fault {
+		b[3] |= 0x20 // FAULT REQSTD
+	}
+	return b
+}
+
+func fanStatus(f EnclosureFan) []byte {
+	b := make([]byte, 4)
+	b[0] = sesStatusOK
+	if f.Fail {
+		b[0] = sesStatusCritical
+		b[3] |= 0x40
+	}
+	if f.Ident {
+		b[1] |= 0x80
+	}
+	// The speed is reported in units of 10 rpm, and as a code from 0
+	// (stopped) to 7 (highest speed).
+	speed := f.RPM / 10
+	if speed > 0x7ff {
+		speed = 0x7ff
+	}
+	code := 0
+	if !f.Off && f.RPM > 0 {
+		code = (f.RPM + 999) / 1000
+		if code > 7 {
+			code = 7
+		}
+	}
+	if f.Off {
+		speed = 0
+		b[3] |= 0x10 // OFF
+	} else {
+		b[3] |= 0x20 // RQSTED ON
+	}
+	b[1] |= byte(speed >> 8)
+	b[2] = byte(speed)
+	b[3] |= byte(code)
+	return b
+}
+
+func tempStatus(s EnclosureSensor) []byte {
+	b := make([]byte, 4)
+	b[0] = sesStatusOK
+	if s.Fail {
+		b[0] = sesStatusCritical
+		b[1] |= 0x40
+	}
+	if s.Ident {
+		b[1] |= 0x80
+	}
+	// The temperature is offset by 20 degrees; zero is reserved.
+	t := s.Celsius + 20
+	if t < 1 {
+		t = 1
+	} else if t > 255 {
+		t = 255
+	}
+	b[2] = byte(t)
+	return b
+}
+
+// statusPage builds the Enclosure Status page: for each type, an overall status element followed by the
+// status of each element.
+func (h *EnclosureCmdHandler) statusPage() []byte {
+	var body []byte
+	critical := false
+	overall := []byte{sesStatusOK, 0, 0, 0}
+	body = append(body, overall...)
+	for _, s := range h.slots {
+		st := slotStatus(s)
+		critical = critical || st[0] == sesStatusCritical
+		body = append(body, st...)
+	}
+	body = append(body, overall...)
+	for _, f := range h.fans {
+		st := fanStatus(f)
+		critical = critical || st[0] == sesStatusCritical
+		body = append(body, st...)
+	}
+	body = append(body, overall...)
+	for _, s := range h.temps {
+		st := tempStatus(s)
+		critical = critical || st[0] == sesStatusCritical
+		body = append(body, st...)
+	}
+	flags := byte(0)
+	if critical {
+		flags |= 0x02 // CRIT
+	}
+	return diagnosticPage(0x02, flags, body)
+}
+
+// control applies the Enclosure Control page in `buf`. Only elements with SELECT set are changed, and
+// overall control elements are ignored.
+func (h *EnclosureCmdHandler) control(buf []byte) bool {
+	if len(buf) < 8 || binary.BigEndian.Uint32(buf[4:8]) != 0 { // expected generation code
+		return false
+	}
+	n := 4 * (3 + len(h.slots) + len(h.fans) + len(h.temps))
+	if int(binary.BigEndian.Uint16(buf[2:4]))+4 < 8+n || len(buf) < 8+n {
+		return false
+	}
+	elems := buf[8:]
+	next := func() []byte {
+		e := elems[:4]
+		elems = elems[4:]
+		return e
+	}
+	const selected = 0x80
+	next()
+	for i := range h.slots {
+		if e := next(); e[0]&selected != 0 {
+			h.slots[i].Ident = e[2]&0x02 != 0
+			h.slots[i].Fault = e[3]&0x20 != 0
+		}
+	}
+	next()
+	for i := range h.fans {
+		if e := next(); e[0]&selected != 0 {
+			h.fans[i].Ident = e[1]&0x80 != 0
+			h.fans[i].Fail = e[3]&0x40 != 0 // RQST FAIL
+			h.fans[i].Off = e[3]&0x20 == 0  // RQST ON
+		}
+	}
+	next()
+	for i := range h.temps {
+		if e := next(); e[0]&selected != 0 {
+			h.temps[i].Ident = e[1]&0x80 != 0
+			h.temps[i].Fail = e[1]&0x40 != 0
+		}
+	}
+	return true
+}
+
+// elementDescriptorPage names every element, and each type with its overall descriptor.
+func (h *EnclosureCmdHandler) elementDescriptorPage() []byte {
+	var body []byte
+	add := func(text string) {
+		d := make([]byte, 4+len(text))
+		binary.BigEndian.PutUint16(d[2:4], uint16(len(text)))
+		copy(d[4:], text)
+		body = append(body, d...)
+	}
+	for _, t := range h.types() {
+		add(t.text)
+		for i := 0; i < t.count; i++ {
+			switch t.typ {
+			case sesTypeDeviceSlot:
+				add(fmt.Sprintf("Slot %02d", i))
+			case sesTypeCooling:
+				add(fmt.Sprintf("Fan %d", i))
+			case sesTypeTemperature:
+				add(fmt.Sprintf("Temperature %d", i))
+			}
+		}
+	}
+	return diagnosticPage(0x07, 0, body)
+}
+
+// additionalStatusPage reports a SAS end device with a single phy for every device slot. The element
+// index counts the elements of every type, without the overall elements, so slot i is element i.
+func (h *EnclosureCmdHandler) additionalStatusPage() []byte {
+	var body []byte
+	for i, s := range h.slots {
+		d := make([]byte, 36)
+		d[0] = 0x10 | 0x06 // EIP, SAS
+		if !s.Installed {
+			d[0] |= 0x80 // INVALID
+		}
+		d[1] = byte(len(d) - 2)
+		d[3] = byte(i) // element index
+		d[4] = 1       // number of phy descriptors
+		d[7] = byte(i) // device slot number
+		phy := d[8:]
+		if s.Installed {
+			phy[0] = 0x10 // end device
+			phy[3] = 0x08 // SSP target
+			binary.BigEndian.PutUint64(phy[12:20], h.conf.LogicalID+uint64(i)+1)
+		}
+		binary.BigEndian.PutUint64(phy[4:12], h.conf.LogicalID)
+		body = append(body, d...)
+	}
+	return diagnosticPage(0x0a, 0, body)
+}
@@ -1,18 +1,20 @@
 package tcmu
 
 import (
-	"encoding/binary"
 	"fmt"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
 
-var byteOrder binary.ByteOrder = binary.LittleEndian
-
 func (d *Device) mbVersion() uint16 {
 	return *(*uint16)(unsafe.Pointer(&d.mmap[0]))
 }
 
+// The kernel lets commands complete out of order: it looks up each completed command by the cmd_id of the
+// entry holding its response, so a response may be written to whichever entry is at the tail.
+const tcmuMailboxFlagCapOOOC = 1 << 0
+
 func (d *Device) mbFlags() uint16 {
 	return *(*uint16)(unsafe.Pointer(&d.mmap[2]))
 }
@@ -25,22 +27,27 @@ func (d *Device) mbCmdrSize() uint32 {
 	return *(*uint32)(unsafe.Pointer(&d.mmap[8]))
 }
 
+// The kernel and the device share cmd_head and cmd_tail, so they are accessed atomically. This also orders
+// them with the ring and data area: an entry is read only after the head moving past it is seen, and a
+// response is written before the tail moving past it, as tcmu-runner does with its barriers.
+
 func (d *Device) mbCmdHead() uint32 {
-	return *(*uint32)(unsafe.Pointer(&d.mmap[12]))
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&d.mmap[12])))
 }
 
 func (d *Device) mbCmdTail() uint32 {
-	return *(*uint32)(unsafe.Pointer(&d.mmap[64]))
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&d.mmap[64])))
 }
 
 func (d *Device) mbSetTail(u uint32) {
-	byteOrder.PutUint32(d.mmap[64:], u)
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&d.mmap[64])), u)
 }
 
 /*
 enum tcmu_opcode {
   TCMU_OP_PAD = 0,
   TCMU_OP_CMD,
+  TCMU_OP_TMR,
 };
 */
 type tcmuOpcode int
@@ -48,6 +55,7 @@ type tcmuOpcode int
 const (
 	tcmuOpPad tcmuOpcode = 0
 	tcmuOpCmd            = 1
+	tcmuOpTmr            = 2
 )
 
 /*
@@ -150,6 +158,33 @@ func (d *Device) copyEntRespSenseData(off int, data []byte) {
 	}
 }
 
+/*
+struct tcmu_tmr_entry {
+	struct tcmu_cmd_entry_hdr hdr;
+
+	uint8_t tmr_type; 0
+	uint8_t __pad1;
+	uint16_t __pad2;
+	uint32_t cmd_cnt; 4
+	uint64_t __pad3;
+	uint64_t __pad4;
+	uint16_t cmd_ids[0]; 24
+} __packed;
+*/
+
+func (d *Device) entTmrType(off int) uint8 {
+	return d.mmap[off+offTmrType]
+}
+
+func (d *Device) entTmrCmdIds(off int) []uint16 {
+	n := int(*(*uint32)(unsafe.Pointer(&d.mmap[off+offTmrCmdCnt])))
+	ids := make([]uint16, n)
+	for i := range ids {
+		ids[i] = *(*uint16)(unsafe.Pointer(&d.mmap[off+offTmrCmdIds+2*i]))
+	}
+	return ids
+}
+
 func (d *Device) entIovecN(off int, idx int) []byte {
 	out := syscall.Iovec{}
 	p := unsafe.Pointer(&d.mmap[off+offReqIov0Base])
@@ -161,7 +196,9 @@ func (d *Device) entIovecN(off int, idx int) []byte {
 func (d *Device) entCdb(off int) []byte {
 	cdbStart := int(d.entReqCdbOff(off))
 	len := d.cdbLen(cdbStart)
-	return d.mmap[cdbStart : cdbStart+len]
+	// Copied, as the entry may hold another command's response before this
+	// one completes.
+	return append([]byte(nil), d.mmap[cdbStart:cdbStart+len]...)
 }
 
 func (d *Device) cdbLen(cdbStart int) int {
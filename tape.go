@@ -0,0 +1,638 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	// The largest block READ BLOCK LIMITS advertises.
+	tapeMaxBlockSize = 1 << 20
+	// Writes past the last 1/32 of the cartridge report early warning.
+	tapeEarlyWarningShift = 5
+)
+
+// TapeCmdHandler emulates a sequential-access (SSC) tape drive. Cartridges are TapeImage files, loaded
+// with Load or given to NewTapeCmdHandler, and unloaded by the initiator or with Unload.
+type TapeCmdHandler struct {
+	Inq *InquiryInfo
+
+	mu   sync.Mutex
+	tape *TapeImage
+	// The initiator has unloaded the cartridge, which is still in the drive.
+	unloaded bool
+	// The device the drive is serving, once it has seen a command. Loading a cartridge raises a unit
+	// attention on it.
+	dev *Device
+	// Zero for variable block mode.
+	blockSize uint32
+	// The file offset of the next record, and the number of records (blocks and filemarks) and filemarks
+	// before it.
+	pos   int64
+	block uint64
+	file  uint64
+}
+
+// NewTapeCmdHandler creates a drive holding `tape`, which may be nil for an empty drive.
+func NewTapeCmdHandler(tape *TapeImage) *TapeCmdHandler {
+	h := &TapeCmdHandler{tape: tape}
+	h.rewind()
+	return h
+}
+
+// TapeSCSIHandler is BasicSCSIHandler for a tape drive.
+func TapeSCSIHandler(h *TapeCmdHandler) *SCSIHandler {
+	return &SCSIHandler{
+		HBA:        30,
+		LUN:        0,
+		WWN:        GenerateTestWWN(),
+		VolumeName: "testtape",
+		// The kernel wants a size, though a tape has none.
+		DataSizes: DataSizes{VolumeSize: 1024 * 1024, BlockSize: 512},
+		DevReady:  SingleThreadedDevReady(h),
+	}
+}
+
+// Load puts `tape` in the drive and rewinds it. The drive must be empty.
+func (h *TapeCmdHandler) Load(tape *TapeImage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tape = tape
+	h.unloaded = false
+	if h.dev != nil {
+		h.dev.RaiseUnitAttention(scsi.AscNotReadyToReadyChange)
+	}
+	h.rewind()
+}
+
+// Unload takes the cartridge out of the drive and returns it, or nil if the drive is empty.
+func (h *TapeCmdHandler) Unload() *TapeImage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := h.tape
+	h.tape = nil
+	h.rewind()
+	return t
+}
+
+// Tape returns the cartridge in the drive, or nil.
+func (h *TapeCmdHandler) Tape() *TapeImage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.tape
+}
+
+func (h *TapeCmdHandler) inquiry() *InquiryInfo {
+	inq := defaultInquiry
+	if h.Inq != nil {
+		inq = *h.Inq
+	}
+	inq.DeviceType = scsi.TypeTape
+	inq.Removable = true
+	return &inq
+}
+
+func (h *TapeCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.Command() == scsi.Inquiry {
+		return EmulateInquiry(cmd, h.inquiry())
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dev = cmd.Device()
+	switch cmd.Command() {
+	case scsi.ReadBlockLimits:
+		data := make([]byte, 6)
+		putUint24(data[1:4], tapeMaxBlockSize)
+		binary.BigEndian.PutUint16(data[4:6], 1)
+		cmd.Write(data)
+		return cmd.Ok(), nil
+	case scsi.ModeSense, scsi.ModeSense10:
+		return h.modeSense(cmd)
+	case scsi.ModeSelect, scsi.ModeSelect10:
+		return h.modeSelect(cmd)
+	case scsi.LoadUnload:
+		if h.tape == nil {
+			return cmd.NotReady(), nil
+		}
+		h.unloaded = cmd.GetCDB(4)&0x01 == 0
+		h.rewind()
+		return cmd.Ok(), nil
+	}
+	if h.tape == nil || h.unloaded {
+		switch cmd.Command() {
+		case scsi.TestUnitReady, scsi.Rewind, scsi.Read6, scsi.Write6, scsi.WriteFilemarks, scsi.Space,
+			scsi.ReadPosition, scsi.ReadAttribute, scsi.WriteAttribute:
+			return cmd.NotReady(), nil
+		}
+	}
+	switch cmd.Command() {
+	case scsi.TestUnitReady:
+		return cmd.Ok(), nil
+	case scsi.Rewind:
+		h.rewind()
+		return cmd.Ok(), nil
+	case scsi.Read6:
+		return h.read(cmd)
+	case scsi.Write6:
+		return h.write(cmd)
+	case scsi.WriteFilemarks:
+		return h.writeFilemarks(cmd)
+	case scsi.Space:
+		return h.space(cmd)
+	case scsi.ReadPosition:
+		return h.readPosition(cmd)
+	case scsi.ReadAttribute:
+		return h.readAttribute(cmd)
+	case scsi.WriteAttribute:
+		return h.writeAttribute(cmd)
+	default:
+		log.Debugf("Ignore unknown SCSI command 0x%x\n", cmd.Command())
+	}
+	return cmd.NotHandled(), nil
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+// tapeXferLen returns the 24 bit transfer length (or count) in bytes 2 to 4 of a tape command.
+func tapeXferLen(cmd *SCSICmd) uint32 {
+	return uint32(cmd.GetCDB(2))<<16 | uint32(cmd.GetCDB(3))<<8 | uint32(cmd.GetCDB(4))
+}
+
+// tapeSense reports the residue of a stream command that stopped early in the INFORMATION field.
+func tapeSense(key byte, asc uint16, residue int32) FixedSense {
+	return FixedSense{Key: key, ASC: asc, Info: uint32(residue), InfoValid: true}
+}
+
+func (h *TapeCmdHandler) rewind() {
+	h.pos = tapeHeaderSize
+	h.block = 0
+	h.file = 0
+}
+
+func (h *TapeCmdHandler) atBOT() bool {
+	return h.pos == tapeHeaderSize
+}
+
+// pastEarlyWarning reports whether the tape has been written up to `off` beyond the early warning point.
+func (h *TapeCmdHandler) pastEarlyWarning(off int64) bool {
+	c := h.tape.Capacity()
+	return off-tapeHeaderSize > c-c>>tapeEarlyWarningShift
+}
+
+// next returns the record at the current position, or io.EOF at the end of data.
+func (h *TapeCmdHandler) next() (byte, uint32, error) {
+	return h.tape.record(h.pos)
+}
+
+func (h *TapeCmdHandler) forward(kind byte, length uint32) {
+	h.pos += tapeRecordOverhead + int64(length)
+	h.block++
+	if kind == tapeRecordFilemark {
+		h.file++
+	}
+}
+
+// backward moves over the record before the current position, which must not be the beginning of the
+// tape, and returns its kind.
+func (h *TapeCmdHandler) backward() (byte, error) {
+	start, kind, _, err := h.tape.prevRecord(h.pos)
+	if err != nil {
+		return 0, err
+	}
+	h.pos = start
+	h.block--
+	if kind == tapeRecordFilemark {
+		h.file--
+	}
+	return kind, nil
+}
+
+// read handles READ (6) in fixed or variable block mode.
+func (h *TapeCmdHandler) read(cmd *SCSICmd) (SCSIResponse, error) {
+	fixed := cmd.GetCDB(1)&0x01 != 0
+	sili := cmd.GetCDB(1)&0x02 != 0
+	count := tapeXferLen(cmd)
+	if fixed && sili || fixed && h.blockSize == 0 {
+		return cmd.IllegalRequest(), nil
+	}
+	if count == 0 {
+		return cmd.Ok(), nil
+	}
+	if !fixed {
+		return h.readRecord(cmd, count, sili)
+	}
+	buf := make([]byte, h.blockSize)
+	for i := uint32(0); i < count; i++ {
+		residue := int32(count - i)
+		kind, length, err := h.next()
+		if err == io.EOF {
+			return cmd.CheckConditionSense(tapeSense(scsi.SenseBlankCheck, scsi.AscEndOfDataDetected, residue)), nil
+		}
+		if err != nil {
+			return cmd.BackendError(err, false), nil
+		}
+		if kind == tapeRecordFilemark {
+			h.forward(kind, length)
+			s := tapeSense(scsi.SenseNoSense, scsi.AscFilemarkDetected, residue)
+			s.Filemark = true
+			return cmd.CheckConditionSense(s), nil
+		}
+		n := length
+		if n > h.blockSize {
+			n = h.blockSize
+		}
+		if err := h.tape.readData(buf[:n], h.pos); err != nil {
+			return cmd.BackendError(err, false), nil
+		}
+		h.forward(kind, length)
+		cmd.Write(buf[:n])
+		if length != h.blockSize {
+			s := tapeSense(scsi.SenseNoSense, scsi.AscNoAdditionalSense, residue)
+			s.ILI = true
+			return cmd.CheckConditionSense(s), nil
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+// readRecord reads one record of up to `want` bytes in variable block mode.
+func (h *TapeCmdHandler) readRecord(cmd *SCSICmd, want uint32, sili bool) (SCSIResponse, error) {
+	kind, length, err := h.next()
+	if err == io.EOF {
+		return cmd.CheckConditionSense(tapeSense(scsi.SenseBlankCheck, scsi.AscEndOfDataDetected, int32(want))), nil
+	}
+	if err != nil {
+		return cmd.BackendError(err, false), nil
+	}
+	if kind == tapeRecordFilemark {
+		h.forward(kind, length)
+		s := tapeSense(scsi.SenseNoSense, scsi.AscFilemarkDetected, int32(want))
+		s.Filemark = true
+		return cmd.CheckConditionSense(s), nil
+	}
+	n := length
+	if n > want {
+		n = want
+	}
+	buf := make([]byte, n)
+	if err := h.tape.readData(buf, h.pos); err != nil {
+		return cmd.BackendError(err, false), nil
+	}
+	h.forward(kind, length)
+	cmd.Write(buf)
+	// A short record is only reported if SILI is clear; a long one always is.
+	if length > want || length < want && !sili {
+		s := tapeSense(scsi.SenseNoSense, scsi.AscNoAdditionalSense, int32(want)-int32(length))
+		s.ILI = true
+		return cmd.CheckConditionSense(s), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// appendRecord writes a record at the current position, refusing it if the cartridge is full.
+func (h *TapeCmdHandler) appendRecord(cmd *SCSICmd, kind byte, data []byte, residue int32) (SCSIResponse, bool) {
+	end := h.pos + tapeRecordOverhead + int64(len(data))
+	if end-tapeHeaderSize > h.tape.Capacity() {
+		s := tapeSense(scsi.SenseVolumeOverflow, scsi.AscEndOfMediumDetected, residue)
+		s.EOM = true
+		return cmd.CheckConditionSense(s), false
+	}
+	if err := h.tape.appendRecord(h.pos, kind, data); err != nil {
+		return cmd.BackendError(err, true), false
+	}
+	h.forward(kind, uint32(len(data)))
+	return SCSIResponse{}, true
+}
+
+// earlyWarning is the response to a write that succeeded past the early warning point.
+func (h *TapeCmdHandler) earlyWarning(cmd *SCSICmd) SCSIResponse {
+	s := tapeSense(scsi.SenseNoSense, scsi.AscEndOfMediumDetected, 0)
+	s.EOM = true
+	return cmd.CheckConditionSense(s)
+}
+
+// write handles WRITE (6). Each fixed block, or the whole variable block, becomes one record.
+func (h *TapeCmdHandler) write(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	fixed := cmd.GetCDB(1)&0x01 != 0
+	count := tapeXferLen(cmd)
+	if fixed && h.blockSize == 0 || !fixed && count > tapeMaxBlockSize {
+		return cmd.IllegalRequest(), nil
+	}
+	size, records := count, uint32(1)
+	if fixed {
+		size, records = h.blockSize, count
+	}
+	if count == 0 {
+		return cmd.Ok(), nil
+	}
+	buf := make([]byte, size)
+	for i := uint32(0); i < records; i++ {
+		if n, err := cmd.Read(buf); err != nil || n < len(buf) {
+			log.Errorln("write/read failed: unable to copy enough")
+			return cmd.MediumError(), nil
+		}
+		residue := int32(records - i)
+		if !fixed {
+			residue = int32(count)
+		}
+		if resp, ok := h.appendRecord(cmd, tapeRecordData, buf, residue); !ok {
+			return resp, nil
+		}
+	}
+	if h.pastEarlyWarning(h.pos) {
+		return h.earlyWarning(cmd), nil
+	}
+	return cmd.Ok(), nil
+}
+
+func (h *TapeCmdHandler) writeFilemarks(cmd *SCSICmd) (SCSIResponse, error) {
+	if cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	count := tapeXferLen(cmd)
+	for i := uint32(0); i < count; i++ {
+		if resp, ok := h.appendRecord(cmd, tapeRecordFilemark, nil, int32(count-i)); !ok {
+			return resp, nil
+		}
+	}
+	if count > 0 && h.pastEarlyWarning(h.pos) {
+		return h.earlyWarning(cmd), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// space handles SPACE (6) over blocks, filemarks, or to the end of data.
+func (h *TapeCmdHandler) space(cmd *SCSICmd) (SCSIResponse, error) {
+	code := cmd.GetCDB(1) & 0x07
+	// The count is a 24 bit two's complement number; negative counts space towards the beginning.
+	count := int32(tapeXferLen(cmd)<<8) >> 8
+	switch code {
+	case 0x0, 0x1:
+		if count >= 0 {
+			return h.spaceForward(cmd, code == 0x1, count)
+		}
+		return h.spaceBackward(cmd, code == 0x1, -count)
+	case 0x3:
+		for {
+			kind, length, err := h.next()
+			if err == io.EOF {
+				return cmd.Ok(), nil
+			}
+			if err != nil {
+				return cmd.BackendError(err, false), nil
+			}
+			h.forward(kind, length)
+		}
+	}
+	return cmd.IllegalRequest(), nil
+}
+
+// spaceForward moves over `count` blocks, stopping after a filemark, or over `count` filemarks.
+func (h *TapeCmdHandler) spaceForward(cmd *SCSICmd, filemarks bool, count int32) (SCSIResponse, error) {
+	for done := int32(0); done < count; {
+		kind, length, err := h.next()
+		if err == io.EOF {
+			return cmd.CheckConditionSense(tapeSense(scsi.SenseBlankCheck, scsi.AscEndOfDataDetected, count-done)), nil
+		}
+		if err != nil {
+			return cmd.BackendError(err, false), nil
+		}
+		h.forward(kind, length)
+		switch {
+		case kind == tapeRecordFilemark && !filemarks:
+			s := tapeSense(scsi.SenseNoSense, scsi.AscFilemarkDetected, count-done)
+			s.Filemark = true
+			return cmd.CheckConditionSense(s), nil
+		case kind == tapeRecordFilemark || !filemarks:
+			done++
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+// spaceBackward moves back over `count` blocks, stopping before a filemark, or over `count` filemarks.
+func (h *TapeCmdHandler) spaceBackward(cmd *SCSICmd, filemarks bool, count int32) (SCSIResponse, error) {
+	for done := int32(0); done < count; {
+		if h.atBOT() {
+			s := tapeSense(scsi.SenseNoSense, scsi.AscBeginningOfMediumDetected, count-done)
+			s.EOM = true
+			return cmd.CheckConditionSense(s), nil
+		}
+		kind, err := h.backward()
+		if err != nil {
+			return cmd.BackendError(err, false), nil
+		}
+		switch {
+		case kind == tapeRecordFilemark && !filemarks:
+			s := tapeSense(scsi.SenseNoSense, scsi.AscFilemarkDetected, count-done)
+			s.Filemark = true
+			return cmd.CheckConditionSense(s), nil
+		case kind == tapeRecordFilemark || !filemarks:
+			done++
+		}
+	}
+	return cmd.Ok(), nil
+}
+
+// readPosition handles the short (0x00) and long (0x06) forms of READ POSITION. There is a single
+// partition and no write buffering, so the first and last block locations are always the same.
+func (h *TapeCmdHandler) readPosition(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	flags := byte(0)
+	if h.atBOT() {
+		flags |= 0x80 // BOP
+	}
+	switch cmd.GetCDB(1) & 0x1f {
+	case 0x00:
+		if h.pastEarlyWarning(h.pos) {
+			flags |= 0x04 // BPEW
+		}
+		data := make([]byte, 20)
+		data[0] = flags
+		order.PutUint32(data[4:8], uint32(h.block))
+		order.PutUint32(data[8:12], uint32(h.block))
+		cmd.Write(data)
+	case 0x06:
+		data := make([]byte, 32)
+		data[0] = flags
+		order.PutUint64(data[8:16], h.block)
+		order.PutUint64(data[16:24], h.file)
+		cmd.Write(data)
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// tapeBlockDescriptor is the mode parameter block descriptor, which carries the block size.
+func (h *TapeCmdHandler) tapeBlockDescriptor() []byte {
+	bd := make([]byte, 8)
+	putUint24(bd[5:8], h.blockSize)
+	return bd
+}
+
+func (h *TapeCmdHandler) modeSense(cmd *SCSICmd) (SCSIResponse, error) {
+	dsp := byte(0x10) // buffered mode 1
+	if cmd.Device().WriteProtected() {
+		dsp |= 0x80 // WP
+	}
+	return writeModeSense(cmd, h.tapeBlockDescriptor(), nil, dsp)
+}
+
+// modeSelect accepts a block descriptor, to switch between fixed and variable block mode. Mode pages are
+// ignored.
+func (h *TapeCmdHandler) modeSelect(cmd *SCSICmd) (SCSIResponse, error) {
+	selectTen := cmd.Command() == scsi.ModeSelect10
+	hdrLen, length := 4, int(cmd.GetCDB(4))
+	if selectTen {
+		hdrLen, length = 8, int(binary.BigEndian.Uint16(cmd.cdb[7:9]))
+	}
+	if length == 0 {
+		return cmd.Ok(), nil
+	}
+	// A longer list could not fit in the image header.
+	if length > 4+tapeHeaderSize {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscAuxiliaryMemoryOutOfSpace), nil
+	}
+	buf := make([]byte, length)
+	if n, err := cmd.Read(buf); err != nil || n < length || length < hdrLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	bdLen := int(buf[3])
+	if selectTen {
+		bdLen = int(binary.BigEndian.Uint16(buf[6:8]))
+	}
+	if bdLen == 0 {
+		return cmd.Ok(), nil
+	}
+	if bdLen != 8 || length < hdrLen+bdLen {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+	bd := buf[hdrLen : hdrLen+8]
+	size := uint32(bd[5])<<16 | uint32(bd[6])<<8 | uint32(bd[7])
+	if size > tapeMaxBlockSize {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList), nil
+	}
+	h.blockSize = size
+	return cmd.Ok(), nil
+}
+
+// deviceAttributes are the read-only MAM attributes the drive generates: the remaining and maximum
+// capacity of the partition, in MiB.
+func (h *TapeCmdHandler) deviceAttributes() []TapeAttribute {
+	mib := func(v int64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(v>>20))
+		return b
+	}
+	c := h.tape.Capacity()
+	return []TapeAttribute{
+		{ID: 0x0000, ReadOnly: true, Data: mib(c - h.tape.Used())},
+		{ID: 0x0001, ReadOnly: true, Data: mib(c)},
+	}
+}
+
+// readAttribute handles the ATTRIBUTE VALUES and ATTRIBUTE LIST service actions of READ ATTRIBUTE.
+func (h *TapeCmdHandler) readAttribute(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	if cmd.GetCDB(7) != 0 { // partition
+		return cmd.IllegalRequest(), nil
+	}
+	first := order.Uint16(cmd.cdb[8:10])
+	allocLen := int(order.Uint32(cmd.cdb[10:14]))
+	var attrs []TapeAttribute
+	for _, a := range append(h.deviceAttributes(), h.tape.Attributes()...) {
+		if a.ID >= first {
+			// Only host attributes can be written by the initiator.
+			a.ReadOnly = a.ReadOnly || !hostAttribute(a.ID)
+			attrs = append(attrs, a)
+		}
+	}
+	var body []byte
+	switch cmd.GetCDB(1) & 0x1f {
+	case 0x00: // attribute values
+		body = encodeAttributes(attrs)
+	case 0x01: // attribute list
+		for _, a := range attrs {
+			body = append(body, byte(a.ID>>8), byte(a.ID))
+		}
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	data := make([]byte, 4+len(body))
+	order.PutUint32(data[0:4], uint32(len(body)))
+	copy(data[4:], body)
+	return writeTruncated(cmd, data, allocLen)
+}
+
+func hostAttribute(id uint16) bool {
+	return id >= 0x0800 && id <= 0x0bff
+}
+
+// writeAttribute handles WRITE ATTRIBUTE. Only host attributes that are not read only may be written; an
+// attribute with a length of zero is removed.
+func (h *TapeCmdHandler) writeAttribute(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	if cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	if cmd.GetCDB(7) != 0 { // partition
+		return cmd.IllegalRequest(), nil
+	}
+	length := int(order.Uint32(cmd.cdb[10:14]))
+	if length == 0 {
+		return cmd.Ok(), nil
+	}
+	// A longer list could not fit in the image header.
+	if length > 4+tapeHeaderSize {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscAuxiliaryMemoryOutOfSpace), nil
+	}
+	buf := make([]byte, length)
+	if n, err := cmd.Read(buf); err != nil || n < length || length < 4 {
+		return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscParameterListLengthError), nil
+	}
+	invalid := cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscInvalidFieldInParameterList)
+	existing := make(map[uint16]TapeAttribute)
+	for _, a := range h.tape.Attributes() {
+		existing[a.ID] = a
+	}
+	var attrs []TapeAttribute
+	p := buf[4:]
+	if int(order.Uint32(buf[0:4])) < len(p) {
+		p = p[:order.Uint32(buf[0:4])]
+	}
+	for len(p) > 0 {
+		if len(p) < 5 || len(p) < 5+int(order.Uint16(p[3:5])) {
+			return invalid, nil
+		}
+		n := int(order.Uint16(p[3:5]))
+		a := TapeAttribute{
+			ID:     order.Uint16(p[0:2]),
+			Format: p[2] & 0x03,
+			Data:   append([]byte(nil), p[5:5+n]...),
+		}
+		if !hostAttribute(a.ID) || existing[a.ID].ReadOnly {
+			return invalid, nil
+		}
+		attrs = append(attrs, a)
+		p = p[5+n:]
+	}
+	if err := h.tape.SetAttributes(attrs...); err != nil {
+		if err == errAttributesFull {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscAuxiliaryMemoryOutOfSpace), nil
+		}
+		return cmd.BackendError(err, true), nil
+	}
+	return cmd.Ok(), nil
+}
@@ -0,0 +1,269 @@
+package tcmu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A tape image file starts with a fixed size header holding the capacity, the end of data and the MAM
+// attributes of the cartridge. The records follow, each of them laid out as
+//
+//	kind (1 byte) | length (4 bytes) | data (length bytes) | length (4 bytes)
+//
+// so that the tape can be spaced over in both directions. A filemark is a record of kind 'F' with no data.
+const (
+	tapeHeaderSize     = 4096
+	tapeRecordOverhead = 9
+
+	tapeRecordData     = 'D'
+	tapeRecordFilemark = 'F'
+)
+
+var (
+	tapeMagic = []byte("GOTCMUTP")
+
+	errAttributesFull = errors.New("no room left for tape attributes")
+)
+
+// Attribute formats of a TapeAttribute.
+const (
+	AttrFormatBinary = 0x0
+	AttrFormatASCII  = 0x1
+	AttrFormatText   = 0x2
+)
+
+// TapeAttribute is a Medium Auxiliary Memory (MAM) attribute of a cartridge, as read with READ ATTRIBUTE.
+// Host attributes (0x0800 to 0x0bff) can also be changed with WRITE ATTRIBUTE, unless they are ReadOnly.
+type TapeAttribute struct {
+	ID       uint16
+	Format   byte
+	ReadOnly bool
+	Data     []byte
+}
+
+// TapeImage is a tape cartridge stored in a file.
+type TapeImage struct {
+	mu       sync.Mutex
+	f        *os.File
+	capacity int64
+	// The file offset just past the last record.
+	eod   int64
+	attrs map[uint16]TapeAttribute
+}
+
+// CreateTapeImage creates a blank cartridge at `path` that holds `capacity` bytes of records.
+func CreateTapeImage(path string, capacity int64) (*TapeImage, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := &TapeImage{
+		f:        f,
+		capacity: capacity,
+		eod:      tapeHeaderSize,
+		attrs:    make(map[uint16]TapeAttribute),
+	}
+	if err := t.writeHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// OpenTapeImage opens a cartridge created by CreateTapeImage.
+func OpenTapeImage(path string) (*TapeImage, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTapeHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+func readTapeHeader(f *os.File) (*TapeImage, error) {
+	hdr := make([]byte, tapeHeaderSize)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:8], tapeMagic) {
+		return nil, errors.New("not a tape image")
+	}
+	order := binary.BigEndian
+	t := &TapeImage{
+		f:        f,
+		capacity: int64(order.Uint64(hdr[8:16])),
+		eod:      int64(order.Uint64(hdr[16:24])),
+		attrs:    make(map[uint16]TapeAttribute),
+	}
+	n := order.Uint32(hdr[24:28])
+	if n > tapeHeaderSize-28 {
+		return nil, errors.New("corrupt tape attributes")
+	}
+	attrs := hdr[28 : 28+n]
+	for len(attrs) > 0 {
+		if len(attrs) < 5 || len(attrs) < 5+int(order.Uint16(attrs[3:5])) {
+			return nil, errors.New("corrupt tape attributes")
+		}
+		n := int(order.Uint16(attrs[3:5]))
+		a := TapeAttribute{
+			ID:       order.Uint16(attrs[0:2]),
+			Format:   attrs[2] & 0x03,
+			ReadOnly: attrs[2]&0x80 != 0,
+			Data:     append([]byte(nil), attrs[5:5+n]...),
+		}
+		t.attrs[a.ID] = a
+		attrs = attrs[5+n:]
+	}
+	return t, nil
+}
+
+// writeHeader must be called with mu held, or before the image is shared.
+func (t *TapeImage) writeHeader() error {
+	hdr := make([]byte, tapeHeaderSize)
+	copy(hdr, tapeMagic)
+	order := binary.BigEndian
+	order.PutUint64(hdr[8:16], uint64(t.capacity))
+	order.PutUint64(hdr[16:24], uint64(t.eod))
+	attrs := encodeAttributes(t.sortedAttributes())
+	if 28+len(attrs) > tapeHeaderSize {
+		return errAttributesFull
+	}
+	order.PutUint32(hdr[24:28], uint32(len(attrs)))
+	copy(hdr[28:], attrs)
+	_, err := t.f.WriteAt(hdr, 0)
+	return err
+}
+
+// encodeAttributes lays attributes out as in a READ ATTRIBUTE response, which is also how they are kept in
+// the image header.
+func encodeAttributes(attrs []TapeAttribute) []byte {
+	var buf bytes.Buffer
+	for _, a := range attrs {
+		b := make([]byte, 5)
+		binary.BigEndian.PutUint16(b[0:2], a.ID)
+		b[2] = a.Format & 0x03
+		if a.ReadOnly {
+			b[2] |= 0x80
+		}
+		binary.BigEndian.PutUint16(b[3:5], uint16(len(a.Data)))
+		buf.Write(b)
+		buf.Write(a.Data)
+	}
+	return buf.Bytes()
+}
+
+func (t *TapeImage) sortedAttributes() []TapeAttribute {
+	var out []TapeAttribute
+	for _, a := range t.attrs {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Attributes returns the MAM attributes stored on the cartridge, in order of ID.
+func (t *TapeImage) Attributes() []TapeAttribute {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sortedAttributes()
+}
+
+// SetAttributes stores attributes on the cartridge. An attribute with no data is removed. Either all of
+// them are stored, or none are.
+func (t *TapeImage) SetAttributes(attrs ...TapeAttribute) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := make(map[uint16]TapeAttribute, len(t.attrs))
+	for k, v := range t.attrs {
+		old[k] = v
+	}
+	for _, a := range attrs {
+		if len(a.Data) == 0 {
+			delete(t.attrs, a.ID)
+			continue
+		}
+		t.attrs[a.ID] = a
+	}
+	if err := t.writeHeader(); err != nil {
+		t.attrs = old
+		return err
+	}
+	return nil
+}
+
+// Capacity returns the number of bytes of records the cartridge holds, including the record overhead.
+func (t *TapeImage) Capacity() int64 {
+	return t.capacity
+}
+
+// Used returns the number of bytes of records written to the cartridge.
+func (t *TapeImage) Used() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.eod - tapeHeaderSize
+}
+
+func (t *TapeImage) Close() error {
+	return t.f.Close()
+}
+
+// record returns the kind and data length of the record at `off`. At the end of data it returns io.EOF.
+func (t *TapeImage) record(off int64) (byte, uint32, error) {
+	t.mu.Lock()
+	eod := t.eod
+	t.mu.Unlock()
+	if off >= eod {
+		return 0, 0, io.EOF
+	}
+	hdr := make([]byte, 5)
+	if _, err := t.f.ReadAt(hdr, off); err != nil {
+		return 0, 0, err
+	}
+	return hdr[0], binary.BigEndian.Uint32(hdr[1:5]), nil
+}
+
+// prevRecord returns the offset, kind and length of the record before `off`, which must not be the
+// beginning of the tape.
+func (t *TapeImage) prevRecord(off int64) (int64, byte, uint32, error) {
+	trailer := make([]byte, 4)
+	if _, err := t.f.ReadAt(trailer, off-4); err != nil {
+		return 0, 0, 0, err
+	}
+	length := binary.BigEndian.Uint32(trailer)
+	start := off - tapeRecordOverhead - int64(length)
+	kind, _, err := t.record(start)
+	return start, kind, length, err
+}
+
+// readData reads the data of the record at `off` into `p`, which may be shorter than the record.
+func (t *TapeImage) readData(p []byte, off int64) error {
+	_, err := t.f.ReadAt(p, off+5)
+	return err
+}
+
+// appendRecord writes a record at `off`, which becomes the new end of data: anything after it is lost, as
+// on a real tape.
+func (t *TapeImage) appendRecord(off int64, kind byte, data []byte) error {
+	rec := make([]byte, tapeRecordOverhead+len(data))
+	rec[0] = kind
+	binary.BigEndian.PutUint32(rec[1:5], uint32(len(data)))
+	copy(rec[5:], data)
+	binary.BigEndian.PutUint32(rec[5+len(data):], uint32(len(data)))
+	if _, err := t.f.WriteAt(rec, off); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.eod = off + int64(len(rec))
+	return t.writeHeader()
+}
@@ -0,0 +1,210 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+// Bits of byte 2 of fixed format sense data.
+const (
+	senseFilemark = 0x80
+	senseEOM      = 0x40
+	senseILI      = 0x20
+)
+
+func tapeCDB(op, flags byte, count int32) []byte {
+	return []byte{op, flags, byte(count >> 16), byte(count >> 8), byte(count), 0}
+}
+
+// runTape sends a command to the tape drive, with `out` as its data out, or with room for `in` bytes of
+// data in.
+func runTape(t *testing.T, d *Device, h *TapeCmdHandler, cdb []byte, out []byte, in int) (*SCSICmd, SCSIResponse) {
+	cmd := newTestCmd(d, cdb, out, in)
+	resp, err := h.HandleCommand(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd, resp
+}
+
+// tapePosition returns the block and file numbers READ POSITION reports in its long form.
+func tapePosition(t *testing.T, d *Device, h *TapeCmdHandler) (uint64, uint64) {
+	cdb := make([]byte, 10)
+	cdb[0] = scsi.ReadPosition
+	cdb[1] = 0x06
+	cmd, resp := runTape(t, d, h, cdb, nil, 32)
+	if k, asc := senseOf(resp); k != 0 {
+		t.Fatalf("READ POSITION: sense key 0x%x asc 0x%04x", k, asc)
+	}
+	data := dataIn(cmd)
+	return binary.BigEndian.Uint64(data[8:16]), binary.BigEndian.Uint64(data[16:24])
+}
+
+// newTapeTest returns a drive holding a cartridge with records of 100 and 200 bytes, a filemark and a
+// record of 300 bytes, written through the drive and read back from the image file.
+func newTapeTest(t *testing.T) (*Device, *TapeCmdHandler, string) {
+	path := filepath.Join(t.TempDir(), "tape"+CartridgeExt)
+	tape, err := CreateTapeImage(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDevice(1<<20, 512)
+	h := NewTapeCmdHandler(tape)
+	for _, n := range []int32{100, 200, -1, 300} {
+		var resp SCSIResponse
+		if n < 0 {
+			_, resp = runTape(t, d, h, tapeCDB(scsi.WriteFilemarks, 0, 1), nil, 0)
+		} else {
+			_, resp = runTape(t, d, h, tapeCDB(scsi.Write6, 0, n), make([]byte, n), 0)
+		}
+		if k, asc := senseOf(resp); k != 0 {
+			t.Fatalf("write: sense key 0x%x asc 0x%04x", k, asc)
+		}
+	}
+	h.Unload().Close()
+	if tape, err = OpenTapeImage(path); err != nil {
+		t.Fatal(err)
+	}
+	h.Load(tape)
+	return d, h, path
+}
+
+func TestTapeFilemarksAndEOD(t *testing.T) {
+	type step struct {
+		cdb []byte
+		in  int
+	}
+	read := func(n int32) step { return step{tapeCDB(scsi.Read6, 0, n), int(n)} }
+	space := func(code byte, n int32) step { return step{tapeCDB(scsi.Space, code, n), 0} }
+	const (
+		spaceBlocks    = 0x0
+		spaceFilemarks = 0x1
+		spaceEOD       = 0x3
+	)
+	tests := []struct {
+		name string
+		// Commands that must succeed, and the command tested.
+		before []step
+		cmd    step
+		key    byte
+		asc    uint16
+		bits   byte
+		// The INFORMATION field, and the position afterwards.
+		info        int32
+		block, file uint64
+	}{
+		{
+			name: "read a record", cmd: read(100),
+			block: 1,
+		},
+		{
+			name: "read a short record", cmd: read(150),
+			bits: senseILI, info: 50, block: 1,
+		},
+		{
+			name: "read a filemark", before: []step{read(100), read(200)}, cmd: read(150),
+			asc: scsi.AscFilemarkDetected, bits: senseFilemark, info: 150, block: 3, file: 1,
+		},
+		{
+			name: "read at the end of data", before: []step{space(spaceEOD, 0)}, cmd: read(150),
+			key: scsi.SenseBlankCheck, asc: scsi.AscEndOfDataDetected, info: 150, block: 4, file: 1,
+		},
+		{
+			name: "space blocks stops after a filemark", cmd: space(spaceBlocks, 5),
+			asc: scsi.AscFilemarkDetected, bits: senseFilemark, info: 3, block: 3, file: 1,
+		},
+		{
+			name: "space filemarks to the end of data", cmd: space(spaceFilemarks, 2),
+			key: scsi.SenseBlankCheck, asc: scsi.AscEndOfDataDetected, info: 1, block: 4, file: 1,
+		},
+		{
+			name: "space to the end of data", cmd: space(spaceEOD, 0),
+			block: 4, file: 1,
+		},
+		{
+			name: "space back over a filemark", before: []step{space(spaceEOD, 0)}, cmd: space(spaceFilemarks, -1),
+			block: 2,
+		},
+		{
+			name: "space back blocks stops before a filemark", before: []step{space(spaceEOD, 0)}, cmd: space(spaceBlocks, -3),
+			asc: scsi.AscFilemarkDetected, bits: senseFilemark, info: 2, block: 2,
+		},
+		{
+			name: "space back to the beginning", before: []step{read(100)}, cmd: space(spaceBlocks, -3),
+			asc: scsi.AscBeginningOfMediumDetected, bits: senseEOM, info: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, h, _ := newTapeTest(t)
+			for _, s := range tt.before {
+				if _, resp := runTape(t, d, h, s.cdb, nil, s.in); resp.status != scsi.SamStatGood {
+					k, asc := senseOf(resp)
+					t.Fatalf("% x: sense key 0x%x asc 0x%04x", s.cdb, k, asc)
+				}
+			}
+			_, resp := runTape(t, d, h, tt.cmd.cdb, nil, tt.cmd.in)
+			k, asc := senseOf(resp)
+			var bits byte
+			var info int32
+			if resp.status != scsi.SamStatGood {
+				bits = resp.senseBuffer[2] & 0xe0
+				info = int32(binary.BigEndian.Uint32(resp.senseBuffer[3:7]))
+			}
+			if k != tt.key || asc != tt.asc || bits != tt.bits || info != tt.info {
+				t.Errorf("sense key 0x%x asc 0x%04x bits 0x%x info %d, want 0x%x 0x%04x 0x%x %d",
+					k, asc, bits, info, tt.key, tt.asc, tt.bits, tt.info)
+			}
+			if block, file := tapePosition(t, d, h); block != tt.block || file != tt.file {
+				t.Errorf("block %d file %d, want %d %d", block, file, tt.block, tt.file)
+			}
+		})
+	}
+}
+
+func TestTapeWriteFilemarksAtEOD(t *testing.T) {
+	d, h, path := newTapeTest(t)
+	if _, resp := runTape(t, d, h, tapeCDB(scsi.Space, 0x3, 0), nil, 0); resp.status != scsi.SamStatGood {
+		t.Fatal("SPACE to the end of data failed")
+	}
+	if _, resp := runTape(t, d, h, tapeCDB(scsi.WriteFilemarks, 0, 2), nil, 0); resp.status != scsi.SamStatGood {
+		t.Fatal("WRITE FILEMARKS failed")
+	}
+	if block, file := tapePosition(t, d, h); block != 6 || file != 3 {
+		t.Fatalf("block %d file %d after WRITE FILEMARKS", block, file)
+	}
+
+	// The filemarks are in the image, and the end of data follows them.
+	h.Unload().Close()
+	tape, err := OpenTapeImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Load(tape)
+	if _, resp := runTape(t, d, h, tapeCDB(scsi.Space, 0x1, 3), nil, 0); resp.status != scsi.SamStatGood {
+		k, asc := senseOf(resp)
+		t.Fatalf("SPACE 3 filemarks: sense key 0x%x asc 0x%04x", k, asc)
+	}
+	_, resp := runTape(t, d, h, tapeCDB(scsi.Read6, 0, 10), nil, 10)
+	if k, asc := senseOf(resp); k != scsi.SenseBlankCheck || asc != scsi.AscEndOfDataDetected {
+		t.Errorf("read past the filemarks: sense key 0x%x asc 0x%04x", k, asc)
+	}
+	if block, file := tapePosition(t, d, h); block != 6 || file != 3 {
+		t.Errorf("block %d file %d at the end of data", block, file)
+	}
+}
+
+func TestTapeWriteAttributeTooLong(t *testing.T) {
+	d, h, _ := newTapeTest(t)
+	n := 4 + tapeHeaderSize + 1
+	cdb := make([]byte, 16)
+	cdb[0] = scsi.WriteAttribute
+	binary.BigEndian.PutUint32(cdb[10:14], uint32(n))
+	_, resp := runTape(t, d, h, cdb, make([]byte, n), 0)
+	if k, asc := senseOf(resp); k != scsi.SenseIllegalRequest || asc != scsi.AscAuxiliaryMemoryOutOfSpace {
+		t.Errorf("sense key 0x%x asc 0x%04x", k, asc)
+	}
+}
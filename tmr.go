@@ -0,0 +1,113 @@
+package tcmu
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// TMRFunction is a task management function, as the kernel reports it.
+type TMRFunction byte
+
+const (
+	TMRUnknown         TMRFunction = 0
+	TMRAbortTask       TMRFunction = 1
+	TMRAbortTaskSet    TMRFunction = 2
+	TMRClearACA        TMRFunction = 3
+	TMRClearTaskSet    TMRFunction = 4
+	TMRLUNReset        TMRFunction = 5
+	TMRTargetWarmReset TMRFunction = 6
+	TMRTargetColdReset TMRFunction = 7
+	// A LUN RESET asked for by the persistent reservations code.
+	TMRLUNResetPro TMRFunction = 128
+)
+
+var tmrFunctionNames = map[TMRFunction]string{
+	TMRUnknown:         "UNKNOWN",
+	TMRAbortTask:       "ABORT TASK",
+	TMRAbortTaskSet:    "ABORT TASK SET",
+	TMRClearACA:        "CLEAR ACA",
+	TMRClearTaskSet:    "CLEAR TASK SET",
+	TMRLUNReset:        "LUN RESET",
+	TMRTargetWarmReset: "TARGET WARM RESET",
+	TMRTargetColdReset: "TARGET COLD RESET",
+	TMRLUNResetPro:     "LUN RESET (PR)",
+}
+
+func (f TMRFunction) String() string {
+	if s, ok := tmrFunctionNames[f]; ok {
+		return s
+	}
+	return fmt.Sprintf("TMR 0x%x", byte(f))
+}
+
+// Reset reports whether the function resets the logical unit.
+func (f TMRFunction) Reset() bool {
+	switch f {
+	case TMRLUNReset, TMRLUNResetPro, TMRTargetWarmReset, TMRTargetColdReset:
+		return true
+	}
+	return false
+}
+
+// TaskManagement is a task management function carried out by the kernel, with the IDs (see SCSICmd.ID) of
+// the commands it aborted that the device was still working on.
+type TaskManagement struct {
+	Function   TMRFunction
+	CommandIDs []uint16
+}
+
+// TaskManagementFunc is told about a task management function, once the contexts of the aborted commands
+// have been cancelled. A reset should also drop any reservations the handler keeps. It is called from the
+// goroutine reading the ring, so it must not block.
+//
+// The kernel still expects a response to each aborted command, though it discards it.
+type TaskManagementFunc func(d *Device, tmr TaskManagement)
+
+// beginCommand gives a command fetched from the ring a context, cancelled if the command is aborted.
+func (d *Device) beginCommand(cmd *SCSICmd) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd.ctx = ctx
+	d.mu.Lock()
+	d.inflight[cmd.id] = cancel
+	d.mu.Unlock()
+}
+
+// endCommand releases the context of a command once its response is on its way to the kernel.
+func (d *Device) endCommand(id uint16) {
+	d.mu.Lock()
+	cancel := d.inflight[id]
+	delete(d.inflight, id)
+	d.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// handleTMR carries out a task management entry from the ring: it cancels the commands aborted, resets the
+// unit attention conditions on a reset, and notifies the SCSIHandler.
+func (d *Device) handleTMR(off int) {
+	tmr := TaskManagement{
+		Function:   TMRFunction(d.entTmrType(off)),
+		CommandIDs: d.entTmrCmdIds(off),
+	}
+	log.Debugf("%s aborting commands %v\n", tmr.Function, tmr.CommandIDs)
+	d.mu.Lock()
+	for _, id := range tmr.CommandIDs {
+		if cancel, ok := d.inflight[id]; ok {
+			cancel()
+		}
+	}
+	if tmr.Function.Reset() {
+		d.unitAttentions = nil
+	}
+	d.mu.Unlock()
+	if tmr.Function.Reset() {
+		d.RaiseUnitAttention(scsi.AscBusDeviceResetFunctionOccurred)
+	}
+	if d.scsi.TaskManagement != nil {
+		d.scsi.TaskManagement(d, tmr)
+	}
+}
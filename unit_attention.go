@@ -0,0 +1,41 @@
+package tcmu
+
+import (
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+// RaiseUnitAttention establishes a unit attention condition with the given additional sense code. It is
+// reported to the initiator in place of the next command that is not exempt from unit attentions, after
+// which it is cleared. Conditions are reported oldest first, and raising one already pending is a no-op.
+func (d *Device) RaiseUnitAttention(asc uint16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range d.unitAttentions {
+		if a == asc {
+			return
+		}
+	}
+	d.unitAttentions = append(d.unitAttentions, asc)
+}
+
+// pendingUnitAttention pops the oldest unit attention condition, returning the response that reports it in
+// place of `cmd`. It returns false if there is none, or `cmd` is exempt (SPC-4 5.14, and GET EVENT STATUS
+// NOTIFICATION on MMC devices).
+func (d *Device) pendingUnitAttention(cmd *SCSICmd) (SCSIResponse, bool) {
+	switch cmd.Command() {
+	case scsi.Inquiry, scsi.ReportLuns, scsi.RequestSense:
+		return SCSIResponse{}, false
+	case scsi.GetEventStatusNotification:
+		if d.scsi.mmc {
+			return SCSIResponse{}, false
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.unitAttentions) == 0 {
+		return SCSIResponse{}, false
+	}
+	asc := d.unitAttentions[0]
+	d.unitAttentions = d.unitAttentions[1:]
+	return cmd.CheckCondition(scsi.SenseUnitAttention, asc), true
+}
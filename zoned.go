@@ -0,0 +1,644 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+	"github.com/prometheus/common/log"
+)
+
+// ZoneType is the type of a zone of a zoned block device (ZBC).
+type ZoneType uint8
+
+const (
+	ZoneTypeConventional      ZoneType = 0x1
+	ZoneTypeSeqWriteRequired  ZoneType = 0x2
+	ZoneTypeSeqWritePreferred ZoneType = 0x3
+)
+
+// reportNotWP is the REPORT ZONES reporting option selecting zones without a write pointer.
+const reportNotWP = 0x3f
+
+// ZoneCondition is the state of a zone of a zoned block device.
+type ZoneCondition uint8
+
+const (
+	ZoneCondNotWP        ZoneCondition = 0x0
+	ZoneCondEmpty        ZoneCondition = 0x1
+	ZoneCondImplicitOpen ZoneCondition = 0x2
+	ZoneCondExplicitOpen ZoneCondition = 0x3
+	ZoneCondClosed       ZoneCondition = 0x4
+	ZoneCondReadOnly     ZoneCondition = 0xd
+	ZoneCondFull         ZoneCondition = 0xe
+	ZoneCondOffline      ZoneCondition = 0xf
+)
+
+// Zone is the state of a single zone. Start, Length and WritePointer are in logical blocks.
+type Zone struct {
+	Start        uint64        `json:"start"`
+	Length       uint64        `json:"length"`
+	Type         ZoneType      `json:"type"`
+	Condition    ZoneCondition `json:"condition"`
+	WritePointer uint64        `json:"write_pointer"`
+	// Set once a sequential write preferred zone has been written out of order.
+	NonSeq bool `json:"non_seq,omitempty"`
+}
+
+func (z *Zone) end() uint64 {
+	return z.Start + z.Length
+}
+
+func (z *Zone) sequential() bool {
+	return z.Type != ZoneTypeConventional
+}
+
+func (z *Zone) open() bool {
+	return z.Condition == ZoneCondImplicitOpen || z.Condition == ZoneCondExplicitOpen
+}
+
+// ZonedConfig describes the zone layout of a ZonedCmdHandler.
+type ZonedConfig struct {
+	// The size of the device, which must match the SCSIHandler.
+	Sizes DataSizes
+	// The size of every zone, in logical blocks. The last zone may be smaller.
+	ZoneBlocks uint64
+	// The number of conventional (randomly writable) zones at the start of the device.
+	ConventionalZones int
+	// Emulate a host-managed device (peripheral type 0x14) with sequential
+	// write required zones. Otherwise the device is host-aware, with
+	// sequential write preferred zones.
+	HostManaged bool
+	// The maximum number of open sequential zones. Zero means no limit.
+	MaxOpenZones int
+	// The sidecar file holding zone conditions and write pointers. It is
+	// created if it does not exist, and rewritten whenever a zone changes
+	// condition, so the write pointers of open zones it holds may lag
+	// behind the writes to them.
+	StatePath string
+}
+
+// ZonedCmdHandler emulates a ZBC zoned block device on top of a ReadWriterAt. It tracks zone conditions and
+// write pointers, enforces the sequential write rules, and answers the zone management commands.
+type ZonedCmdHandler struct {
+	RW  ReadWriterAt
+	Inq *InquiryInfo
+
+	conf  ZonedConfig
+	mu    sync.Mutex
+	zones []Zone
+}
+
+type zoneState struct {
+	Zones []Zone `json:"zones"`
+}
+
+// NewZonedCmdHandler creates a zoned handler, restoring the zone state from conf.StatePath if it exists.
+func NewZonedCmdHandler(rw ReadWriterAt, conf ZonedConfig) (*ZonedCmdHandler, error) {
+	if conf.ZoneBlocks == 0 {
+		return nil, fmt.Errorf("zone size must not be zero")
+	}
+	h := &ZonedCmdHandler{
+		RW:   rw,
+		conf: conf,
+	}
+	data, err := ioutil.ReadFile(conf.StatePath)
+	if os.IsNotExist(err) {
+		h.zones = h.initialZones()
+		return h, h.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state zoneState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Invalid zone state in %s: %v", conf.StatePath, err)
+	}
+	want := h.initialZones()
+	if len(state.Zones) != len(want) {
+		return nil, fmt.Errorf("Zone state in %s has %d zones, expected %d", conf.StatePath, len(state.Zones), len(want))
+	}
+	for i := range want {
+		if state.Zones[i].Start != want[i].Start || state.Zones[i].Length != want[i].Length || state.Zones[i].Type != want[i].Type {
+			return nil, fmt.Errorf("Zone state in %s does not match the zone layout at zone %d", conf.StatePath, i)
+		}
+	}
+	h.zones = state.Zones
+	return h, nil
+}
+
+// ZonedSCSIHandler is BasicSCSIHandler for a zoned device.
+func ZonedSCSIHandler(rw ReadWriterAt, conf ZonedConfig) (*SCSIHandler, error) {
+	z, err := NewZonedCmdHandler(rw, conf)
+	if err != nil {
+		return nil, err
+	}
+	h := BasicSCSIHandler(rw)
+	h.DataSizes = conf.Sizes
+	h.DevReady = MultiThreadedDevReady(z, 2)
+	return h, nil
+}
+
+func (h *ZonedCmdHandler) initialZones() []Zone {
+	nblocks := uint64(h.conf.Sizes.VolumeSize / h.conf.Sizes.BlockSize)
+	var zones []Zone
+	for start := uint64(0); start < nblocks; start += h.conf.ZoneBlocks {
+		z := Zone{
+			Start:  start,
+			Length: h.conf.ZoneBlocks,
+		}
+		if z.end() > nblocks {
+			z.Length = nblocks - start
+		}
+		switch {
+		case len(zones) < h.conf.ConventionalZones:
+			z.Type = ZoneTypeConventional
+			z.Condition = ZoneCondNotWP
+		case h.conf.HostManaged:
+			z.Type = ZoneTypeSeqWriteRequired
+			z.Condition = ZoneCondEmpty
+		default:
+			z.Type = ZoneTypeSeqWritePreferred
+			z.Condition = ZoneCondEmpty
+		}
+		z.WritePointer = start
+		zones = append(zones, z)
+	}
+	return zones
+}
+
+// Zones returns a snapshot of the state of every zone.
+func (h *ZonedCmdHandler) Zones() []Zone {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Zone(nil), h.zones...)
+}
+
+// save writes the zone state to the sidecar file. Must be called with mu held, or before the handler is used.
+func (h *ZonedCmdHandler) save() error {
+	data, err := json.Marshal(zoneState{Zones: h.zones})
+	if err != nil {
+		return err
+	}
+	tmp := h.conf.StatePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.conf.StatePath)
+}
+
+// zoneIndex returns the index of the zone holding `lba`.
+func (h *ZonedCmdHandler) zoneIndex(lba uint64) int {
+	i := int(lba / h.conf.ZoneBlocks)
+	if i >= len(h.zones) {
+		return len(h.zones) - 1
+	}
+	return i
+}
+
+func (h *ZonedCmdHandler) openZones() int {
+	n := 0
+	for i := range h.zones {
+		if h.zones[i].open() {
+			n++
+		}
+	}
+	return n
+}
+
+// makeRoom ensures another zone can be opened, implicitly closing an implicitly open zone outside
+// `keep` if that is what it takes. Must be called with mu held.
+func (h *ZonedCmdHandler) makeRoom(keep ...int) bool {
+	if h.conf.MaxOpenZones == 0 || h.openZones() < h.conf.MaxOpenZones {
+		return true
+	}
+next:
+	for i := range h.zones {
+		for _, k := range keep {
+			if i == k {
+				continue next
+			}
+		}
+		if h.zones[i].Condition == ZoneCondImplicitOpen {
+			h.closeZone(&h.zones[i])
+			return true
+		}
+	}
+	return false
+}
+
+func (h *ZonedCmdHandler) closeZone(z *Zone) {
+	if z.WritePointer == z.Start {
+		z.Condition = ZoneCondEmpty
+	} else {
+		z.Condition = ZoneCondClosed
+	}
+}
+
+func (h *ZonedCmdHandler) inquiry() *InquiryInfo {
+	inq := defaultInquiry
+	if h.Inq != nil {
+		inq = *h.Inq
+	}
+	if h.conf.HostManaged {
+		inq.DeviceType = scsi.TypeZbc
+	}
+	pages := map[byte]VPDPageFunc{
+		0xb1: h.blockDeviceCharacteristicsVPD,
+		0xb6: h.zonedCharacteristicsVPD,
+	}
+	for k, v := range inq.VPDPages {
+		pages[k] = v
+	}
+	inq.VPDPages = pages
+	return &inq
+}
+
+func (h *ZonedCmdHandler) HandleCommand(cmd *SCSICmd) (SCSIResponse, error) {
+	if resp, ok := checkALUAState(cmd); !ok {
+		return resp, nil
+	}
+	if isWriteCommand(cmd) && cmd.Device().WriteProtected() {
+		return cmd.DataProtect(), nil
+	}
+	switch cmd.Command() {
+	case scsi.Inquiry:
+		return EmulateInquiry(cmd, h.inquiry())
+	case scsi.TestUnitReady:
+		return EmulateTestUnitReady(cmd)
+	case scsi.ServiceActionIn16:
+		return EmulateServiceActionIn(cmd)
+	case scsi.ModeSense, scsi.ModeSense10:
+		return EmulateModeSense(cmd, false)
+	case scsi.ModeSelect, scsi.ModeSelect10:
+		return EmulateModeSelect(cmd, false)
+	case scsi.Read6, scsi.Read10, scsi.Read12, scsi.Read16:
+		return EmulateRead(cmd, h.RW)
+	case scsi.Write6, scsi.Write10, scsi.Write12, scsi.Write16:
+		return h.write(cmd, EmulateWrite)
+	case scsi.WriteSame, scsi.WriteSame16:
+		return h.write(cmd, EmulateWriteSame)
+	case scsi.Verify, scsi.Verify12, scsi.Verify16:
+		return EmulateVerify(cmd, h.RW)
+	case scsi.VariableLengthCmd:
+		if cmd.CdbLen() != 32 {
+			return cmd.IllegalRequest(), nil
+		}
+		switch cmd.ServiceAction() {
+		case scsi.Read32:
+			return EmulateRead(cmd, h.RW)
+		case scsi.Write32:
+			return h.write(cmd, EmulateWrite)
+		case scsi.WriteSame32:
+			return h.write(cmd, EmulateWriteSame)
+		case scsi.Verify32:
+			return EmulateVerify(cmd, h.RW)
+		}
+		log.Debugf("Ignore unknown variable length service action 0x%x\n", cmd.ServiceAction())
+	case scsi.ZbcIn:
+		if cmd.GetCDB(1)&0x1f == scsi.ZiReportZones {
+			return h.reportZones(cmd)
+		}
+		return cmd.IllegalRequest(), nil
+	case scsi.ZbcOut:
+		return h.zoneAction(cmd)
+	default:
+		log.Debugf("Ignore unknown SCSI command 0x%x\n", cmd.Command())
+	}
+	return cmd.NotHandled(), nil
+}
+
+// write checks a WRITE or WRITE SAME against the zone rules, performs it with `do`, and moves the write
+// pointers along. Writes are serialised, so that the write pointer check and the write itself cannot be
+// interleaved.
+func (h *ZonedCmdHandler) write(cmd *SCSICmd, do func(*SCSICmd, io.WriterAt) (SCSIResponse, error)) (SCSIResponse, error) {
+	lba := cmd.LBA()
+	blocks := uint64(xferBlocks(cmd))
+	if !cmd.Device().Sizes().InRange(lba, uint32(blocks)) {
+		return cmd.LBAOutOfRange(), nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	first := h.zoneIndex(lba)
+	last := first
+	if blocks > 0 {
+		last = h.zoneIndex(lba + blocks - 1)
+	}
+	for i := first; i <= last; i++ {
+		z := &h.zones[i]
+		switch z.Condition {
+		case ZoneCondOffline:
+			return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscZoneIsOffline), nil
+		case ZoneCondReadOnly:
+			return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscZoneIsReadOnly), nil
+		}
+		if z.Type != ZoneTypeSeqWriteRequired {
+			continue
+		}
+		if first != last {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscWriteBoundaryViolation), nil
+		}
+		if z.Condition == ZoneCondFull || lba != z.WritePointer {
+			return cmd.CheckCondition(scsi.SenseIllegalRequest, scsi.AscUnalignedWriteCommand), nil
+		}
+	}
+	// Open the zones as they are checked, so that every one of them counts
+	// against MaxOpenZones. Zones other than these may be closed to make
+	// room, and stay closed if the write fails.
+	before := make([]Zone, len(h.zones))
+	copy(before, h.zones)
+	var opened []int
+	undo := func() {
+		for _, i := range opened {
+			h.closeZone(&h.zones[i])
+		}
+	}
+	for i := first; i <= last; i++ {
+		z := &h.zones[i]
+		if !z.sequential() || z.open() {
+			continue
+		}
+		if !h.makeRoom(opened...) {
+			undo()
+			h.saveIfChanged(before)
+			return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscInsufficientZoneResources), nil
+		}
+		z.Condition = ZoneCondImplicitOpen
+		opened = append(opened, i)
+	}
+
+	if resp, ok := cmd.aborted(true); ok {
+		undo()
+		h.saveIfChanged(before)
+		return resp, nil
+	}
+	resp, err := do(cmd, h.RW)
+	if err != nil || resp.status != scsi.SamStatGood {
+		undo()
+		h.saveIfChanged(before)
+		return resp, err
+	}
+
+	end := lba + blocks
+	for i := first; i <= last; i++ {
+		z := &h.zones[i]
+		if !z.sequential() {
+			continue
+		}
+		start := lba
+		if start < z.Start {
+			start = z.Start
+		}
+		if start != z.WritePointer {
+			z.NonSeq = true
+		}
+		zend := end
+		if zend > z.end() {
+			zend = z.end()
+		}
+		if zend > z.WritePointer {
+			z.WritePointer = zend
+		}
+		if z.WritePointer == z.end() {
+			z.Condition = ZoneCondFull
+		}
+	}
+	if err := h.saveIfChanged(before); err != nil {
+		return cmd.TargetFailure(), nil
+	}
+	return resp, nil
+}
+
+// saveIfChanged saves the zone state if any zone has changed condition since `before`. Must be called
+// with mu held.
+func (h *ZonedCmdHandler) saveIfChanged(before []Zone) error {
+	for i := range h.zones {
+		if h.zones[i].Condition != before[i].Condition {
+			err := h.save()
+			if err != nil {
+				log.Errorf("failed to save zone state: %v", err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneAction handles the ZBC OUT service actions: CLOSE, FINISH and OPEN ZONE, and RESET WRITE POINTER.
+func (h *ZonedCmdHandler) zoneAction(cmd *SCSICmd) (SCSIResponse, error) {
+	action := cmd.GetCDB(1) & 0x1f
+	switch action {
+	case scsi.ZoCloseZone, scsi.ZoFinishZone, scsi.ZoOpenZone, scsi.ZoResetWritePointer:
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+	if cmd.Device().WriteProtected() && action != scsi.ZoCloseZone {
+		return cmd.DataProtect(), nil
+	}
+	all := cmd.GetCDB(14)&0x01 != 0
+	id := binary.BigEndian.Uint64(cmd.cdb[2:10])
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var targets []*Zone
+	if all {
+		for i := range h.zones {
+			if h.zones[i].sequential() {
+				targets = append(targets, &h.zones[i])
+			}
+		}
+	} else {
+		if id >= uint64(cmd.Device().Sizes().VolumeSize/cmd.Device().Sizes().BlockSize) {
+			return cmd.LBAOutOfRange(), nil
+		}
+		z := &h.zones[h.zoneIndex(id)]
+		if z.Start != id || !z.sequential() {
+			return cmd.IllegalRequest(), nil
+		}
+		switch z.Condition {
+		case ZoneCondOffline:
+			return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscZoneIsOffline), nil
+		case ZoneCondReadOnly:
+			return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscZoneIsReadOnly), nil
+		}
+		targets = []*Zone{z}
+	}
+
+	for _, z := range targets {
+		switch action {
+		case scsi.ZoOpenZone:
+			// With ALL set, only closed zones are opened.
+			if z.Condition == ZoneCondClosed || (!all && (z.Condition == ZoneCondEmpty || z.Condition == ZoneCondImplicitOpen)) {
+				if z.Condition != ZoneCondImplicitOpen && !h.makeRoom() {
+					return cmd.CheckCondition(scsi.SenseDataProtect, scsi.AscInsufficientZoneResources), nil
+				}
+				z.Condition = ZoneCondExplicitOpen
+			}
+		case scsi.ZoCloseZone:
+			if z.open() {
+				h.closeZone(z)
+			}
+		case scsi.ZoFinishZone:
+			switch z.Condition {
+			case ZoneCondEmpty, ZoneCondImplicitOpen, ZoneCondExplicitOpen, ZoneCondClosed:
+				if all && z.Condition == ZoneCondEmpty {
+					continue
+				}
+				z.Condition = ZoneCondFull
+				z.WritePointer = z.end()
+			}
+		case scsi.ZoResetWritePointer:
+			switch z.Condition {
+			case ZoneCondReadOnly, ZoneCondOffline:
+				continue
+			}
+			z.Condition = ZoneCondEmpty
+			z.WritePointer = z.Start
+			z.NonSeq = false
+		}
+	}
+	if err := h.save(); err != nil {
+		log.Errorf("failed to save zone state: %v", err)
+		return cmd.TargetFailure(), nil
+	}
+	return cmd.Ok(), nil
+}
+
+// zoneMatches implements the REPORTING OPTIONS filter of REPORT ZONES.
+func zoneMatches(z *Zone, opt byte) bool {
+	switch opt {
+	case 0x00:
+		return true
+	case 0x01:
+		return z.Condition == ZoneCondEmpty
+	case 0x02:
+		return z.Condition == ZoneCondImplicitOpen
+	case 0x03:
+		return z.Condition == ZoneCondExplicitOpen
+	case 0x04:
+		return z.Condition == ZoneCondClosed
+	case 0x05:
+		return z.Condition == ZoneCondFull
+	case 0x06:
+		return z.Condition == ZoneCondReadOnly
+	case 0x07:
+		return z.Condition == ZoneCondOffline
+	case 0x10:
+		// RWP RECOMMENDED is never set.
+		return false
+	case 0x11:
+		return z.NonSeq
+	case reportNotWP:
+		return z.Condition == ZoneCondNotWP
+	}
+	return false
+}
+
+func (h *ZonedCmdHandler) reportZones(cmd *SCSICmd) (SCSIResponse, error) {
+	order := binary.BigEndian
+	start := order.Uint64(cmd.cdb[2:10])
+	allocLen := int(order.Uint32(cmd.cdb[10:14]))
+	partial := cmd.GetCDB(14)&0x80 != 0
+	opt := cmd.GetCDB(14) & 0x3f
+	nblocks := uint64(cmd.Device().Sizes().VolumeSize / cmd.Device().Sizes().BlockSize)
+	if start >= nblocks {
+		return cmd.LBAOutOfRange(), nil
+	}
+	switch opt {
+	case 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x10, 0x11, reportNotWP:
+	default:
+		return cmd.IllegalRequest(), nil
+	}
+
+	h.mu.Lock()
+	var descs []byte
+	matched := 0
+	for i := h.zoneIndex(start); i < len(h.zones); i++ {
+		z := &h.zones[i]
+		if !zoneMatches(z, opt) {
+			continue
+		}
+		matched++
+		if partial && 64+len(descs)+64 > allocLen {
+			break
+		}
+		d := make([]byte, 64)
+		d[0] = byte(z.Type) & 0x0f
+		d[1] = byte(z.Condition) << 4
+		if z.NonSeq {
+			d[1] |= 0x02
+		}
+		order.PutUint64(d[8:16], z.Length)
+		order.PutUint64(d[16:24], z.Start)
+		wp := z.WritePointer
+		if !z.sequential() || z.Condition == ZoneCondFull || z.Condition == ZoneCondReadOnly || z.Condition == ZoneCondOffline {
+			wp = ^uint64(0) // invalid
+		}
+		order.PutUint64(d[24:32], wp)
+		descs = append(descs, d...)
+	}
+	h.mu.Unlock()
+
+	hdr := make([]byte, 64)
+	listLen := matched * 64
+	if partial {
+		listLen = len(descs)
+	}
+	order.PutUint32(hdr[0:4], uint32(listLen))
+	order.PutUint64(hdr[8:16], nblocks-1)
+	return writeTruncated(cmd, append(hdr, descs...), allocLen)
+}
+
+// blockDeviceCharacteristicsVPD builds the Block Device Characteristics VPD page (0xb1).
+func (h *ZonedCmdHandler) blockDeviceCharacteristicsVPD(cmd *SCSICmd, inq *InquiryInfo) []byte {
+	data := make([]byte, 64)
+	data[0] = inq.peripheral()
+	data[1] = 0xb1
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)-4))
+	binary.BigEndian.PutUint16(data[4:6], 0x0001) // non-rotating medium
+	if !h.conf.HostManaged {
+		data[8] = 0x01 << 4 // ZONED: host aware
+	}
+	return data
+}
+
+// zonedCharacteristicsVPD builds the Zoned Block Device Characteristics VPD page (0xb6).
+func (h *ZonedCmdHandler) zonedCharacteristicsVPD(cmd *SCSICmd, inq *InquiryInfo) []byte {
+	order := binary.BigEndian
+	data := make([]byte, 64)
+	data[0] = inq.peripheral()
+	data[1] = 0xb6
+	order.PutUint16(data[2:4], uint16(len(data)-4))
+	data[4] = 0x01              // URSWRZ: reads are not restricted by write pointers
+	limit := uint32(0xffffffff) // not reported
+	if h.conf.MaxOpenZones > 0 {
+		limit = uint32(h.conf.MaxOpenZones)
+	}
+	if h.conf.HostManaged {
+		order.PutUint32(data[8:12], 0xffffffff)
+		order.PutUint32(data[12:16], 0xffffffff)
+		order.PutUint32(data[16:20], limit)
+	} else {
+		order.PutUint32(data[8:12], limit)
+		order.PutUint32(data[12:16], 0xffffffff)
+	}
+	return data
+}
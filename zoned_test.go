@@ -0,0 +1,179 @@
+package tcmu
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alternative-storage/go-tcmu/scsi"
+)
+
+// A conventional zone followed by four sequential zones of 16 blocks.
+const (
+	zonedTestZones  = 5
+	zonedTestBlocks = 16
+	zonedTestBS     = 512
+)
+
+func zonedWriteCmd(d *Device, lba uint64, blocks uint32) *SCSICmd {
+	cdb := make([]byte, 16)
+	cdb[0] = scsi.Write16
+	binary.BigEndian.PutUint64(cdb[2:10], lba)
+	binary.BigEndian.PutUint32(cdb[10:14], blocks)
+	return newTestCmd(d, cdb, make([]byte, int(blocks)*zonedTestBS), 0)
+}
+
+func zoneOpenCmd(d *Device, id uint64) *SCSICmd {
+	cdb := make([]byte, 16)
+	cdb[0] = scsi.ZbcOut
+	cdb[1] = scsi.ZoOpenZone
+	binary.BigEndian.PutUint64(cdb[2:10], id)
+	return newTestCmd(d, cdb, nil, 0)
+}
+
+func newZonedTest(t *testing.T, store *memStore, state string, hostManaged bool, maxOpen int) (*Device, *ZonedCmdHandler) {
+	d := newTestDevice(zonedTestZones*zonedTestBlocks*zonedTestBS, zonedTestBS)
+	h, err := NewZonedCmdHandler(store, ZonedConfig{
+		Sizes:             d.Sizes(),
+		ZoneBlocks:        zonedTestBlocks,
+		ConventionalZones: 1,
+		HostManaged:       hostManaged,
+		MaxOpenZones:      maxOpen,
+		StatePath:         state,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, h
+}
+
+func TestZonedWrite(t *testing.T) {
+	type step func(d *Device) *SCSICmd
+	write := func(lba uint64, blocks uint32) step {
+		return func(d *Device) *SCSICmd { return zonedWriteCmd(d, lba, blocks) }
+	}
+	open := func(id uint64) step {
+		return func(d *Device) *SCSICmd { return zoneOpenCmd(d, id) }
+	}
+	const (
+		notWP    = ZoneCondNotWP
+		empty    = ZoneCondEmpty
+		implicit = ZoneCondImplicitOpen
+		explicit = ZoneCondExplicitOpen
+		closed   = ZoneCondClosed
+		full     = ZoneCondFull
+	)
+	tests := []struct {
+		name        string
+		hostManaged bool
+		maxOpen     int
+		// Commands that must succeed, and the command tested.
+		before []step
+		cmd    step
+		key    byte
+		asc    uint16
+		// The condition and write pointer of every zone afterwards.
+		conds []ZoneCondition
+		wps   []uint64
+	}{
+		{
+			name: "write at the write pointer", hostManaged: true, cmd: write(16, 4),
+			conds: []ZoneCondition{notWP, implicit, empty, empty, empty}, wps: []uint64{0, 20, 32, 48, 64},
+		},
+		{
+			name: "unaligned write", hostManaged: true, cmd: write(18, 4),
+			key: scsi.SenseIllegalRequest, asc: scsi.AscUnalignedWriteCommand,
+			conds: []ZoneCondition{notWP, empty, empty, empty, empty}, wps: []uint64{0, 16, 32, 48, 64},
+		},
+		{
+			name: "fill a zone", hostManaged: true, cmd: write(16, 16),
+			conds: []ZoneCondition{notWP, full, empty, empty, empty}, wps: []uint64{0, 32, 32, 48, 64},
+		},
+		{
+			name: "write to a full zone", hostManaged: true, before: []step{write(16, 16)}, cmd: write(16, 1),
+			key: scsi.SenseIllegalRequest, asc: scsi.AscUnalignedWriteCommand,
+			conds: []ZoneCondition{notWP, full, empty, empty, empty}, wps: []uint64{0, 32, 32, 48, 64},
+		},
+		{
+			name: "write across a zone boundary", hostManaged: true, before: []step{write(16, 12)}, cmd: write(28, 8),
+			key: scsi.SenseIllegalRequest, asc: scsi.AscWriteBoundaryViolation,
+			conds: []ZoneCondition{notWP, implicit, empty, empty, empty}, wps: []uint64{0, 28, 32, 48, 64},
+		},
+		{
+			name: "implicitly open zone closed to make room", hostManaged: true, maxOpen: 1,
+			before: []step{write(16, 4)}, cmd: write(32, 4),
+			conds: []ZoneCondition{notWP, closed, implicit, empty, empty}, wps: []uint64{0, 20, 36, 48, 64},
+		},
+		{
+			name: "explicitly open zone kept open", hostManaged: true, maxOpen: 1,
+			before: []step{open(16)}, cmd: write(32, 4),
+			key: scsi.SenseDataProtect, asc: scsi.AscInsufficientZoneResources,
+			conds: []ZoneCondition{notWP, explicit, empty, empty, empty}, wps: []uint64{0, 16, 32, 48, 64},
+		},
+		{
+			name: "conventional zones are not opened", hostManaged: true, maxOpen: 1,
+			before: []step{open(16)}, cmd: write(0, 4),
+			conds: []ZoneCondition{notWP, explicit, empty, empty, empty}, wps: []uint64{0, 16, 32, 48, 64},
+		},
+		{
+			name: "write across two empty zones over the limit", maxOpen: 1, cmd: write(28, 8),
+			key: scsi.SenseDataProtect, asc: scsi.AscInsufficientZoneResources,
+			conds: []ZoneCondition{notWP, empty, empty, empty, empty}, wps: []uint64{0, 16, 32, 48, 64},
+		},
+		{
+			name: "write across two empty zones", maxOpen: 2, cmd: write(28, 8),
+			conds: []ZoneCondition{notWP, full, implicit, empty, empty}, wps: []uint64{0, 32, 36, 48, 64},
+		},
+		{
+			name: "out of order write to a sequential write preferred zone", before: []step{write(16, 4)}, cmd: write(24, 4),
+			conds: []ZoneCondition{notWP, implicit, empty, empty, empty}, wps: []uint64{0, 28, 32, 48, 64},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := filepath.Join(t.TempDir(), "zones.json")
+			store := &memStore{make([]byte, zonedTestZones*zonedTestBlocks*zonedTestBS)}
+			d, h := newZonedTest(t, store, state, tt.hostManaged, tt.maxOpen)
+			for i, s := range tt.before {
+				resp, err := h.HandleCommand(s(d))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if k, asc := senseOf(resp); k != 0 {
+					t.Fatalf("step %d: sense key 0x%x asc 0x%04x", i, k, asc)
+				}
+			}
+			resp, err := h.HandleCommand(tt.cmd(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k, asc := senseOf(resp); k != tt.key || asc != tt.asc {
+				t.Fatalf("sense key 0x%x asc 0x%04x, want 0x%x 0x%04x", k, asc, tt.key, tt.asc)
+			}
+			conds, wps := zoneStates(h.Zones())
+			if !reflect.DeepEqual(conds, tt.conds) || !reflect.DeepEqual(wps, tt.wps) {
+				t.Errorf("conditions %v write pointers %v, want %v %v", conds, wps, tt.conds, tt.wps)
+			}
+
+			// The conditions survive a restart, and so do the write
+			// pointers of the zones that are not open.
+			_, h = newZonedTest(t, store, state, tt.hostManaged, tt.maxOpen)
+			for i, z := range h.Zones() {
+				if z.Condition != tt.conds[i] || (!z.open() && z.WritePointer != tt.wps[i]) {
+					t.Errorf("zone %d restored as condition 0x%x write pointer %d", i, z.Condition, z.WritePointer)
+				}
+			}
+		})
+	}
+}
+
+func zoneStates(zones []Zone) ([]ZoneCondition, []uint64) {
+	var conds []ZoneCondition
+	var wps []uint64
+	for _, z := range zones {
+		conds = append(conds, z.Condition)
+		wps = append(wps, z.WritePointer)
+	}
+	return conds, wps
+}